@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// normalizeCapability converts a capability name to the uppercase form without the CAP_ prefix
+func normalizeCapability(capability v1.Capability) string {
+	return strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(string(capability))), "CAP_")
+}
+
+// checkCapabilities requires the container to drop ALL and to only add the allowed capabilities,
+// path is the path of the capabilities
+func checkCapabilities(capabilities *v1.Capabilities, path *field.Path, profile *Profile) error {
+	if capabilities == nil {
+		return field.Required(path, "Container must drop all capabilities")
+	}
+
+	dropsAll := false
+	for _, capability := range capabilities.Drop {
+		if normalizeCapability(capability) == "ALL" {
+			dropsAll = true
+		}
+	}
+	if !dropsAll {
+		return field.Required(path.Child("drop"), "Container must drop all capabilities (drop must contain ALL)")
+	}
+
+	for i, capability := range capabilities.Add {
+		name := normalizeCapability(capability)
+		allowed := false
+		for _, allowedName := range profile.Capabilities.Add {
+			if normalizeCapability(v1.Capability(allowedName)) == name {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return field.Forbidden(path.Child("add").Index(i), fmt.Sprintf("Container must not add capability %v", capability))
+		}
+	}
+	return nil
+}
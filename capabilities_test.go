@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestCapabilities(t *testing.T) {
+	profile := defaultProfile()
+	profile.Capabilities.Add = []string{"CAP_NET_BIND_SERVICE"}
+
+	cases := map[string]struct {
+		capabilities *v1.Capabilities
+		allowed      bool
+	}{
+		"lowercase":     {&v1.Capabilities{Drop: []v1.Capability{"all"}}, true},
+		"uppercase":     {&v1.Capabilities{Drop: []v1.Capability{"ALL"}}, true},
+		"dropExtra":     {&v1.Capabilities{Drop: []v1.Capability{"ALL", "NET_RAW"}}, true},
+		"addAllowed":    {&v1.Capabilities{Drop: []v1.Capability{"ALL"}, Add: []v1.Capability{"net_bind_service"}}, true},
+		"addPrefixed":   {&v1.Capabilities{Drop: []v1.Capability{"ALL"}, Add: []v1.Capability{"CAP_NET_BIND_SERVICE"}}, true},
+		"nil":           {nil, false},
+		"dropSome":      {&v1.Capabilities{Drop: []v1.Capability{"NET_RAW"}}, false},
+		"addNotAllowed": {&v1.Capabilities{Drop: []v1.Capability{"ALL"}, Add: []v1.Capability{"SYS_ADMIN"}}, false},
+	}
+
+	for key, val := range cases {
+		err := checkCapabilities(val.capabilities, field.NewPath("capabilities"), &profile)
+		if val.allowed && err != nil {
+			t.Errorf("Valid capabilities `%v` were denied: %v", key, err)
+		}
+		if !val.allowed && err == nil {
+			t.Errorf("Invalid capabilities `%v` were allowed", key)
+		}
+	}
+}
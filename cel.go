@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+)
+
+// Limits of the CEL rules when the policy doesn't set them
+const (
+	defaultCELCostLimit = 1000000
+	defaultCELTimeout   = 100 * time.Millisecond
+)
+
+// CELPolicy declares rules as CEL expressions, evaluated once per request
+type CELPolicy struct {
+	// Maximum cost of an evaluation, defaults to 1000000
+	CostLimit uint64 `json:"costLimit,omitempty"`
+	// Maximum duration of an evaluation, defaults to 100ms
+	Timeout string    `json:"timeout,omitempty"`
+	Rules   []CELRule `json:"rules,omitempty"`
+}
+
+// CELRule denies the requests for which the expression returns false. The expressions can
+// use object, oldObject, request, namespaceObject and params, see the README.
+type CELRule struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+	Message    string `json:"message,omitempty"`
+	// Expression returning the message, Message is used when it fails
+	MessageExpression string `json:"messageExpression,omitempty"`
+	// Field reported in the denial, e.g. spec.template.metadata.labels
+	FieldPath string `json:"fieldPath,omitempty"`
+	// deny by default
+	Severity Severity `json:"severity,omitempty"`
+	// Value of params in the expressions
+	Params interface{} `json:"params,omitempty"`
+}
+
+// celRule is the Rule of a compiled CELRule
+type celRule struct {
+	*CELRule
+	program        cel.Program
+	messageProgram cel.Program
+	timeout        time.Duration
+}
+
+// compile type checks the expressions of the rules against the objects they can receive, an
+// expression must be valid for one of them. They are only compiled once.
+func (policy *CELPolicy) compile(workloads []WorkloadRule) ([]Rule, error) {
+	timeout := defaultCELTimeout
+	if policy.Timeout != "" {
+		parsed, err := time.ParseDuration(policy.Timeout)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid cel timeout %v", policy.Timeout)
+		}
+		timeout = parsed
+	}
+	costLimit := policy.CostLimit
+	if costLimit == 0 {
+		costLimit = defaultCELCostLimit
+	}
+
+	// The programs read the fields of the decoded JSON, whatever the kind of the object
+	env, err := celEnv(nil)
+	if err != nil {
+		return nil, err
+	}
+	checks := []*cel.Env{}
+	for _, objectType := range celObjectTypes {
+		check, err := celEnv(objectType)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+	for _, workload := range workloads {
+		if !workload.isAppsWorkload() {
+			checks = append(checks, env)
+			break
+		}
+	}
+
+	rules := []Rule{}
+	names := map[string]bool{}
+	for i := range policy.Rules {
+		rule := &celRule{CELRule: &policy.Rules[i], timeout: timeout}
+		if rule.Name == "" || rule.Expression == "" {
+			return nil, fmt.Errorf("cel rules must set a name and an expression")
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("cel rule %v is declared twice", rule.Name)
+		}
+		names[rule.Name] = true
+		if severity := rule.CELRule.Severity; severity != "" && severity != SeverityDeny && severity != SeverityWarn {
+			return nil, fmt.Errorf("cel rule %v: severity must be %v or %v", rule.Name, SeverityDeny, SeverityWarn)
+		}
+		if rule.program, err = compileCEL(env, checks, rule.Expression, cel.BoolType, costLimit); err != nil {
+			return nil, fmt.Errorf("cel rule %v: %v", rule.Name, err)
+		}
+		if rule.MessageExpression != "" {
+			if rule.messageProgram, err = compileCEL(env, checks, rule.MessageExpression, cel.StringType, costLimit); err != nil {
+				return nil, fmt.Errorf("cel rule %v: messageExpression: %v", rule.Name, err)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// compileCEL returns the program of the expression in env once it type checks in one of checks
+func compileCEL(env *cel.Env, checks []*cel.Env, expression string, output *cel.Type, costLimit uint64) (cel.Program, error) {
+	// The error of the first kind, jobs, is reported
+	var checkErr error
+	for i, check := range checks {
+		_, err := checkCEL(check, expression, output)
+		if err == nil {
+			checkErr = nil
+			break
+		}
+		if i == 0 {
+			checkErr = err
+		}
+	}
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	ast, err := checkCEL(env, expression, output)
+	if err != nil {
+		return nil, err
+	}
+	return env.Program(ast, cel.CostLimit(costLimit), cel.InterruptCheckFrequency(100))
+}
+
+func checkCEL(env *cel.Env, expression string, output *cel.Type) (*cel.Ast, error) {
+	ast, issues := env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if !ast.OutputType().IsExactType(output) && !ast.OutputType().IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("must return %v, returns %v", output, ast.OutputType())
+	}
+	return ast, nil
+}
+
+func (rule *celRule) ID() string { return "cel." + rule.Name }
+
+func (rule *celRule) Description() string {
+	if rule.Message != "" {
+		return rule.Message
+	}
+	return rule.Expression
+}
+
+func (rule *celRule) Severity() Severity {
+	if rule.CELRule.Severity == "" {
+		return SeverityDeny
+	}
+	return rule.CELRule.Severity
+}
+
+// Evaluate runs the expression against the request of the object, errors and timeouts deny the request
+func (rule *celRule) Evaluate(ctx context.Context, object *Object, profile *Profile) []Violation {
+	if object.Request == nil {
+		return nil
+	}
+	activation, err := requestVariables(object)
+	if err != nil {
+		return []Violation{{Message: fmt.Sprintf("cel rule %v: %v", rule.Name, err), Severity: SeverityDeny}}
+	}
+	activation["params"] = rule.Params
+
+	ctx, cancel := context.WithTimeout(ctx, rule.timeout)
+	defer cancel()
+	result, _, err := rule.program.ContextEval(ctx, activation)
+	if err != nil {
+		return []Violation{{Message: fmt.Sprintf("cel rule %v failed: %v", rule.Name, err), Severity: SeverityDeny}}
+	}
+	if valid, ok := result.(types.Bool); !ok {
+		return []Violation{{Message: fmt.Sprintf("cel rule %v returned %v instead of a bool", rule.Name, result.Type()), Severity: SeverityDeny}}
+	} else if valid {
+		return nil
+	}
+	return []Violation{{Field: rule.FieldPath, Message: rule.message(ctx, activation)}}
+}
+
+// message returns the message of a violation
+func (rule *celRule) message(ctx context.Context, activation map[string]interface{}) string {
+	if rule.messageProgram != nil {
+		if result, _, err := rule.messageProgram.ContextEval(ctx, activation); err == nil {
+			if message, ok := result.(types.String); ok && message != "" {
+				return string(message)
+			}
+		}
+	}
+	if rule.Message != "" {
+		return rule.Message
+	}
+	return fmt.Sprintf("failed expression: %v", rule.Expression)
+}
+
+// requestVariables returns object, oldObject, request and namespaceObject, decoded once per object
+func requestVariables(object *Object) (map[string]interface{}, error) {
+	if object.variables == nil {
+		request := object.Request
+		activation := map[string]interface{}{"oldObject": nil, "namespaceObject": nil}
+		if err := decodeRaw(request.Object.Raw, "object", activation); err != nil {
+			return nil, err
+		}
+		if err := decodeRaw(request.OldObject.Raw, "oldObject", activation); err != nil {
+			return nil, err
+		}
+
+		withoutObjects := *request
+		withoutObjects.Object.Raw, withoutObjects.OldObject.Raw = nil, nil
+		data, err := json.Marshal(withoutObjects)
+		if err != nil {
+			return nil, err
+		}
+		if err := decodeRaw(data, "request", activation); err != nil {
+			return nil, err
+		}
+
+		// Namespaces are only available with the cluster lookups, otherwise it is null
+		if namespace, err := object.Cluster.Namespace(request.Namespace); err == nil {
+			data, err := json.Marshal(namespace)
+			if err != nil {
+				return nil, err
+			}
+			if err := decodeRaw(data, "namespaceObject", activation); err != nil {
+				return nil, err
+			}
+		}
+		object.variables = activation
+	}
+
+	// Copied as params differ per rule
+	activation := map[string]interface{}{}
+	for key, value := range object.variables {
+		activation[key] = value
+	}
+	return activation, nil
+}
+
+func decodeRaw(data []byte, name string, activation map[string]interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("error decoding %v: %v", name, err)
+	}
+	activation[name] = decodeNumbers(value)
+	return nil
+}
+
+// decodeNumbers converts the integers to int64, the type of the integer fields in the expressions
+func decodeNumbers(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if integer, err := value.Int64(); err == nil {
+			return integer
+		}
+		float, _ := value.Float64()
+		return float
+	case map[string]interface{}:
+		for key, item := range value {
+			value[key] = decodeNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = decodeNumbers(item)
+		}
+	}
+	return value
+}
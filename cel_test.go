@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	admission "k8s.io/api/admission/v1beta1"
+	"sigs.k8s.io/yaml"
+)
+
+func celHandler(t *testing.T, policyYAML string) *AdmissionHandler {
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict([]byte(policyYAML), policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &AdmissionHandler{RuntimeClass: "gvisor", Policy: policy}
+}
+
+func TestCELRules(t *testing.T) {
+	handler := celHandler(t, `
+cel:
+  rules:
+  - name: team
+    expression: "has(object.metadata.labels) && object.metadata.labels.exists(k, k in params.keys)"
+    messageExpression: "'job ' + object.metadata.name + ' must set one of ' + params.keys.join(', ')"
+    fieldPath: metadata.labels
+    params:
+      keys: [team, owner]
+  - name: admin
+    expression: "request.userInfo.username != 'kubernetes-admin'"
+    message: use a service account
+    severity: warn
+  - name: deadline
+    expression: "oldObject == null || object.spec.activeDeadlineSeconds <= oldObject.spec.activeDeadlineSeconds"
+    message: activeDeadlineSeconds can't be extended
+  - name: namespace
+    expression: "namespaceObject == null || namespaceObject.metadata.name == object.metadata.namespace"
+`)
+
+	review := loadValidJob(t)
+	allowed, _, err := checkRequest(context.Background(), review.Request, handler)
+	if allowed || err.Error() != "metadata.labels: job busybox must set one of team, owner" {
+		t.Fatalf("Job without labels must be denied with the message expression, got %v", err)
+	}
+
+	job := loadJob(t, review)
+	job.Labels = map[string]string{"owner": "ml"}
+	saveJob(t, review, job)
+	allowed, warnings, err := checkRequest(context.Background(), review.Request, handler)
+	if !allowed || len(warnings) != 1 || warnings[0] != "use a service account" {
+		t.Fatalf("Job must be allowed with a warning, got %v %v", warnings, err)
+	}
+
+	review.Request.Operation = admission.Update
+	review.Request.OldObject.Raw = review.Request.Object.Raw
+	*job.Spec.ActiveDeadlineSeconds = 60
+	saveJob(t, review, job)
+	if allowed, _, err = checkRequest(context.Background(), review.Request, handler); allowed || err.Error() != "activeDeadlineSeconds can't be extended" {
+		t.Fatalf("Update must be denied by the oldObject rule, got %v", err)
+	}
+}
+
+func TestCELLimits(t *testing.T) {
+	items := []string{}
+	for i := 0; i < 500; i++ {
+		items = append(items, fmt.Sprint(i))
+	}
+	expensive := fmt.Sprintf("[%v].map(x, [%[1]v].map(y, x * y)).size() > 0", strings.Join(items, ","))
+	data, _ := json.Marshal(expensive)
+
+	for _, limits := range []string{"costLimit: 1000", "timeout: 1ns"} {
+		handler := celHandler(t, fmt.Sprintf(`
+cel:
+  %v
+  rules:
+  - name: expensive
+    expression: %s
+`, limits, data))
+		allowed, _, err := checkRequest(context.Background(), loadValidJob(t).Request, handler)
+		if allowed || !strings.Contains(err.Error(), "cel rule expensive failed") {
+			t.Errorf("Expression over the %v must be denied, got %v", limits, err)
+		}
+	}
+}
+
+func TestInvalidCELRules(t *testing.T) {
+	cases := map[string]string{
+		"syntax":      `{rules: [{name: a, expression: "object."}]}`,
+		"notBool":     `{rules: [{name: a, expression: "1 + 1"}]}`,
+		"message":     `{rules: [{name: a, expression: "true", messageExpression: "1"}]}`,
+		"undeclared":  `{rules: [{name: a, expression: "pod.x == 1"}]}`,
+		"misspelled":  `{rules: [{name: a, expression: "has(object.spec.templte.metadata.labels)"}]}`,
+		"fieldType":   `{rules: [{name: a, expression: "object.spec.activeDeadlineSeconds == 'a'"}]}`,
+		"typedOutput": `{rules: [{name: a, expression: "object.metadata.name"}]}`,
+		"noName":      `{rules: [{expression: "true"}]}`,
+		"duplicate":   `{rules: [{name: a, expression: "true"}, {name: a, expression: "true"}]}`,
+		"severity":    `{rules: [{name: a, expression: "true", severity: info}]}`,
+		"timeout":     `{timeout: 1x, rules: [{name: a, expression: "true"}]}`,
+		"zeroTimeout": `{timeout: 0s, rules: [{name: a, expression: "true"}]}`,
+	}
+	for key, val := range cases {
+		policy := &Policy{}
+		if err := yaml.UnmarshalStrict([]byte("cel: "+val), policy); err != nil {
+			t.Fatal(err)
+		}
+		if err := policy.validate(); err == nil {
+			t.Errorf("Invalid cel policy `%v` was loaded", key)
+		}
+	}
+}
+
+func validateCELPolicy(t *testing.T, policyYAML string) error {
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict([]byte(policyYAML), policy); err != nil {
+		t.Fatal(err)
+	}
+	return policy.validate()
+}
+
+func TestCELTypes(t *testing.T) {
+	policies := map[string]string{
+		"job":        `{rules: [{name: a, expression: "object.spec.activeDeadlineSeconds + 10 > 30"}]}`,
+		"deployment": `{rules: [{name: a, expression: "!has(object.spec.replicas) || object.spec.replicas <= 3"}]}`,
+		"request":    `{rules: [{name: a, expression: "request.userInfo.groups.exists(g, g == 'system:masters')"}]}`,
+	}
+	for key, val := range policies {
+		if err := validateCELPolicy(t, "cel: "+val); err != nil {
+			t.Errorf("Valid cel policy `%v` was rejected: %v", key, err)
+		}
+	}
+
+	handler := celHandler(t, "cel: "+policies["job"])
+	if allowed, _, err := checkRequest(context.Background(), loadValidJob(t).Request, handler); !allowed {
+		t.Fatalf("Integer fields must be evaluated as ints, got %v", err)
+	}
+
+	custom := `cel: {rules: [{name: a, expression: "has(object.spec.pytorchReplicaSpecs)"}]}`
+	if err := validateCELPolicy(t, custom); err == nil {
+		t.Errorf("Fields of undeclared workloads must be rejected")
+	}
+	workloads := "workloads: [{group: kubeflow.org, kind: PyTorchJob, podTemplatePaths: ['spec.pytorchReplicaSpecs.*.template']}]\n"
+	if err := validateCELPolicy(t, workloads+custom); err != nil {
+		t.Errorf("Objects of custom workloads must be checked as dyn, got %v", err)
+	}
+}
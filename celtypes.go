@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/ext"
+	admission "k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Go types of the objects received by the CEL rules, the expressions are checked against their
+// fields when the policy is loaded. The objects of the other workloads are only checked as dyn.
+var celObjectTypes = []reflect.Type{
+	reflect.TypeOf(batchv1.Job{}),
+	reflect.TypeOf(appsv1.Deployment{}),
+	reflect.TypeOf(appsv1.StatefulSet{}),
+	reflect.TypeOf(appsv1.DaemonSet{}),
+	reflect.TypeOf(appsv1.ReplicaSet{}),
+}
+
+var jsonMarshaler = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+
+// celTypes declares Go API types to the CEL type checker as objects with the fields of their
+// JSON form. The fields have no accessors, so the programs read them from the decoded JSON.
+type celTypes struct {
+	types.Provider
+	structs map[string]map[string]*types.Type
+}
+
+func newCELTypes(provider types.Provider) *celTypes {
+	return &celTypes{Provider: provider, structs: map[string]map[string]*types.Type{}}
+}
+
+// declare returns the CEL type of the JSON form of a Go type, declaring the structs it uses
+func (provider *celTypes) declare(goType reflect.Type) *types.Type {
+	// Quantities, times and int-or-strings have a custom JSON form
+	if goType.Kind() != reflect.Ptr && reflect.PointerTo(goType).Implements(jsonMarshaler) {
+		return types.DynType
+	}
+
+	switch goType.Kind() {
+	case reflect.Ptr:
+		return provider.declare(goType.Elem())
+	case reflect.Bool:
+		return types.BoolType
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return types.IntType
+	case reflect.Float32, reflect.Float64:
+		return types.DoubleType
+	case reflect.String:
+		return types.StringType
+	case reflect.Slice:
+		// Encoded in base64
+		if goType.Elem().Kind() == reflect.Uint8 {
+			return types.StringType
+		}
+		return types.NewListType(provider.declare(goType.Elem()))
+	case reflect.Map:
+		return types.NewMapType(types.StringType, provider.declare(goType.Elem()))
+	case reflect.Struct:
+		name := strings.ReplaceAll(goType.PkgPath(), "/", ".") + "." + goType.Name()
+		if _, ok := provider.structs[name]; !ok {
+			// Declared before its fields, for the recursive types
+			fields := map[string]*types.Type{}
+			provider.structs[name] = fields
+			provider.declareFields(goType, fields)
+		}
+		return types.NewObjectType(name)
+	}
+	return types.DynType
+}
+
+func (provider *celTypes) declareFields(goType reflect.Type, fields map[string]*types.Type) {
+	for i := 0; i < goType.NumField(); i++ {
+		goField := goType.Field(i)
+		if !goField.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(goField.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		// Inlined, e.g. TypeMeta
+		if goField.Anonymous && name == "" {
+			provider.declareFields(goField.Type, fields)
+			continue
+		}
+		if name == "" {
+			name = goField.Name
+		}
+		fields[name] = provider.declare(goField.Type)
+	}
+}
+
+// FindStructType implements types.Provider
+func (provider *celTypes) FindStructType(structType string) (*types.Type, bool) {
+	if _, ok := provider.structs[structType]; ok {
+		return types.NewTypeTypeWithParam(types.NewObjectType(structType)), true
+	}
+	return provider.Provider.FindStructType(structType)
+}
+
+// FindStructFieldNames implements types.Provider
+func (provider *celTypes) FindStructFieldNames(structType string) ([]string, bool) {
+	fields, ok := provider.structs[structType]
+	if !ok {
+		return provider.Provider.FindStructFieldNames(structType)
+	}
+	names := []string{}
+	for name := range fields {
+		names = append(names, name)
+	}
+	return names, true
+}
+
+// FindStructFieldType implements types.Provider
+func (provider *celTypes) FindStructFieldType(structType, fieldName string) (*types.FieldType, bool) {
+	fields, ok := provider.structs[structType]
+	if !ok {
+		return provider.Provider.FindStructFieldType(structType, fieldName)
+	}
+	fieldType, ok := fields[fieldName]
+	if !ok {
+		return nil, false
+	}
+	return &types.FieldType{Type: fieldType}, true
+}
+
+// celEnv returns the environment of the rules, with object and oldObject of the Go type, or dyn
+// when it is nil
+func celEnv(objectType reflect.Type) (*cel.Env, error) {
+	registry, err := types.NewRegistry()
+	if err != nil {
+		return nil, err
+	}
+	provider := newCELTypes(registry)
+	object := types.DynType
+	if objectType != nil {
+		object = provider.declare(objectType)
+	}
+	return cel.NewEnv(
+		cel.CustomTypeAdapter(registry),
+		cel.CustomTypeProvider(provider),
+		cel.Variable("object", object),
+		cel.Variable("oldObject", object),
+		cel.Variable("request", provider.declare(reflect.TypeOf(admission.AdmissionRequest{}))),
+		cel.Variable("namespaceObject", provider.declare(reflect.TypeOf(v1.Namespace{}))),
+		cel.Variable("params", cel.DynType),
+		ext.Strings(),
+	)
+}
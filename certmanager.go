@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Keys of the CA secret. A new CA is kept as the next CA, trusted in the caBundles before it signs
+// certificates, and the CA it replaces stays trusted until it expires
+const (
+	caCertKey         = "ca.pem"
+	caKeyKey          = "ca-key.pem"
+	nextCACertKey     = "next-ca.pem"
+	nextCAKeyKey      = "next-ca-key.pem"
+	previousCACertKey = "previous-ca.pem"
+)
+
+// CertManager serves a short-lived certificate signed by a CA kept in a Secret, and keeps the
+// caBundle of the webhook configurations in sync with the CA. Replicas share the CA, each one
+// issues its own serving certificate.
+type CertManager struct {
+	Client kubernetes.Interface
+	// Namespace and name of the CA secret, created if it does not exist
+	Namespace  string
+	SecretName string
+	// Service of the webhook, the certificate is valid for its DNS names
+	Service string
+	// Name of the ValidatingWebhookConfiguration and MutatingWebhookConfiguration to patch
+	WebhookName  string
+	CAValidity   time.Duration
+	CertValidity time.Duration
+	KeyType      string
+	// How often the certificate and the caBundles are checked
+	RefreshInterval time.Duration
+
+	now   func() time.Time
+	mutex sync.RWMutex
+	cert  *tls.Certificate
+}
+
+// caSet is the content of the CA secret
+type caSet struct {
+	secret *v1.Secret
+	// Signs the serving certificates
+	current *certificateAuthority
+	// Trusted before it replaces the current CA, nil outside of a rotation
+	next *certificateAuthority
+	// Replaced CA, nil when there is none
+	previous    *x509.Certificate
+	previousPEM []byte
+}
+
+func parseCASet(secret *v1.Secret) (*caSet, error) {
+	current, err := parseCA(secret.Data[caCertKey], secret.Data[caKeyKey])
+	if err != nil {
+		return nil, err
+	}
+	cas := &caSet{secret: secret, current: current}
+	if len(secret.Data[nextCACertKey]) > 0 {
+		if cas.next, err = parseCA(secret.Data[nextCACertKey], secret.Data[nextCAKeyKey]); err != nil {
+			return nil, fmt.Errorf("next CA: %v", err)
+		}
+	}
+	if previous := secret.Data[previousCACertKey]; len(previous) > 0 {
+		block, _ := pem.Decode(previous)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("no certificate in the previous CA")
+		}
+		if cas.previous, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, err
+		}
+		cas.previousPEM = previous
+	}
+	return cas, nil
+}
+
+func (cas *caSet) data() map[string][]byte {
+	data := map[string][]byte{caCertKey: cas.current.certPEM, caKeyKey: cas.current.keyPEM}
+	if cas.next != nil {
+		data[nextCACertKey], data[nextCAKeyKey] = cas.next.certPEM, cas.next.keyPEM
+	}
+	if cas.previous != nil {
+		data[previousCACertKey] = cas.previousPEM
+	}
+	return data
+}
+
+// bundle returns the CAs trusted by the webhooks: the current, the next and the previous one
+func (cas *caSet) bundle() []byte {
+	bundle := append([]byte{}, cas.current.certPEM...)
+	if cas.next != nil {
+		bundle = append(bundle, cas.next.certPEM...)
+	}
+	return append(bundle, cas.previousPEM...)
+}
+
+// Start loads or creates the CA, issues the first certificate and rotates it in the background until
+// the context is done. The webhook configurations may not exist yet, failing to patch them is retried
+func (manager *CertManager) Start(ctx context.Context) error {
+	if manager.now == nil {
+		manager.now = time.Now
+	}
+	// The next CA must be trusted for a while before it is used
+	if manager.CAValidity < 3*manager.CertValidity {
+		return fmt.Errorf("CA validity must be at least three times the certificate validity")
+	}
+	if err := manager.refresh(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(manager.RefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := manager.refresh(ctx); err != nil {
+					log.Printf("Error refreshing the certificate: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (manager *CertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+	if manager.cert == nil {
+		return nil, fmt.Errorf("no certificate issued yet")
+	}
+	return manager.cert, nil
+}
+
+// loadCA reads the CAs from the secret, generating it when the secret does not exist
+func (manager *CertManager) loadCA(ctx context.Context) (*caSet, error) {
+	secrets := manager.Client.CoreV1().Secrets(manager.Namespace)
+	secret, err := secrets.Get(ctx, manager.SecretName, k8meta.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		ca, err := newCA(fmt.Sprintf("%v-ca", manager.Service), manager.CAValidity, manager.KeyType)
+		if err != nil {
+			return nil, err
+		}
+		secret = &v1.Secret{
+			ObjectMeta: k8meta.ObjectMeta{Name: manager.SecretName, Namespace: manager.Namespace, Labels: map[string]string{"app": manager.Service}},
+			Data:       map[string][]byte{caCertKey: ca.certPEM, caKeyKey: ca.keyPEM},
+		}
+		created, err := secrets.Create(ctx, secret, k8meta.CreateOptions{})
+		if err == nil {
+			log.Printf("Created CA in secret %v/%v", manager.Namespace, manager.SecretName)
+			return &caSet{secret: created, current: ca}, nil
+		}
+		if !apierrors.IsAlreadyExists(err) {
+			return nil, err
+		}
+		// Another replica created it first
+		secret, err = secrets.Get(ctx, manager.SecretName, k8meta.GetOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseCASet(secret)
+}
+
+// rotateCA reloads the secret, another replica may have rotated the CA. A next CA is generated when
+// a third of the CA validity is left, at least twice the certificate validity, and it replaces the
+// current CA once the certificates would outlive it, at least one refresh after it was published
+func (manager *CertManager) rotateCA(ctx context.Context) (*caSet, error) {
+	cas, err := manager.loadCA(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now, expiry := manager.now(), cas.current.cert.NotAfter
+	if cas.next == nil && now.After(expiry) {
+		return nil, fmt.Errorf("CA expired on %v, delete the secret to generate a new one", expiry)
+	}
+
+	changed := false
+	if cas.previous != nil && now.After(cas.previous.NotAfter) {
+		cas.previous, cas.previousPEM = nil, nil
+		changed = true
+	}
+	window := manager.CAValidity / 3
+	if window < 2*manager.CertValidity {
+		window = 2 * manager.CertValidity
+	}
+	if cas.next == nil && now.After(expiry.Add(-window)) {
+		if cas.next, err = newCA(fmt.Sprintf("%v-ca", manager.Service), manager.CAValidity, manager.KeyType); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated the next CA, it replaces the CA expiring on %v", expiry)
+	} else if cas.next != nil && now.After(expiry.Add(-manager.CertValidity)) {
+		cas.previous, cas.previousPEM = cas.current.cert, cas.current.certPEM
+		cas.current, cas.next = cas.next, nil
+		log.Printf("Replaced the CA expiring on %v", expiry)
+	} else if !changed {
+		return cas, nil
+	}
+
+	secret := cas.secret.DeepCopy()
+	secret.Data = cas.data()
+	updated, err := manager.Client.CoreV1().Secrets(manager.Namespace).Update(ctx, secret, k8meta.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		// Another replica rotated it first
+		return manager.loadCA(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cas.secret = updated
+	return cas, nil
+}
+
+// refresh rotates the CA, issues a new certificate when a third of its validity is left or the CA
+// was replaced, and patches the caBundles. Nothing is issued when the CA can't be used
+func (manager *CertManager) refresh(ctx context.Context) error {
+	cas, err := manager.rotateCA(ctx)
+	if err != nil {
+		return fmt.Errorf("error loading the CA from secret %v/%v: %v", manager.Namespace, manager.SecretName, err)
+	}
+	manager.mutex.RLock()
+	cert := manager.cert
+	manager.mutex.RUnlock()
+	if cert == nil || manager.now().After(cert.Leaf.NotAfter.Add(-manager.CertValidity/3)) || cert.Leaf.CheckSignatureFrom(cas.current.cert) != nil {
+		if err := manager.issue(cas.current); err != nil {
+			return fmt.Errorf("error issuing the serving certificate: %v", err)
+		}
+	}
+	if err := manager.patchCABundles(ctx, cas.bundle()); err != nil {
+		log.Printf("Error patching the caBundle of %v: %v", manager.WebhookName, err)
+	}
+	return nil
+}
+
+func (manager *CertManager) issue(ca *certificateAuthority) error {
+	certPEM, keyPEM, err := ca.issue(serviceNames(manager.Service, manager.Namespace), manager.CertValidity, manager.KeyType)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	manager.mutex.Lock()
+	manager.cert = &cert
+	manager.mutex.Unlock()
+	log.Printf("Issued serving certificate valid until %v", cert.Leaf.NotAfter)
+	return nil
+}
+
+// patchCABundles sets the bundle in every webhook of the configurations, they are only updated when
+// the caBundle differs. The MutatingWebhookConfiguration is optional
+func (manager *CertManager) patchCABundles(ctx context.Context, bundle []byte) error {
+	registration := manager.Client.AdmissionregistrationV1()
+	validating, err := registration.ValidatingWebhookConfigurations().Get(ctx, manager.WebhookName, k8meta.GetOptions{})
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i := range validating.Webhooks {
+		if !bytes.Equal(validating.Webhooks[i].ClientConfig.CABundle, bundle) {
+			validating.Webhooks[i].ClientConfig.CABundle = bundle
+			changed = true
+		}
+	}
+	if changed {
+		if _, err := registration.ValidatingWebhookConfigurations().Update(ctx, validating, k8meta.UpdateOptions{}); err != nil {
+			return err
+		}
+		log.Printf("Patched the caBundle of ValidatingWebhookConfiguration %v", manager.WebhookName)
+	}
+
+	mutating, err := registration.MutatingWebhookConfigurations().Get(ctx, manager.WebhookName, k8meta.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	changed = false
+	for i := range mutating.Webhooks {
+		if !bytes.Equal(mutating.Webhooks[i].ClientConfig.CABundle, bundle) {
+			mutating.Webhooks[i].ClientConfig.CABundle = bundle
+			changed = true
+		}
+	}
+	if changed {
+		if _, err := registration.MutatingWebhookConfigurations().Update(ctx, mutating, k8meta.UpdateOptions{}); err != nil {
+			return err
+		}
+		log.Printf("Patched the caBundle of MutatingWebhookConfiguration %v", manager.WebhookName)
+	}
+	return nil
+}
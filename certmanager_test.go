@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	v1 "k8s.io/api/core/v1"
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testWebhookName = "simple-admission.admission.svc"
+
+func webhookConfigurations(caBundle []byte) []runtime.Object {
+	clientConfig := admissionregistrationv1.WebhookClientConfig{CABundle: caBundle}
+	return []runtime.Object{
+		&admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: k8meta.ObjectMeta{Name: testWebhookName},
+			Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: testWebhookName, ClientConfig: clientConfig}},
+		},
+		&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: k8meta.ObjectMeta{Name: testWebhookName},
+			Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: testWebhookName, ClientConfig: clientConfig}},
+		},
+	}
+}
+
+func testCertManager(client *fake.Clientset, now *time.Time) *CertManager {
+	return &CertManager{
+		Client:          client,
+		Namespace:       "admission",
+		SecretName:      "admission-ca",
+		Service:         "simple-admission",
+		WebhookName:     testWebhookName,
+		CAValidity:      48 * time.Hour,
+		CertValidity:    3 * time.Hour,
+		KeyType:         KeyECDSAP256,
+		RefreshInterval: time.Hour,
+		now:             func() time.Time { return *now },
+	}
+}
+
+// caBundles returns the caBundles of the validating and mutating webhooks
+func caBundles(t *testing.T, client *fake.Clientset) ([]byte, []byte) {
+	registration := client.AdmissionregistrationV1()
+	validating, err := registration.ValidatingWebhookConfigurations().Get(context.Background(), testWebhookName, k8meta.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutating, err := registration.MutatingWebhookConfigurations().Get(context.Background(), testWebhookName, k8meta.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return validating.Webhooks[0].ClientConfig.CABundle, mutating.Webhooks[0].ClientConfig.CABundle
+}
+
+func TestCertManager(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	now := time.Now()
+	client := fake.NewSimpleClientset(webhookConfigurations(nil)...)
+	manager := testCertManager(client, &now)
+	if err := manager.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := client.CoreV1().Secrets("admission").Get(ctx, "admission-ca", k8meta.GetOptions{})
+	if err != nil {
+		t.Fatalf("CA secret must be created: %v", err)
+	}
+	validating, mutating := caBundles(t, client)
+	if !bytes.Equal(validating, secret.Data[caCertKey]) || !bytes.Equal(mutating, secret.Data[caCertKey]) {
+		t.Errorf("caBundles must be patched with the CA")
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(secret.Data[caCertKey])
+	cert, err := manager.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range serviceNames("simple-admission", "admission") {
+		if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("Certificate must be valid for %v: %v", name, err)
+		}
+	}
+
+	// Not rotated until a third of the validity is left
+	now = now.Add(time.Hour)
+	if err := manager.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := manager.GetCertificate(nil); current != cert {
+		t.Errorf("Certificate must not be rotated early")
+	}
+	now = now.Add(time.Hour + time.Minute)
+	if err := manager.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := manager.GetCertificate(nil); current == cert {
+		t.Errorf("Certificate must be rotated before expiring")
+	}
+
+	// A replaced caBundle is patched again
+	validatingConfiguration := webhookConfigurations([]byte("stale"))[0].(*admissionregistrationv1.ValidatingWebhookConfiguration)
+	if _, err := client.AdmissionregistrationV1().ValidatingWebhookConfigurations().Update(ctx, validatingConfiguration, k8meta.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if validating, _ := caBundles(t, client); !bytes.Equal(validating, secret.Data[caCertKey]) {
+		t.Errorf("Stale caBundle must be patched")
+	}
+}
+
+func TestCertManagerExistingCA(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ca, err := newCA("existing", 24*time.Hour, KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := &v1.Secret{
+		ObjectMeta: k8meta.ObjectMeta{Name: "admission-ca", Namespace: "admission"},
+		Data:       map[string][]byte{caCertKey: ca.certPEM, caKeyKey: ca.keyPEM},
+	}
+	now := time.Now()
+	// Only the validating webhook is deployed
+	client := fake.NewSimpleClientset(append(webhookConfigurations(nil)[:1], secret)...)
+	manager := testCertManager(client, &now)
+	if err := manager.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := manager.GetCertificate(nil)
+	if err := cert.Leaf.CheckSignatureFrom(ca.cert); err != nil {
+		t.Errorf("Certificate must be signed by the existing CA: %v", err)
+	}
+
+	now = now.Add(25 * time.Hour)
+	if err := manager.refresh(ctx); err == nil {
+		t.Errorf("Expired CA must not issue certificates")
+	}
+	if current, _ := manager.GetCertificate(nil); current != cert {
+		t.Errorf("Certificate must not be reissued with an expired CA")
+	}
+	if err := testCertManager(client, &now).Start(ctx); err == nil {
+		t.Errorf("Expired CA must be rejected")
+	}
+}
+
+func TestCertManagerRotation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	now := time.Now()
+	client := fake.NewSimpleClientset(webhookConfigurations(nil)...)
+	manager := testCertManager(client, &now)
+	if err := manager.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := client.CoreV1().Secrets("admission").Get(ctx, "admission-ca", k8meta.GetOptions{})
+	ca, err := parseCA(secret.Data[caCertKey], secret.Data[caKeyKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The next CA is trusted a third of the CA validity before it expires, and doesn't sign yet
+	now = ca.cert.NotAfter.Add(-15 * time.Hour)
+	if err := manager.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	secret, _ = client.CoreV1().Secrets("admission").Get(ctx, "admission-ca", k8meta.GetOptions{})
+	next := secret.Data[nextCACertKey]
+	validating, mutating := caBundles(t, client)
+	if len(next) == 0 || !bytes.Equal(validating, append(append([]byte{}, ca.certPEM...), next...)) || !bytes.Equal(mutating, validating) {
+		t.Fatalf("caBundles must trust the current and the next CA")
+	}
+	cert, _ := manager.GetCertificate(nil)
+	if err := cert.Leaf.CheckSignatureFrom(ca.cert); err != nil {
+		t.Errorf("Next CA must not sign before it replaces the CA: %v", err)
+	}
+
+	// It replaces the CA before the certificates outlive it, the replaced CA stays trusted
+	now = ca.cert.NotAfter.Add(-2 * time.Hour)
+	if err := manager.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	secret, _ = client.CoreV1().Secrets("admission").Get(ctx, "admission-ca", k8meta.GetOptions{})
+	if !bytes.Equal(secret.Data[caCertKey], next) || !bytes.Equal(secret.Data[previousCACertKey], ca.certPEM) || len(secret.Data[nextCACertKey]) > 0 {
+		t.Fatalf("Next CA must replace the CA")
+	}
+	validating, _ = caBundles(t, client)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(validating)
+	rotated, _ := manager.GetCertificate(nil)
+	if rotated == cert || !bytes.Contains(validating, ca.certPEM) {
+		t.Errorf("Certificate must be reissued and the replaced CA must stay trusted")
+	}
+	if _, err := rotated.Leaf.Verify(x509.VerifyOptions{DNSName: serviceNames("simple-admission", "admission")[0], Roots: roots}); err != nil {
+		t.Errorf("Certificate of the new CA must be trusted by the caBundle: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// Key types of the generated certificates
+const (
+	KeyRSA2048   = "rsa2048"
+	KeyRSA4096   = "rsa4096"
+	KeyECDSAP256 = "ecdsa-p256"
+	KeyECDSAP384 = "ecdsa-p384"
+	KeyEd25519   = "ed25519"
+)
+
+var keyTypes = []string{KeyRSA2048, KeyRSA4096, KeyECDSAP256, KeyECDSAP384, KeyEd25519}
+
+// certificateAuthority signs the serving certificates of the webhook
+type certificateAuthority struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// PEM encoded certificate and PKCS#8 key
+	certPEM, keyPEM []byte
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case KeyECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key type %v, must be one of %v", keyType, keyTypes)
+}
+
+// newCA generates a self-signed CA
+func newCA(commonName string, validity time.Duration, keyType string) (*certificateAuthority, error) {
+	key, err := generateKey(keyType)
+	if err != nil {
+		return nil, err
+	}
+	template, err := certificateTemplate(commonName, validity)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, keyPEM, err := encodePEM(der, key)
+	if err != nil {
+		return nil, err
+	}
+	return parseCA(certPEM, keyPEM)
+}
+
+// parseCA loads a CA from its PEM encoded certificate and key
+func parseCA(certPEM, keyPEM []byte) (*certificateAuthority, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate in the CA")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("certificate %v is not a CA", cert.Subject.CommonName)
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no key in the CA")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported CA key")
+	}
+	return &certificateAuthority{cert: cert, key: key, certPEM: certPEM, keyPEM: keyPEM}, nil
+}
+
+// issue returns the PEM encoded serving certificate and key for the SANs, DNS names or IPs.
+// The first SAN is used as common name
+func (ca *certificateAuthority) issue(sans []string, validity time.Duration, keyType string) ([]byte, []byte, error) {
+	if len(sans) == 0 {
+		return nil, nil, fmt.Errorf("serving certificates need at least a SAN")
+	}
+	key, err := generateKey(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := certificateTemplate(sans[0], validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, san)
+		}
+	}
+	return ca.sign(template, key)
+}
+
+// issueClient returns the PEM encoded client certificate and key for the common name
+func (ca *certificateAuthority) issueClient(commonName string, validity time.Duration, keyType string) ([]byte, []byte, error) {
+	key, err := generateKey(keyType)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := certificateTemplate(commonName, validity)
+	if err != nil {
+		return nil, nil, err
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return ca.sign(template, key)
+}
+
+func (ca *certificateAuthority) sign(template *x509.Certificate, key crypto.Signer) ([]byte, []byte, error) {
+	// A certificate can't outlive its CA
+	if template.NotAfter.After(ca.cert.NotAfter) {
+		template.NotAfter = ca.cert.NotAfter
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return encodePEM(der, key)
+}
+
+func certificateTemplate(commonName string, validity time.Duration) (*x509.Certificate, error) {
+	if validity <= 0 {
+		return nil, fmt.Errorf("validity must be positive")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	// Backdated to tolerate clock skew between the nodes
+	now := time.Now().Add(-5 * time.Minute)
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now,
+		NotAfter:     now.Add(validity),
+	}, nil
+}
+
+func encodePEM(der []byte, key crypto.Signer) ([]byte, []byte, error) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), nil
+}
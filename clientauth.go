@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// requireClientCerts makes the server only accept clients with a certificate signed by the CA in
+// caFile. When allowedNames is set, the common name or a DNS/URI SAN of the client certificate must
+// match one of its glob patterns, see compileNamePattern
+func requireClientCerts(config *tls.Config, caFile string, allowedNames []string) error {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates in %v", caFile)
+	}
+	patterns := []*regexp.Regexp{}
+	for _, pattern := range allowedNames {
+		compiled, err := compileNamePattern(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid client name pattern %v: %v", pattern, err)
+		}
+		patterns = append(patterns, compiled)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if len(allowedNames) > 0 {
+		config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			// The chains are already verified against the CA, the first certificate is the client's
+			if len(chains) == 0 || len(chains[0]) == 0 {
+				return fmt.Errorf("no verified client certificate")
+			}
+			return verifyClientName(chains[0][0], patterns)
+		}
+	}
+	return nil
+}
+
+// verifyClientName checks the common name and SANs of the client certificate against the allowlist
+func verifyClientName(cert *x509.Certificate, patterns []*regexp.Regexp) error {
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		for _, pattern := range patterns {
+			if pattern.MatchString(name) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client certificate %v is not in the allowed names", cert.Subject.CommonName)
+}
+
+// compileNamePattern converts a glob pattern with the syntax of path.Match to a regexp, but * and ?
+// also match the / of the URI SANs, e.g. spiffe://cluster.local/* matches every path
+func compileNamePattern(pattern string) (*regexp.Regexp, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	// The pattern is valid, every escape is followed by a character and every class is closed
+	runes := []rune(pattern)
+	expression := strings.Builder{}
+	expression.WriteString("(?s)^")
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '*':
+			expression.WriteString(".*")
+		case '?':
+			expression.WriteString(".")
+		case '\\':
+			i++
+			expression.WriteString(regexp.QuoteMeta(string(runes[i])))
+		case '[':
+			expression.WriteString("[")
+			if i++; runes[i] == '^' {
+				expression.WriteString("^")
+				i++
+			}
+			for ; runes[i] != ']'; i++ {
+				// Unescaped dashes are ranges, escaped ones are literal
+				if runes[i] == '-' {
+					expression.WriteString("-")
+					continue
+				}
+				if runes[i] == '\\' {
+					i++
+				}
+				if runes[i] == '-' {
+					expression.WriteString(`\-`)
+				} else {
+					expression.WriteString(regexp.QuoteMeta(string(runes[i])))
+				}
+			}
+			expression.WriteString("]")
+		default:
+			expression.WriteString(regexp.QuoteMeta(string(runes[i])))
+		}
+	}
+	expression.WriteString("$")
+	return regexp.Compile(expression.String())
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireClientCerts(t *testing.T) {
+	serverCA, err := newCA("server-ca", time.Hour, KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, serverKey, err := serverCA.issue([]string{"127.0.0.1"}, time.Hour, KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCA, err := newCA("client-ca", time.Hour, KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCA, err := newCA("other-ca", time.Hour, KeyECDSAP256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "client-ca.pem")
+	if err := ioutil.WriteFile(caFile, clientCA.certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	cert, err := tls.X509KeyPair(serverCert, serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	if err := requireClientCerts(server.TLS, caFile, []string{"kube-apiserver", "system:*"}); err != nil {
+		t.Fatal(err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverCA.certPEM)
+	clientCert := func(ca *certificateAuthority, name string) []tls.Certificate {
+		certPEM, keyPEM, err := ca.issueClient(name, time.Hour, KeyECDSAP256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []tls.Certificate{cert}
+	}
+	tests := []struct {
+		name    string
+		certs   []tls.Certificate
+		allowed bool
+	}{
+		{"allowed", clientCert(clientCA, "kube-apiserver"), true},
+		{"pattern", clientCert(clientCA, "system:apiserver"), true},
+		{"not allowed", clientCert(clientCA, "attacker"), false},
+		{"other CA", clientCert(otherCA, "kube-apiserver"), false},
+		{"no certificate", nil, false},
+	}
+	for _, test := range tests {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: test.certs}}}
+		response, err := client.Get(server.URL)
+		if err == nil {
+			response.Body.Close()
+		}
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%v: expected allowed %v, got error %v", test.name, test.allowed, err)
+		}
+	}
+
+	if err := requireClientCerts(&tls.Config{}, caFile, []string{"["}); err == nil {
+		t.Errorf("Invalid pattern must be rejected")
+	}
+	if err := requireClientCerts(&tls.Config{}, filepath.Join(t.TempDir(), "missing.pem"), nil); err == nil {
+		t.Errorf("Missing CA must be rejected")
+	}
+}
+
+func TestVerifyClientName(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		allowed bool
+	}{
+		{"kube-apiserver", "kube-apiserver", true},
+		{"system:*", "system:apiserver", true},
+		{"*.example.com", "apiserver.example.com", true},
+		{"apiserver-?", "apiserver-1", true},
+		{"apiserver-[0-9]", "apiserver-a", false},
+		{"apiserver-[^0-9]", "apiserver-a", true},
+		{`apiserver-[a\-z]`, "apiserver--", true},
+		{`apiserver-[a\-z]`, "apiserver-b", false},
+		{`apiserver\*`, "apiserver*", true},
+		{`apiserver\*`, "apiserver-1", false},
+		// * and ? match the / of the URI SANs
+		{"spiffe://cluster.local/*", "spiffe://cluster.local/ns/kube-system/sa/apiserver", true},
+		{"spiffe://cluster.local/ns/?ube-system/*", "spiffe://cluster.local/ns/kube-system/sa/apiserver", true},
+		{"spiffe://cluster.local/*", "spiffe://other.local/ns/kube-system/sa/apiserver", false},
+	}
+	for _, test := range cases {
+		pattern, err := compileNamePattern(test.pattern)
+		if err != nil {
+			t.Fatalf("%v: %v", test.pattern, err)
+		}
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}}
+		if strings.Contains(test.name, "://") {
+			uri, err := url.Parse(test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert.URIs = []*url.URL{uri}
+		} else {
+			cert.DNSNames = []string{test.name}
+		}
+		if allowed := verifyClientName(cert, []*regexp.Regexp{pattern}) == nil; allowed != test.allowed {
+			t.Errorf("%v matching %v: expected allowed %v", test.pattern, test.name, test.allowed)
+		}
+	}
+
+	for _, pattern := range []string{"[", "[a", `a\`, "[]"} {
+		if _, err := compileNamePattern(pattern); err == nil {
+			t.Errorf("Invalid pattern %v was compiled", pattern)
+		}
+	}
+}
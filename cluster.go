@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	nodev1 "k8s.io/api/node/v1"
+	schedulingv1 "k8s.io/api/scheduling/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	nodelisters "k8s.io/client-go/listers/node/v1"
+	schedulinglisters "k8s.io/client-go/listers/scheduling/v1"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/metadata/metadatainformer"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	resyncPeriod = 10 * time.Minute
+	syncTimeout  = time.Minute
+)
+
+var errLookupDisabled = errors.New("cluster lookups are not enabled")
+
+// Cluster gives the checks read access to the objects referenced by a job.
+// Only metadata is cached, so the webhook never holds the content of secrets.
+type Cluster struct {
+	Secrets         cache.GenericLister
+	ConfigMaps      cache.GenericLister
+	Namespaces      cache.GenericLister
+	ServiceAccounts corelisters.ServiceAccountLister
+	RuntimeClasses  nodelisters.RuntimeClassLister
+	PriorityClasses schedulinglisters.PriorityClassLister
+}
+
+// LoadClientConfig uses the kubeconfig file if set, otherwise the in-cluster configuration
+func LoadClientConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	return rest.InClusterConfig()
+}
+
+// NewCluster starts the informers and waits until their caches are synced. Namespaces are always
+// cached, the other objects only when the profiles of the policy read them
+func NewCluster(ctx context.Context, config *rest.Config, policy *Policy) (*Cluster, error) {
+	metadataClient, err := metadata.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	metadataFactory := metadatainformer.NewSharedInformerFactory(metadataClient, resyncPeriod)
+	factory := informers.NewSharedInformerFactory(client, resyncPeriod)
+	cluster := &Cluster{
+		Namespaces: metadataFactory.ForResource(schema.GroupVersionResource{Version: "v1", Resource: "namespaces"}).Lister(),
+	}
+	lookups := policy.lookups()
+	if lookups.Secrets {
+		cluster.Secrets = metadataFactory.ForResource(schema.GroupVersionResource{Version: "v1", Resource: "secrets"}).Lister()
+	}
+	if lookups.ConfigMaps {
+		cluster.ConfigMaps = metadataFactory.ForResource(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}).Lister()
+	}
+	if lookups.ServiceAccounts {
+		cluster.ServiceAccounts = factory.Core().V1().ServiceAccounts().Lister()
+	}
+	if lookups.RuntimeClasses {
+		cluster.RuntimeClasses = factory.Node().V1().RuntimeClasses().Lister()
+	}
+	if lookups.PriorityClasses {
+		cluster.PriorityClasses = factory.Scheduling().V1().PriorityClasses().Lister()
+	}
+
+	metadataFactory.Start(ctx.Done())
+	factory.Start(ctx.Done())
+	syncCtx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+	for resource, synced := range metadataFactory.WaitForCacheSync(syncCtx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("failed to sync cache of %v", resource.Resource)
+		}
+	}
+	for informer, synced := range factory.WaitForCacheSync(syncCtx.Done()) {
+		if !synced {
+			return nil, fmt.Errorf("failed to sync cache of %v", informer)
+		}
+	}
+	return cluster, nil
+}
+
+// SecretLabels returns the labels of a secret
+func (cluster *Cluster) SecretLabels(namespace, name string) (map[string]string, error) {
+	if cluster == nil || cluster.Secrets == nil {
+		return nil, errLookupDisabled
+	}
+	return objectLabels(cluster.Secrets, namespace, name)
+}
+
+// ConfigMapLabels returns the labels of a config map
+func (cluster *Cluster) ConfigMapLabels(namespace, name string) (map[string]string, error) {
+	if cluster == nil || cluster.ConfigMaps == nil {
+		return nil, errLookupDisabled
+	}
+	return objectLabels(cluster.ConfigMaps, namespace, name)
+}
+
+// NamespaceLabels returns the labels of a namespace
+func (cluster *Cluster) NamespaceLabels(name string) (map[string]string, error) {
+	if cluster == nil || cluster.Namespaces == nil {
+		return nil, errLookupDisabled
+	}
+	obj, err := cluster.Namespaces.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	return accessor.GetLabels(), nil
+}
+
+// Namespace returns the metadata of a namespace
+func (cluster *Cluster) Namespace(name string) (runtime.Object, error) {
+	if cluster == nil || cluster.Namespaces == nil {
+		return nil, errLookupDisabled
+	}
+	return cluster.Namespaces.Get(name)
+}
+
+// ServiceAccount returns a service account from the cache
+func (cluster *Cluster) ServiceAccount(namespace, name string) (*v1.ServiceAccount, error) {
+	if cluster == nil || cluster.ServiceAccounts == nil {
+		return nil, errLookupDisabled
+	}
+	return cluster.ServiceAccounts.ServiceAccounts(namespace).Get(name)
+}
+
+// RuntimeClass returns a runtime class from the cache
+func (cluster *Cluster) RuntimeClass(name string) (*nodev1.RuntimeClass, error) {
+	if cluster == nil || cluster.RuntimeClasses == nil {
+		return nil, errLookupDisabled
+	}
+	return cluster.RuntimeClasses.Get(name)
+}
+
+// PriorityClass returns a priority class from the cache, an empty name returns the
+// global default class or nil if there is none
+func (cluster *Cluster) PriorityClass(name string) (*schedulingv1.PriorityClass, error) {
+	if cluster == nil || cluster.PriorityClasses == nil {
+		return nil, errLookupDisabled
+	}
+	if name != "" {
+		return cluster.PriorityClasses.Get(name)
+	}
+	classes, err := cluster.PriorityClasses.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	return globalDefaultPriorityClass(classes), nil
+}
+
+// objectLabels returns the labels of a namespaced object from the lister cache
+func objectLabels(lister cache.GenericLister, namespace, name string) (map[string]string, error) {
+	if lister == nil {
+		return nil, errLookupDisabled
+	}
+	obj, err := lister.ByNamespace(namespace).Get(name)
+	if err != nil {
+		return nil, err
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	return accessor.GetLabels(), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// CommandRule denies a container command matching a regex or an argv prefix
+type CommandRule struct {
+	// Regex matched against every element of command and args
+	Regex string `json:"regex,omitempty"`
+	// Prefix matched against command followed by args, e.g. ["sh", "-c"]
+	Prefix []string `json:"prefix,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// UnmarshalJSON compiles the regex of the rule
+func (rule *CommandRule) UnmarshalJSON(data []byte) error {
+	type plain CommandRule
+	if err := json.Unmarshal(data, (*plain)(rule)); err != nil {
+		return err
+	}
+	return rule.compile()
+}
+
+func (rule *CommandRule) compile() error {
+	if (rule.Regex == "") == (len(rule.Prefix) == 0) {
+		return fmt.Errorf("command rules must set either a regex or a prefix")
+	}
+	if rule.Regex == "" {
+		return nil
+	}
+	regex, err := regexp.Compile(rule.Regex)
+	if err != nil {
+		return fmt.Errorf("invalid command regex %v: %v", rule.Regex, err)
+	}
+	rule.regex = regex
+	return nil
+}
+
+// match returns the path of the element matching the rule, nil if none does
+func (rule *CommandRule) match(container *v1.Container, path *field.Path) *field.Path {
+	if rule.regex != nil {
+		for i, command := range container.Command {
+			if rule.regex.MatchString(command) {
+				return path.Child("command").Index(i)
+			}
+		}
+		for i, arg := range container.Args {
+			if rule.regex.MatchString(arg) {
+				return path.Child("args").Index(i)
+			}
+		}
+		return nil
+	}
+
+	argv := append(append([]string{}, container.Command...), container.Args...)
+	if len(argv) < len(rule.Prefix) {
+		return nil
+	}
+	for i, prefix := range rule.Prefix {
+		if argv[i] != prefix {
+			return nil
+		}
+	}
+	if len(container.Command) > 0 {
+		return path.Child("command").Index(0)
+	}
+	return path.Child("args").Index(0)
+}
+
+// checkContainerCommand validates the env names and the command of a container
+func checkContainerCommand(container *v1.Container, path *field.Path, profile *Profile) error {
+	if err := checkEnvNames(container, path, profile); err != nil {
+		return err
+	}
+	return checkCommand(container, path, profile)
+}
+
+// checkCommand validates command and args against the denied command rules of the profile
+func checkCommand(container *v1.Container, path *field.Path, profile *Profile) error {
+	for _, rule := range profile.DeniedCommands {
+		if match := rule.match(container, path); match != nil {
+			if rule.Regex != "" {
+				return field.Forbidden(match, fmt.Sprintf("must not match %v", rule.Regex))
+			}
+			return field.Forbidden(match, fmt.Sprintf("must not start with %v", strings.Join(rule.Prefix, " ")))
+		}
+	}
+	return nil
+}
+
+// checkEnvNames validates the env names against the allowed and denied patterns of the profile,
+// the denied patterns ignore case as most tools also read the lowercase proxy variables
+func checkEnvNames(container *v1.Container, path *field.Path, profile *Profile) error {
+	for i, env := range container.Env {
+		envPath := path.Child("env").Index(i)
+		for _, pattern := range profile.Env.DeniedNames {
+			if matched, _ := matchIgnoreCase(pattern, env.Name); matched {
+				return field.Forbidden(envPath, fmt.Sprintf("env %v is not allowed", env.Name))
+			}
+		}
+		if len(profile.Env.AllowedNames) > 0 && !matchAny(profile.Env.AllowedNames, env.Name) {
+			return field.Forbidden(envPath, fmt.Sprintf("env %v is not in the allowed names", env.Name))
+		}
+	}
+	return nil
+}
+
+func matchIgnoreCase(pattern, name string) (bool, error) {
+	return path.Match(strings.ToUpper(pattern), strings.ToUpper(name))
+}
+
+// matchAny returns if the value matches any of the glob patterns
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+)
+
+func commandProfile(t *testing.T) *Profile {
+	profile := &Profile{}
+	if err := yaml.Unmarshal([]byte(`
+env:
+  allowedNames: ["APP_*", "LD_PRELOAD", "https_proxy"]
+deniedCommands:
+- prefix: ["sh", "-c"]
+- regex: "^(curl|wget)$"
+`), profile); err != nil {
+		t.Fatal(err)
+	}
+	return profile
+}
+
+func TestContainerCommand(t *testing.T) {
+	cases := map[string]struct {
+		container v1.Container
+		path      string
+	}{
+		"valid":        {v1.Container{Command: []string{"sleep"}, Args: []string{"120"}, Env: []v1.EnvVar{{Name: "APP_MODE"}}}, ""},
+		"preload":      {v1.Container{Env: []v1.EnvVar{{Name: "APP_MODE"}, {Name: "LD_PRELOAD"}}}, "containers[0].env[1]"},
+		"proxy":        {v1.Container{Env: []v1.EnvVar{{Name: "https_proxy"}}}, "containers[0].env[0]"},
+		"notAllowed":   {v1.Container{Env: []v1.EnvVar{{Name: "OTHER"}}}, "containers[0].env[0]"},
+		"shell":        {v1.Container{Command: []string{"sh", "-c", "echo"}}, "containers[0].command[0]"},
+		"shellArgs":    {v1.Container{Command: []string{"sh"}, Args: []string{"-c", "echo"}}, "containers[0].command[0]"},
+		"shellNoCmd":   {v1.Container{Args: []string{"sh", "-c"}}, "containers[0].args[0]"},
+		"shellScript":  {v1.Container{Command: []string{"sh", "script.sh"}}, ""},
+		"regexCommand": {v1.Container{Command: []string{"/bin/run", "curl"}}, "containers[0].command[1]"},
+		"regexArg":     {v1.Container{Command: []string{"run"}, Args: []string{"a", "wget"}}, "containers[0].args[1]"},
+	}
+
+	for key, val := range cases {
+		err := checkContainerCommand(&val.container, field.NewPath("containers").Index(0), commandProfile(t))
+		if val.path == "" && err != nil {
+			t.Errorf("Valid container `%v` was denied: %v", key, err)
+		}
+		if val.path != "" && (err == nil || !strings.HasPrefix(err.Error(), val.path+":")) {
+			t.Errorf("Container `%v` must be denied at %v, got %v", key, val.path, err)
+		}
+	}
+}
+
+func TestInvalidCommandRule(t *testing.T) {
+	rules := []string{`{"regex": "("}`, `{}`, `{"regex": "sh", "prefix": ["sh"]}`}
+	for _, rule := range rules {
+		if err := yaml.Unmarshal([]byte(rule), &CommandRule{}); err == nil {
+			t.Errorf("Invalid command rule %v was loaded", rule)
+		}
+	}
+}
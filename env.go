@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+type labelLookup func(namespace, name string) (map[string]string, error)
+
+// checkEnv validates the env and envFrom references of a container against the profile allowlists,
+// path is the path of the container
+func checkEnv(container *v1.Container, path *field.Path, namespace string, profile *Profile, cluster *Cluster) error {
+	for i, env := range container.Env {
+		if env.ValueFrom == nil {
+			continue
+		}
+
+		var err error
+		source := env.ValueFrom
+		switch {
+		case source.SecretKeyRef != nil:
+			err = checkRef("secret", profile.Env.Secrets, cluster.SecretLabels, namespace, source.SecretKeyRef.Name, source.SecretKeyRef.Key)
+		case source.ConfigMapKeyRef != nil:
+			err = checkRef("configMap", profile.Env.ConfigMaps, cluster.ConfigMapLabels, namespace, source.ConfigMapKeyRef.Name, source.ConfigMapKeyRef.Key)
+		case source.FieldRef != nil:
+			if !contains(profile.Env.FieldRefs, source.FieldRef.FieldPath) {
+				err = fmt.Errorf("fieldRef %v is not allowed", source.FieldRef.FieldPath)
+			}
+		case source.ResourceFieldRef != nil:
+			if !contains(profile.Env.ResourceFieldRefs, source.ResourceFieldRef.Resource) {
+				err = fmt.Errorf("resourceFieldRef %v is not allowed", source.ResourceFieldRef.Resource)
+			}
+		default:
+			err = fmt.Errorf("valueFrom has no supported source")
+		}
+		if err != nil {
+			return field.Forbidden(path.Child("env").Index(i).Child("valueFrom"), fmt.Sprintf("env %v: %v", env.Name, err))
+		}
+	}
+
+	for i, from := range container.EnvFrom {
+		var err error
+		switch {
+		case from.SecretRef != nil:
+			err = checkRef("secret", profile.Env.Secrets, cluster.SecretLabels, namespace, from.SecretRef.Name, "")
+		case from.ConfigMapRef != nil:
+			err = checkRef("configMap", profile.Env.ConfigMaps, cluster.ConfigMapLabels, namespace, from.ConfigMapRef.Name, "")
+		default:
+			err = fmt.Errorf("no supported source")
+		}
+		if err != nil {
+			return field.Forbidden(path.Child("envFrom").Index(i), err.Error())
+		}
+	}
+	return nil
+}
+
+// checkRef looks for a rule allowing the key of the object, an empty key references the whole object
+func checkRef(kind string, refs []ObjectRef, lookup labelLookup, namespace, name, key string) error {
+	var objectLabels map[string]string
+	var lookupErr error
+	lookedUp, keyDenied := false, false
+
+	for _, ref := range refs {
+		if !ref.matchName(name) {
+			continue
+		}
+		if ref.Selector != nil {
+			if !lookedUp {
+				objectLabels, lookupErr = lookup(namespace, name)
+				lookedUp = true
+			}
+			if lookupErr != nil || !ref.matchLabels(objectLabels) {
+				continue
+			}
+		}
+		if ref.matchKey(key) {
+			return nil
+		}
+		keyDenied = true
+	}
+
+	switch {
+	case keyDenied && key == "":
+		return fmt.Errorf("%v %v can only be referenced by key", kind, name)
+	case keyDenied:
+		return fmt.Errorf("key %v of %v %v is not allowed", key, kind, name)
+	case lookupErr != nil:
+		return fmt.Errorf("can't read the labels of %v %v: %v", kind, name, lookupErr)
+	}
+	return fmt.Errorf("%v %v is not allowed", kind, name)
+}
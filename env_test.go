@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/tools/cache"
+)
+
+func testCluster(t *testing.T, secrets ...*k8meta.PartialObjectMetadata) *Cluster {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, secret := range secrets {
+		if err := indexer.Add(secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Cluster{
+		Secrets: cache.NewGenericLister(indexer, schema.GroupResource{Resource: "secrets"}),
+	}
+}
+
+func envProfile() *Profile {
+	profile := defaultProfile()
+	profile.Env = EnvPolicy{
+		Secrets: []ObjectRef{
+			{Name: "api-*", Keys: []string{"token"}},
+			{Selector: &k8meta.LabelSelector{MatchLabels: map[string]string{"env-allowed": "true"}}},
+		},
+		ConfigMaps:        []ObjectRef{{Name: "settings"}},
+		FieldRefs:         []string{"metadata.name"},
+		ResourceFieldRefs: []string{"limits.cpu"},
+	}
+	return &profile
+}
+
+func secretEnv(name, key string) v1.EnvVar {
+	return v1.EnvVar{Name: "ENV", ValueFrom: &v1.EnvVarSource{
+		SecretKeyRef: &v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: name}, Key: key},
+	}}
+}
+
+func TestEnvReferences(t *testing.T) {
+	cluster := testCluster(t, &k8meta.PartialObjectMetadata{ObjectMeta: k8meta.ObjectMeta{
+		Name: "labeled", Namespace: "default", Labels: map[string]string{"env-allowed": "true"},
+	}})
+
+	cases := map[string]struct {
+		container v1.Container
+		allowed   bool
+	}{
+		"secretKey":        {v1.Container{Env: []v1.EnvVar{secretEnv("api-github", "token")}}, true},
+		"secretWrongKey":   {v1.Container{Env: []v1.EnvVar{secretEnv("api-github", "password")}}, false},
+		"secretUnknown":    {v1.Container{Env: []v1.EnvVar{secretEnv("other", "token")}}, false},
+		"secretLabeled":    {v1.Container{Env: []v1.EnvVar{secretEnv("labeled", "anything")}}, true},
+		"secretNotCached":  {v1.Container{Env: []v1.EnvVar{secretEnv("missing", "token")}}, false},
+		"envFromLabeled":   {v1.Container{EnvFrom: []v1.EnvFromSource{{SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "labeled"}}}}}, true},
+		"envFromKeyedOnly": {v1.Container{EnvFrom: []v1.EnvFromSource{{SecretRef: &v1.SecretEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "api-github"}}}}}, false},
+		"envFromConfigMap": {v1.Container{EnvFrom: []v1.EnvFromSource{{ConfigMapRef: &v1.ConfigMapEnvSource{LocalObjectReference: v1.LocalObjectReference{Name: "settings"}}}}}, true},
+		"envFromEmpty":     {v1.Container{EnvFrom: []v1.EnvFromSource{{}}}, false},
+		"fieldRef":         {v1.Container{Env: []v1.EnvVar{{Name: "NAME", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "metadata.name"}}}}}, true},
+		"fieldRefDenied":   {v1.Container{Env: []v1.EnvVar{{Name: "IP", ValueFrom: &v1.EnvVarSource{FieldRef: &v1.ObjectFieldSelector{FieldPath: "status.hostIP"}}}}}, false},
+		"resourceFieldRef": {v1.Container{Env: []v1.EnvVar{{Name: "CPU", ValueFrom: &v1.EnvVarSource{ResourceFieldRef: &v1.ResourceFieldSelector{Resource: "limits.cpu"}}}}}, true},
+		"emptySource":      {v1.Container{Env: []v1.EnvVar{{Name: "EMPTY", ValueFrom: &v1.EnvVarSource{}}}}, false},
+	}
+
+	for key, val := range cases {
+		err := checkEnv(&val.container, field.NewPath("container"), "default", envProfile(), cluster)
+		if val.allowed && err != nil {
+			t.Errorf("Valid env `%v` was denied: %v", key, err)
+		}
+		if !val.allowed && err == nil {
+			t.Errorf("Invalid env `%v` was allowed", key)
+		}
+	}
+}
+
+func TestEnvLookupDisabled(t *testing.T) {
+	container := v1.Container{Env: []v1.EnvVar{secretEnv("labeled", "token")}}
+	if err := checkEnv(&container, field.NewPath("container"), "default", envProfile(), nil); err == nil {
+		t.Fatalf("Secret matched by selector was allowed without cluster lookups")
+	}
+}
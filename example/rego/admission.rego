@@ -0,0 +1,20 @@
+package kubernetes.admission
+
+# Denies the request with the message
+deny contains msg if {
+	input.request.kind.kind == "Job"
+	not input.request.object.metadata.labels.team
+	msg := "jobs must set the team label"
+}
+
+# Denies the request, reporting the field
+violation contains {"msg": msg, "field": sprintf("spec.template.spec.containers[%v].image", [i])} if {
+	some i, container in input.request.object.spec.template.spec.containers
+	not startswith(container.image, "registry.internal/")
+	msg := sprintf("image %v must come from registry.internal", [container.image])
+}
+
+# Returned as a warning to the user
+warn contains "jobs should set the owner label" if {
+	not input.request.object.metadata.labels.owner
+}
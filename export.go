@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"sigs.k8s.io/yaml"
+)
+
+// exportCommand implements `simple-admission export vap`, it writes the ValidatingAdmissionPolicies
+// of the policy to stdout and reports the rules that still need the webhook to stderr
+func exportCommand(args []string) error {
+	if len(args) == 0 || args[0] != "vap" {
+		return fmt.Errorf("usage: simple-admission export vap [flags]")
+	}
+	flags := flag.NewFlagSet("export vap", flag.ExitOnError)
+	policyFile := flags.String("policy", "", "File containing the policy profiles, if empty the default profile is exported")
+	runtimeClass := flags.String("runtimeClass", "gvisor", "RuntimeClass of the sandboxed environment")
+	name := flags.String("name", "simple-admission", "Prefix of the names of the policies and bindings")
+	output := flags.String("output", "", "File to write the manifests, defaults to stdout")
+	flags.Parse(args[1:])
+
+	var policy *Policy
+	if *policyFile != "" {
+		loaded, err := LoadPolicy(*policyFile)
+		if err != nil {
+			return err
+		}
+		policy = loaded
+	}
+	objects, unsupported := ExportVAP(policy, *runtimeClass, *name)
+
+	writer := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		writer = file
+	}
+	for i, object := range objects {
+		data, err := yaml.Marshal(object)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Fprintln(writer, "---")
+		}
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if len(unsupported) > 0 {
+		fmt.Fprintln(os.Stderr, "Rules that can't be expressed as a ValidatingAdmissionPolicy, they still need the webhook:")
+		for _, rule := range unsupported {
+			fmt.Fprintf(os.Stderr, "- %v\n", rule)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Defaults of the external rules
+const (
+	defaultExternalTimeout          = 2 * time.Second
+	defaultExternalFailureThreshold = 5
+	defaultExternalResetTimeout     = 30 * time.Second
+	// Larger responses are failures of the validator
+	maxExternalResponseSize = 1 << 20
+	// Method of the gRPC service described in proto/validator.proto
+	externalValidateMethod = "/simpleadmission.v1.ExternalValidator/Validate"
+)
+
+// Failure policies of the external rules
+const (
+	ExternalFail   = "Fail"
+	ExternalIgnore = "Ignore"
+)
+
+// errCircuitOpen is returned without calling the endpoint while the circuit breaker is open
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// ExternalRule calls an endpoint with the object, oldObject, request and namespaceObject of the
+// request and applies the violations it returns, see the README for the protocol
+type ExternalRule struct {
+	Name string `json:"name"`
+	// http:// or https:// URL receiving a POST, or grpc:// or grpcs:// address of the ExternalValidator service
+	URL string `json:"url"`
+	// Maximum duration of a call, defaults to 2s and is bounded by the timeout of the webhook
+	Timeout string `json:"timeout,omitempty"`
+	// Fail denies the request when the endpoint fails, Ignore allows it with a warning. Defaults to Fail
+	FailurePolicy string `json:"failurePolicy,omitempty"`
+	// File with the CA bundle of https and grpcs endpoints, defaults to the system roots
+	CAFile         string         `json:"caFile,omitempty"`
+	CircuitBreaker CircuitBreaker `json:"circuitBreaker,omitempty"`
+}
+
+// CircuitBreaker stops calling an endpoint after consecutive failures, the failure policy
+// applies without waiting for the timeout until a trial call succeeds
+type CircuitBreaker struct {
+	// Consecutive failures that open the circuit, defaults to 5
+	FailureThreshold int `json:"failureThreshold,omitempty"`
+	// Duration before a trial call once the circuit is open, defaults to 30s
+	ResetTimeout string `json:"resetTimeout,omitempty"`
+}
+
+// externalRule is the Rule of an external endpoint
+type externalRule struct {
+	name    string
+	timeout time.Duration
+	ignore  bool
+	breaker *circuitBreaker
+	call    func(ctx context.Context, input map[string]interface{}) (*violationsDocument, error)
+}
+
+// compileExternal validates the external rules and prepares their clients
+func compileExternal(rules []ExternalRule) ([]Rule, error) {
+	names := map[string]bool{}
+	result := []Rule{}
+	for _, external := range rules {
+		if external.Name == "" || external.URL == "" {
+			return nil, fmt.Errorf("external rules must set a name and a url")
+		}
+		if names[external.Name] {
+			return nil, fmt.Errorf("external rule %v is declared twice", external.Name)
+		}
+		names[external.Name] = true
+		rule, err := external.compile()
+		if err != nil {
+			return nil, fmt.Errorf("external rule %v: %v", external.Name, err)
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+func (external *ExternalRule) compile() (*externalRule, error) {
+	timeout, err := parseDuration(external.Timeout, defaultExternalTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timeout %v", external.Timeout)
+	}
+	resetTimeout, err := parseDuration(external.CircuitBreaker.ResetTimeout, defaultExternalResetTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid circuitBreaker.resetTimeout %v", external.CircuitBreaker.ResetTimeout)
+	}
+	threshold := external.CircuitBreaker.FailureThreshold
+	if threshold < 0 {
+		return nil, fmt.Errorf("circuitBreaker.failureThreshold must not be negative")
+	}
+	if threshold == 0 {
+		threshold = defaultExternalFailureThreshold
+	}
+	if external.FailurePolicy != "" && external.FailurePolicy != ExternalFail && external.FailurePolicy != ExternalIgnore {
+		return nil, fmt.Errorf("failurePolicy must be %v or %v", ExternalFail, ExternalIgnore)
+	}
+
+	endpoint, err := url.Parse(external.URL)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid url %v", external.URL)
+	}
+	var roots *x509.CertPool
+	if external.CAFile != "" {
+		data, err := ioutil.ReadFile(external.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate in %v", external.CAFile)
+		}
+	}
+
+	rule := &externalRule{
+		name:    external.Name,
+		timeout: timeout,
+		ignore:  external.FailurePolicy == ExternalIgnore,
+		breaker: &circuitBreaker{threshold: threshold, resetTimeout: resetTimeout, now: time.Now},
+	}
+	switch endpoint.Scheme {
+	case "http", "https":
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+		rule.call = httpValidator(client, external.URL)
+	case "grpc", "grpcs":
+		transport := insecure.NewCredentials()
+		if endpoint.Scheme == "grpcs" {
+			transport = credentials.NewTLS(&tls.Config{RootCAs: roots})
+		}
+		// The connection is established on the first call
+		connection, err := grpc.NewClient(endpoint.Host, grpc.WithTransportCredentials(transport), grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(maxExternalResponseSize)))
+		if err != nil {
+			return nil, err
+		}
+		rule.call = grpcValidator(connection)
+	default:
+		return nil, fmt.Errorf("unsupported url scheme %v", endpoint.Scheme)
+	}
+	return rule, nil
+}
+
+// parseDuration parses a positive duration, returning the default when empty
+func parseDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("invalid duration %v", value)
+	}
+	return parsed, nil
+}
+
+func (rule *externalRule) ID() string          { return "external." + rule.name }
+func (rule *externalRule) Description() string { return "External validator " + rule.name }
+func (rule *externalRule) Severity() Severity  { return SeverityDeny }
+
+// Evaluate calls the endpoint, failures deny the request or add a warning depending on the failure policy
+func (rule *externalRule) Evaluate(ctx context.Context, object *Object, profile *Profile) []Violation {
+	if object.Request == nil {
+		return nil
+	}
+	result, err := rule.run(ctx, object)
+	if err != nil {
+		log.Printf("External rule %v failed: %v", rule.name, err)
+		violation := Violation{Message: fmt.Sprintf("external rule %v failed: %v", rule.name, err), Severity: SeverityDeny}
+		if rule.ignore {
+			violation.Severity = SeverityWarn
+		}
+		return []Violation{violation}
+	}
+	return result.violations()
+}
+
+func (rule *externalRule) run(ctx context.Context, object *Object) (*violationsDocument, error) {
+	variables, err := requestVariables(object)
+	if err != nil {
+		return nil, err
+	}
+	if !rule.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	// The deadline of the request, set from the webhook timeout, bounds the timeout of the call
+	callCtx, cancel := context.WithTimeout(ctx, rule.timeout)
+	defer cancel()
+	result, err := rule.call(callCtx, variables)
+	if err != nil && ctx.Err() != nil {
+		// The request was cancelled or ran out of time before the call, it says nothing about the endpoint
+		rule.breaker.release()
+	} else {
+		rule.breaker.record(err)
+	}
+	return result, err
+}
+
+// httpValidator posts the variables as JSON and decodes the violations of the response
+func httpValidator(client *http.Client, endpoint string) func(context.Context, map[string]interface{}) (*violationsDocument, error) {
+	return func(ctx context.Context, input map[string]interface{}) (*violationsDocument, error) {
+		data, err := json.Marshal(input)
+		if err != nil {
+			return nil, err
+		}
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		response, err := client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status %v", response.Status)
+		}
+		body, err := io.ReadAll(io.LimitReader(response.Body, maxExternalResponseSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(body) > maxExternalResponseSize {
+			return nil, fmt.Errorf("response is larger than %v bytes", maxExternalResponseSize)
+		}
+		result := &violationsDocument{}
+		if err := json.Unmarshal(body, result); err != nil {
+			return nil, fmt.Errorf("invalid response: %v", err)
+		}
+		return result, nil
+	}
+}
+
+// grpcValidator calls the Validate method with the variables as a google.protobuf.Struct
+func grpcValidator(connection *grpc.ClientConn) func(context.Context, map[string]interface{}) (*violationsDocument, error) {
+	return func(ctx context.Context, input map[string]interface{}) (*violationsDocument, error) {
+		request, err := structpb.NewStruct(input)
+		if err != nil {
+			return nil, err
+		}
+		response := &structpb.Struct{}
+		if err := connection.Invoke(ctx, externalValidateMethod, request, response); err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(response.AsMap())
+		if err != nil {
+			return nil, err
+		}
+		result := &violationsDocument{}
+		if err := json.Unmarshal(data, result); err != nil {
+			return nil, fmt.Errorf("invalid response: %v", err)
+		}
+		return result, nil
+	}
+}
+
+// circuitBreaker counts the consecutive failures of an endpoint. Once open, a single trial
+// call is allowed after the reset timeout and its result closes or reopens the circuit
+type circuitBreaker struct {
+	threshold    int
+	resetTimeout time.Duration
+	now          func() time.Time
+
+	mutex    sync.Mutex
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// allow returns whether the endpoint can be called
+func (breaker *circuitBreaker) allow() bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if breaker.failures < breaker.threshold {
+		return true
+	}
+	if breaker.trial || breaker.now().Sub(breaker.openedAt) < breaker.resetTimeout {
+		return false
+	}
+	breaker.trial = true
+	return true
+}
+
+// release ends a call without a result, so another trial call can be made
+func (breaker *circuitBreaker) release() {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.trial = false
+}
+
+// record updates the state with the result of a call
+func (breaker *circuitBreaker) record(err error) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	breaker.trial = false
+	if err == nil {
+		breaker.failures = 0
+		return
+	}
+	breaker.failures++
+	if breaker.failures >= breaker.threshold {
+		breaker.openedAt = breaker.now()
+	}
+}
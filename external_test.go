@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/structpb"
+	admission "k8s.io/api/admission/v1beta1"
+)
+
+// testValidator denies jobs with the external-deny label and warns when the owner label is missing
+func testValidator(input map[string]interface{}) map[string]interface{} {
+	violations := []interface{}{}
+	object, _ := input["object"].(map[string]interface{})
+	metadata, _ := object["metadata"].(map[string]interface{})
+	labels, _ := metadata["labels"].(map[string]interface{})
+	if value, ok := labels["external-deny"].(string); ok {
+		violations = append(violations, map[string]interface{}{"message": "denied by the validator: " + value, "field": "metadata.labels[external-deny]"})
+	}
+	if _, ok := labels["owner"]; !ok {
+		violations = append(violations, map[string]interface{}{"message": "owner label is missing", "severity": "warn"})
+	}
+	return map[string]interface{}{"violations": violations}
+}
+
+// httpServer serves testValidator, paths with error fail, paths with slow never return in time
+// and paths with large return more than the size limit
+func httpServer(t *testing.T, calls *int32) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		input := map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(r.URL.Path, "error") {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if strings.Contains(r.URL.Path, "slow") {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		if strings.Contains(r.URL.Path, "large") {
+			json.NewEncoder(w).Encode(map[string]interface{}{"violations": []interface{}{}, "padding": strings.Repeat("x", maxExternalResponseSize)})
+			return
+		}
+		json.NewEncoder(w).Encode(testValidator(input))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// grpcServer serves testValidator with the ExternalValidator service, without generated code
+func grpcServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	server.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "simpleadmission.v1.ExternalValidator",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Validate",
+			Handler: func(_ interface{}, ctx context.Context, decode func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				request := &structpb.Struct{}
+				if err := decode(request); err != nil {
+					return nil, err
+				}
+				return structpb.NewStruct(testValidator(request.AsMap()))
+			},
+		}},
+	}, struct{}{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return "grpc://" + listener.Addr().String()
+}
+
+func externalHandler(t *testing.T, rules ...ExternalRule) *AdmissionHandler {
+	policy := &Policy{External: rules}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &AdmissionHandler{RuntimeClass: "gvisor", Policy: policy}
+}
+
+func TestExternalRules(t *testing.T) {
+	var calls int32
+	endpoints := map[string]string{
+		"http": httpServer(t, &calls).URL + "/validate",
+		"grpc": grpcServer(t),
+	}
+	for key, endpoint := range endpoints {
+		handler := externalHandler(t, ExternalRule{Name: key, URL: endpoint})
+		review := loadValidJob(t)
+		job := loadJob(t, review)
+
+		allowed, warnings, err := checkRequest(context.Background(), review.Request, handler)
+		if !allowed || len(warnings) != 1 || warnings[0] != "owner label is missing" {
+			t.Errorf("%v: job must be allowed with the validator warning, got %v %v", key, warnings, err)
+		}
+
+		job.Labels = map[string]string{"owner": "ml", "external-deny": "test"}
+		saveJob(t, review, job)
+		allowed, _, err = checkRequest(context.Background(), review.Request, handler)
+		if allowed || err.Error() != "metadata.labels[external-deny]: denied by the validator: test" {
+			t.Errorf("%v: validator violation must deny with its field, got %v", key, err)
+		}
+
+		job.Labels = map[string]string{"owner": "ml"}
+		saveJob(t, review, job)
+		if allowed, warnings, err = checkRequest(context.Background(), review.Request, handler); !allowed || len(warnings) > 0 {
+			t.Errorf("%v: job must be allowed without warnings, got %v %v", key, warnings, err)
+		}
+	}
+}
+
+func TestExternalFailurePolicy(t *testing.T) {
+	var calls int32
+	server := httpServer(t, &calls)
+	cases := []struct {
+		rule    ExternalRule
+		allowed bool
+	}{
+		{ExternalRule{Name: "error", URL: server.URL + "/error"}, false},
+		{ExternalRule{Name: "error", URL: server.URL + "/error", FailurePolicy: ExternalIgnore}, true},
+		{ExternalRule{Name: "slow", URL: server.URL + "/slow", Timeout: "50ms"}, false},
+		{ExternalRule{Name: "slow", URL: server.URL + "/slow", Timeout: "50ms", FailurePolicy: ExternalIgnore}, true},
+		{ExternalRule{Name: "unreachable", URL: "grpc://127.0.0.1:1", FailurePolicy: ExternalFail}, false},
+		{ExternalRule{Name: "large", URL: server.URL + "/large"}, false},
+	}
+	for _, test := range cases {
+		handler := externalHandler(t, test.rule)
+		allowed, warnings, err := checkRequest(context.Background(), loadValidJob(t).Request, handler)
+		if allowed != test.allowed {
+			t.Errorf("%v with %v: expected allowed %v, got %v", test.rule.Name, test.rule.FailurePolicy, test.allowed, err)
+			continue
+		}
+		message := ""
+		if allowed && len(warnings) == 1 {
+			message = warnings[0]
+		} else if !allowed {
+			message = err.Error()
+		}
+		if !strings.HasPrefix(message, "external rule "+test.rule.Name+" failed") {
+			t.Errorf("%v with %v: failure must be reported, got %v %v", test.rule.Name, test.rule.FailurePolicy, warnings, err)
+		}
+	}
+}
+
+func TestExternalWebhookTimeout(t *testing.T) {
+	var calls int32
+	handler := externalHandler(t, ExternalRule{Name: "slow", URL: httpServer(t, &calls).URL + "/slow", Timeout: "5s"})
+	encoded, err := json.Marshal(loadValidJob(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest("POST", "/validate?timeout=200ms", bytes.NewReader(encoded))
+	recorder := httptest.NewRecorder()
+
+	start := time.Now()
+	handler.handler(recorder, request)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Call must end before the webhook timeout, took %v", elapsed)
+	}
+	response := admission.AdmissionReview{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Response.Allowed || !strings.Contains(response.Response.Result.Message, "external rule slow failed") {
+		t.Fatalf("Call over the webhook timeout must deny, got %v", response.Response.Result)
+	}
+	if breaker := handler.Policy.rules[0].(*externalRule).breaker; breaker.failures != 0 || breaker.trial {
+		t.Fatalf("Calls cut by the webhook timeout must not count as failures of the endpoint")
+	}
+}
+
+func TestExternalCircuitBreaker(t *testing.T) {
+	var calls int32
+	handler := externalHandler(t, ExternalRule{
+		Name:           "error",
+		URL:            httpServer(t, &calls).URL + "/error",
+		FailurePolicy:  ExternalIgnore,
+		CircuitBreaker: CircuitBreaker{FailureThreshold: 2, ResetTimeout: "1m"},
+	})
+	breaker := handler.Policy.rules[0].(*externalRule).breaker
+	now := time.Now()
+	breaker.now = func() time.Time { return now }
+
+	request := loadValidJob(t).Request
+	for i := 0; i < 4; i++ {
+		checkRequest(context.Background(), request, handler)
+	}
+	if atomic.LoadInt32(&calls) != 2 {
+		t.Fatalf("Endpoint must not be called once the circuit is open, got %v calls", calls)
+	}
+	_, warnings, _ := checkRequest(context.Background(), request, handler)
+	if len(warnings) != 1 || !strings.HasSuffix(warnings[0], errCircuitOpen.Error()) {
+		t.Fatalf("Open circuit must apply the failure policy, got %v", warnings)
+	}
+
+	now = now.Add(time.Minute)
+	checkRequest(context.Background(), request, handler)
+	checkRequest(context.Background(), request, handler)
+	if atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("A single trial call must be done after the reset timeout, got %v calls", calls)
+	}
+}
+
+func TestCircuitBreakerRecovery(t *testing.T) {
+	now := time.Now()
+	breaker := &circuitBreaker{threshold: 1, resetTimeout: time.Second, now: func() time.Time { return now }}
+	breaker.record(errCircuitOpen)
+	if breaker.allow() {
+		t.Fatalf("Circuit must be open after the threshold")
+	}
+	now = now.Add(time.Second)
+	if !breaker.allow() || breaker.allow() {
+		t.Fatalf("Only the trial call must be allowed after the reset timeout")
+	}
+	breaker.record(nil)
+	if !breaker.allow() || !breaker.allow() {
+		t.Fatalf("Successful trial must close the circuit")
+	}
+}
+
+func TestInvalidExternalRules(t *testing.T) {
+	cases := map[string][]ExternalRule{
+		"noURL":          {{Name: "test"}},
+		"scheme":         {{Name: "test", URL: "ftp://validator"}},
+		"timeout":        {{Name: "test", URL: "http://validator", Timeout: "-1s"}},
+		"failurePolicy":  {{Name: "test", URL: "http://validator", FailurePolicy: "Allow"}},
+		"threshold":      {{Name: "test", URL: "http://validator", CircuitBreaker: CircuitBreaker{FailureThreshold: -1}}},
+		"caFile":         {{Name: "test", URL: "https://validator", CAFile: "missing.pem"}},
+		"duplicatedName": {{Name: "test", URL: "http://validator"}, {Name: "test", URL: "grpc://validator:443"}},
+	}
+	for key, rules := range cases {
+		policy := &Policy{External: rules}
+		if err := policy.validate(); err == nil {
+			t.Errorf("Invalid external rule `%v` was loaded", key)
+		}
+	}
+}
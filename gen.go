@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+	"sigs.k8s.io/yaml"
+)
+
+//go:embed templates/*.yaml
+var templateFiles embed.FS
+
+// Order of the templates in the manifest, the webhooks go last so the server is deployed first
+var manifestTemplates = []string{"deployment.yaml", "secret.yaml", "client-ca.yaml", "webhooks.yaml"}
+
+// GenOptions are the settings of the certificates and manifests generated by `simple-admission gen`
+type GenOptions struct {
+	Name      string
+	Namespace string
+	// Name of the webhooks, defaults to <name>.<namespace>.svc
+	WebhookName  string
+	SecretName   string
+	Image        string
+	Replicas     int
+	CAValidity   time.Duration
+	CertValidity time.Duration
+	KeyType      string
+	// Extra DNS names or IPs of the serving certificate
+	SANs []string
+	// Label selector of the namespaces sent to the webhooks, in the kubectl syntax
+	NamespaceSelector string
+	FailurePolicy     string
+	TimeoutSeconds    int
+	Mutating          bool
+	// The server issues its own certificate from a CA kept in SecretName, no certificates are generated
+	SelfManagedCerts bool
+	// Require client certificates, signed by a generated client CA. ClientName is the common name of
+	// the apiserver certificate, KubeconfigPath where the apiserver reads the generated kubeconfig
+	ClientAuth     bool
+	ClientName     string
+	KubeconfigPath string
+	// Objects granted to list and watch besides namespaces, the ones read by the policy
+	Lookups ClusterLookups
+}
+
+// stringList is a repeatable flag
+type stringList []string
+
+func (list *stringList) String() string { return strings.Join(*list, ",") }
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// genCommand implements `simple-admission gen`, it writes the CA, the serving certificate and
+// the manifests of the webhook to the output directory
+func genCommand(args []string) error {
+	options := GenOptions{}
+	var sans stringList
+	flags := flag.NewFlagSet("gen", flag.ExitOnError)
+	flags.StringVar(&options.Name, "name", "simple-admission", "Name of the service, deployment and RBAC objects")
+	flags.StringVar(&options.Namespace, "namespace", "default", "Namespace where the webhook runs")
+	flags.StringVar(&options.WebhookName, "webhookName", "", "Name of the webhook configurations, defaults to <name>.<namespace>.svc")
+	flags.StringVar(&options.SecretName, "secretName", "admission-certs", "Secret with the serving certificate")
+	flags.StringVar(&options.Image, "image", "fdns/simple-admission:latest", "Image of the webhook")
+	flags.IntVar(&options.Replicas, "replicas", 1, "Replicas of the deployment")
+	flags.DurationVar(&options.CAValidity, "caValidity", 5*365*24*time.Hour, "Validity of the CA")
+	flags.DurationVar(&options.CertValidity, "certValidity", 365*24*time.Hour, "Validity of the serving certificate, bounded by the CA")
+	flags.StringVar(&options.KeyType, "keyType", KeyECDSAP256, fmt.Sprintf("Key type of the certificates, one of %v", strings.Join(keyTypes, ", ")))
+	flags.Var(&sans, "san", "Extra DNS name or IP of the serving certificate, can be repeated")
+	flags.StringVar(&options.NamespaceSelector, "namespaceSelector", "", "Label selector of the validated namespaces, e.g. 'team in (ml,research)'. Defaults to the namespace of the webhook")
+	flags.StringVar(&options.FailurePolicy, "failurePolicy", "Fail", "Failure policy of the webhooks, Fail or Ignore")
+	flags.IntVar(&options.TimeoutSeconds, "timeoutSeconds", 10, "Timeout of the webhooks, between 1 and 30")
+	flags.BoolVar(&options.Mutating, "mutating", true, "Also generate the MutatingWebhookConfiguration")
+	flags.BoolVar(&options.SelfManagedCerts, "selfManagedCerts", false, "Only generate the manifest, the server keeps its CA in --secretName and patches the caBundle of the webhooks")
+	flags.BoolVar(&options.ClientAuth, "clientAuth", false, "Require client certificates, also generates the client certificate of the apiserver and its admission configuration")
+	flags.StringVar(&options.ClientName, "clientName", "kube-apiserver", "Common name of the apiserver client certificate, the only one allowed by the webhook")
+	flags.StringVar(&options.KubeconfigPath, "kubeconfigPath", "/etc/kubernetes/admission/admission-kubeconfig.yaml", "Path of admission-kubeconfig.yaml in the apiserver, referenced by admission-config.yaml")
+	policyFile := flags.String("policy", "", "Policy file of the webhook, only the objects read by its profiles are granted")
+	outputDir := flags.String("outputDir", "certs", "Directory of the certificates and manifest.yaml")
+	flags.Parse(args)
+	options.SANs = sans
+	if *policyFile != "" {
+		policy, err := LoadPolicy(*policyFile)
+		if err != nil {
+			return err
+		}
+		options.Lookups = policy.lookups()
+	}
+
+	files, err := Generate(options)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*outputDir, 0755); err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		data := files[name]
+		mode := os.FileMode(0644)
+		if strings.HasSuffix(name, "-key.pem") || name == "admission-kubeconfig.yaml" {
+			mode = 0600
+		}
+		if err := ioutil.WriteFile(filepath.Join(*outputDir, name), data, mode); err != nil {
+			return err
+		}
+		fmt.Printf("Generated %v\n", filepath.Join(*outputDir, name))
+	}
+	return nil
+}
+
+// Generate returns the CA, the serving certificate and manifest.yaml, by file name. With self-managed
+// certificates only manifest.yaml is returned. With client authentication the client CA, the apiserver
+// certificate and its admission configuration are added
+func Generate(options GenOptions) (map[string][]byte, error) {
+	if options.Name == "" || options.Namespace == "" {
+		return nil, fmt.Errorf("name and namespace must be set")
+	}
+	if options.WebhookName == "" {
+		options.WebhookName = fmt.Sprintf("%v.%v.svc", options.Name, options.Namespace)
+	}
+	// The apiserver requires fully qualified webhook names
+	if strings.Count(options.WebhookName, ".") < 2 {
+		return nil, fmt.Errorf("webhook name %v must have at least three segments", options.WebhookName)
+	}
+	if options.FailurePolicy != "Fail" && options.FailurePolicy != "Ignore" {
+		return nil, fmt.Errorf("failure policy must be Fail or Ignore")
+	}
+	if options.TimeoutSeconds < 1 || options.TimeoutSeconds > 30 {
+		return nil, fmt.Errorf("timeoutSeconds must be between 1 and 30")
+	}
+	if options.Replicas < 1 {
+		return nil, fmt.Errorf("replicas must be at least 1")
+	}
+	selector := options.NamespaceSelector
+	if selector == "" {
+		selector = "kubernetes.io/metadata.name=" + options.Namespace
+	}
+	namespaceSelector, err := k8meta.ParseToLabelSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace selector: %v", err)
+	}
+
+	values := struct {
+		GenOptions
+		NamespaceSelector               *k8meta.LabelSelector
+		CABundle, ServerCert, ServerKey string
+		ClientCABundle                  string
+	}{
+		GenOptions:        options,
+		NamespaceSelector: namespaceSelector,
+	}
+	files := map[string][]byte{}
+	if options.SelfManagedCerts {
+		if options.CAValidity <= 0 {
+			return nil, fmt.Errorf("validity must be positive")
+		}
+		// The server generates the keys
+		if !contains(keyTypes, options.KeyType) {
+			return nil, fmt.Errorf("unknown key type %v, must be one of %v", options.KeyType, keyTypes)
+		}
+	} else {
+		ca, err := newCA(fmt.Sprintf("%v-ca", options.Name), options.CAValidity, options.KeyType)
+		if err != nil {
+			return nil, fmt.Errorf("error generating the CA: %v", err)
+		}
+		serverCert, serverKey, err := ca.issue(append(serviceNames(options.Name, options.Namespace), options.SANs...), options.CertValidity, options.KeyType)
+		if err != nil {
+			return nil, fmt.Errorf("error generating the serving certificate: %v", err)
+		}
+		files["ca.pem"], files["ca-key.pem"] = ca.certPEM, ca.keyPEM
+		files["server.pem"], files["server-key.pem"] = serverCert, serverKey
+		values.CABundle = base64.StdEncoding.EncodeToString(ca.certPEM)
+		values.ServerCert = base64.StdEncoding.EncodeToString(serverCert)
+		values.ServerKey = base64.StdEncoding.EncodeToString(serverKey)
+	}
+	if options.ClientAuth {
+		if options.ClientName == "" || options.KubeconfigPath == "" {
+			return nil, fmt.Errorf("clientName and kubeconfigPath must be set")
+		}
+		ca, err := newCA(fmt.Sprintf("%v-client-ca", options.Name), options.CAValidity, options.KeyType)
+		if err != nil {
+			return nil, fmt.Errorf("error generating the client CA: %v", err)
+		}
+		clientCert, clientKey, err := ca.issueClient(options.ClientName, options.CertValidity, options.KeyType)
+		if err != nil {
+			return nil, fmt.Errorf("error generating the client certificate: %v", err)
+		}
+		kubeconfig, err := admissionKubeconfig(serviceNames(options.Name, options.Namespace)[0], clientCert, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		files["client-ca.pem"], files["client-ca-key.pem"] = ca.certPEM, ca.keyPEM
+		files["client.pem"], files["client-key.pem"] = clientCert, clientKey
+		files["admission-kubeconfig.yaml"] = kubeconfig
+		values.ClientCABundle = base64.StdEncoding.EncodeToString(ca.certPEM)
+	}
+	templates, err := template.New("manifest").Funcs(template.FuncMap{
+		"toYaml": func(value interface{}) (string, error) {
+			data, err := yaml.Marshal(value)
+			return strings.TrimSuffix(string(data), "\n"), err
+		},
+		"indent": func(spaces int, value string) string {
+			prefix := strings.Repeat(" ", spaces)
+			return prefix + strings.ReplaceAll(value, "\n", "\n"+prefix)
+		},
+	}).ParseFS(templateFiles, "templates/*.yaml")
+	if err != nil {
+		return nil, err
+	}
+	manifest := &bytes.Buffer{}
+	for _, name := range manifestTemplates {
+		// The server creates its own secret
+		if (name == "secret.yaml" && options.SelfManagedCerts) || (name == "client-ca.yaml" && !options.ClientAuth) {
+			continue
+		}
+		if manifest.Len() > 0 {
+			manifest.WriteString("---\n")
+		}
+		if err := templates.ExecuteTemplate(manifest, name, values); err != nil {
+			return nil, err
+		}
+	}
+
+	files["manifest.yaml"] = manifest.Bytes()
+	if options.ClientAuth {
+		config := &bytes.Buffer{}
+		if err := templates.ExecuteTemplate(config, "admission-config.yaml", values); err != nil {
+			return nil, err
+		}
+		files["admission-config.yaml"] = config.Bytes()
+	}
+	return files, nil
+}
+
+// admissionKubeconfig returns the kubeconfig used by the apiserver to authenticate to the webhook
+// service, its user is matched by the DNS name of the service
+func admissionKubeconfig(serviceName string, clientCert, clientKey []byte) ([]byte, error) {
+	config := clientcmdapi.NewConfig()
+	config.AuthInfos[serviceName] = &clientcmdapi.AuthInfo{
+		ClientCertificateData: clientCert,
+		ClientKeyData:         clientKey,
+	}
+	return clientcmd.Write(*config)
+}
+
+// serviceNames returns the DNS names of the service
+func serviceNames(name, namespace string) []string {
+	return []string{
+		fmt.Sprintf("%v.%v.svc", name, namespace),
+		name,
+		fmt.Sprintf("%v.%v", name, namespace),
+		fmt.Sprintf("%v.%v.svc.cluster.local", name, namespace),
+	}
+}
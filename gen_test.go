@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	admission "k8s.io/api/admission/v1beta1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/yaml"
+)
+
+func genOptions() GenOptions {
+	return GenOptions{
+		Name:           "simple-admission",
+		Namespace:      "admission",
+		SecretName:     "admission-certs",
+		Image:          "fdns/simple-admission:latest",
+		Replicas:       1,
+		CAValidity:     48 * time.Hour,
+		CertValidity:   24 * time.Hour,
+		KeyType:        KeyECDSAP256,
+		FailurePolicy:  "Fail",
+		TimeoutSeconds: 10,
+		Mutating:       true,
+	}
+}
+
+// manifestObjects splits the manifest and decodes the documents of the kind
+func manifestObjects(t *testing.T, manifest []byte, kind string, into func() interface{}) []interface{} {
+	objects := []interface{}{}
+	for _, document := range bytes.Split(manifest, []byte("\n---\n")) {
+		meta := struct{ Kind string }{}
+		if err := yaml.Unmarshal(document, &meta); err != nil {
+			t.Fatalf("Invalid document %v: %v", string(document), err)
+		}
+		if meta.Kind != kind {
+			continue
+		}
+		object := into()
+		if err := yaml.UnmarshalStrict(document, object); err != nil {
+			t.Fatalf("Invalid %v: %v", kind, err)
+		}
+		objects = append(objects, object)
+	}
+	return objects
+}
+
+func TestGenerate(t *testing.T) {
+	options := genOptions()
+	options.SANs = []string{"webhook.example.com", "10.0.0.1"}
+	options.NamespaceSelector = "team in (ml,research)"
+	files, err := Generate(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tls.X509KeyPair(files["server.pem"], files["server-key.pem"]); err != nil {
+		t.Fatalf("Invalid serving key pair: %v", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(files["ca.pem"]) {
+		t.Fatalf("Invalid CA")
+	}
+	block, _ := pem.Decode(files["server.pem"])
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"simple-admission.admission.svc", "webhook.example.com", "10.0.0.1"} {
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Errorf("Certificate must be valid for %v: %v", name, err)
+		}
+	}
+	if validity := cert.NotAfter.Sub(cert.NotBefore); validity != 24*time.Hour {
+		t.Errorf("Certificate must be valid for 24h, got %v", validity)
+	}
+
+	manifest := files["manifest.yaml"]
+	webhooks := manifestObjects(t, manifest, "ValidatingWebhookConfiguration", func() interface{} { return &admissionregistrationv1.ValidatingWebhookConfiguration{} })
+	if len(webhooks) != 1 {
+		t.Fatalf("Manifest must contain a ValidatingWebhookConfiguration")
+	}
+	webhook := webhooks[0].(*admissionregistrationv1.ValidatingWebhookConfiguration).Webhooks[0]
+	if webhook.Name != "simple-admission.admission.svc" || !bytes.Equal(webhook.ClientConfig.CABundle, files["ca.pem"]) || *webhook.FailurePolicy != admissionregistrationv1.Fail || *webhook.TimeoutSeconds != 10 {
+		t.Errorf("Unexpected webhook %v", webhook)
+	}
+	if selector := webhook.NamespaceSelector.MatchExpressions; len(selector) != 1 || selector[0].Key != "team" || strings.Join(selector[0].Values, ",") != "ml,research" {
+		t.Errorf("Namespace selector must be parsed, got %v", webhook.NamespaceSelector)
+	}
+	if len(manifestObjects(t, manifest, "MutatingWebhookConfiguration", func() interface{} { return &admissionregistrationv1.MutatingWebhookConfiguration{} })) != 1 {
+		t.Errorf("Manifest must contain a MutatingWebhookConfiguration")
+	}
+	secrets := manifestObjects(t, manifest, "Secret", func() interface{} { return &v1.Secret{} })
+	if len(secrets) != 1 || !bytes.Equal(secrets[0].(*v1.Secret).Data["server.pem"], files["server.pem"]) || secrets[0].(*v1.Secret).Namespace != "admission" {
+		t.Errorf("Secret must contain the serving certificate")
+	}
+	for _, kind := range []string{"Deployment", "Service", "ServiceAccount", "ClusterRoleBinding"} {
+		if !bytes.Contains(manifest, []byte("kind: "+kind+"\n")) {
+			t.Errorf("Manifest must contain a %v", kind)
+		}
+	}
+
+	for _, lookups := range []bool{false, true} {
+		options := genOptions()
+		options.Lookups.Secrets = lookups
+		files, err := Generate(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roles := manifestObjects(t, files["manifest.yaml"], "ClusterRole", func() interface{} { return &rbacv1.ClusterRole{} })
+		granted := false
+		for _, rule := range roles[0].(*rbacv1.ClusterRole).Rules {
+			granted = granted || contains(rule.Resources, "secrets")
+		}
+		if granted != lookups {
+			t.Errorf("Secrets must only be listed when the policy looks them up, lookups %v granted %v", lookups, granted)
+		}
+	}
+}
+
+func TestGenerateOwnDeployment(t *testing.T) {
+	files, err := Generate(genOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := files["manifest.yaml"]
+	webhook := manifestObjects(t, manifest, "ValidatingWebhookConfiguration", func() interface{} { return &admissionregistrationv1.ValidatingWebhookConfiguration{} })[0].(*admissionregistrationv1.ValidatingWebhookConfiguration).Webhooks[0]
+	deployment := manifestObjects(t, manifest, "Deployment", func() interface{} { return &appsv1.Deployment{} })[0].(*appsv1.Deployment)
+	namespaceSelector, err := k8meta.LabelSelectorAsSelector(webhook.NamespaceSelector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unlike LabelSelectorAsSelector, the apiserver selects every object without an objectSelector
+	if webhook.ObjectSelector == nil {
+		webhook.ObjectSelector = &k8meta.LabelSelector{}
+	}
+	objectSelector, err := k8meta.LabelSelectorAsSelector(webhook.ObjectSelector)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The apiserver only sends the objects selected by the webhook
+	admit := func(kind string, object k8meta.Object) (bool, error) {
+		if !namespaceSelector.Matches(labels.Set{"kubernetes.io/metadata.name": object.GetNamespace()}) || !objectSelector.Matches(labels.Set(object.GetLabels())) {
+			return true, nil
+		}
+		raw, err := json.Marshal(object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := &admission.AdmissionRequest{
+			Kind:      k8meta.GroupVersionKind{Group: "apps", Version: "v1", Kind: kind},
+			Namespace: object.GetNamespace(),
+			Operation: admission.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		}
+		request.RequestKind = &request.Kind
+		allowed, _, err := checkRequest(context.Background(), request, &AdmissionHandler{RuntimeClass: "gvisor"})
+		return allowed, err
+	}
+
+	// The ReplicaSets of the deployment use the labels of its template
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: k8meta.ObjectMeta{Name: deployment.Name + "-7d9f8", Namespace: deployment.Namespace, Labels: deployment.Spec.Template.Labels},
+		Spec:       appsv1.ReplicaSetSpec{Replicas: deployment.Spec.Replicas, Selector: deployment.Spec.Selector, Template: deployment.Spec.Template},
+	}
+	if allowed, err := admit("Deployment", deployment); !allowed {
+		t.Errorf("The deployment of the webhook must be allowed: %v", err)
+	}
+	if allowed, err := admit("ReplicaSet", replicaSet); !allowed {
+		t.Errorf("The replica sets of the webhook must be allowed: %v", err)
+	}
+
+	other := deployment.DeepCopy()
+	other.Labels = map[string]string{"app": "other"}
+	if allowed, _ := admit("Deployment", other); allowed {
+		t.Errorf("Other deployments in the namespace must be validated")
+	}
+}
+
+func TestGenerateOptions(t *testing.T) {
+	for _, keyType := range keyTypes {
+		options := genOptions()
+		options.KeyType = keyType
+		options.Mutating = false
+		options.CertValidity = 72 * time.Hour
+		files, err := Generate(options)
+		if err != nil {
+			t.Errorf("%v: %v", keyType, err)
+			continue
+		}
+		if _, err := tls.X509KeyPair(files["server.pem"], files["server-key.pem"]); err != nil {
+			t.Errorf("%v: invalid serving key pair: %v", keyType, err)
+		}
+		ca, err := parseCA(files["ca.pem"], files["ca-key.pem"])
+		if err != nil {
+			t.Fatalf("%v: %v", keyType, err)
+		}
+		block, _ := pem.Decode(files["server.pem"])
+		if cert, _ := x509.ParseCertificate(block.Bytes); cert.NotAfter.After(ca.cert.NotAfter) {
+			t.Errorf("%v: certificate must not outlive the CA", keyType)
+		}
+		if bytes.Contains(files["manifest.yaml"], []byte("MutatingWebhookConfiguration")) {
+			t.Errorf("%v: MutatingWebhookConfiguration must be optional", keyType)
+		}
+	}
+
+	options := genOptions()
+	options.SelfManagedCerts = true
+	files, err := Generate(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := files["manifest.yaml"]
+	if len(files) != 1 || bytes.Contains(manifest, []byte("caBundle:")) || bytes.Contains(manifest, []byte("kind: Secret\n")) {
+		t.Errorf("Self-managed certificates must only generate the manifest")
+	}
+	if !bytes.Contains(manifest, []byte("- --selfManagedCerts\n")) || !bytes.Contains(manifest, []byte("kind: RoleBinding\n")) {
+		t.Errorf("Self-managed certificates must be enabled in the deployment")
+	}
+	if !bytes.Contains(manifest, []byte("- --keyType="+options.KeyType+"\n")) {
+		t.Errorf("Key type must be passed to the server")
+	}
+	options.KeyType = "dsa"
+	if _, err := Generate(options); err == nil {
+		t.Errorf("Unknown key type must be rejected with self-managed certificates")
+	}
+
+	options = genOptions()
+	options.ClientAuth = true
+	options.ClientName = "kube-apiserver"
+	options.KubeconfigPath = "/etc/kubernetes/admission/admission-kubeconfig.yaml"
+	if files, err = Generate(options); err != nil {
+		t.Fatal(err)
+	}
+	kubeconfig, err := clientcmd.Load(files["admission-kubeconfig.yaml"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := kubeconfig.AuthInfos["simple-admission.admission.svc"]
+	if user == nil || !bytes.Equal(user.ClientCertificateData, files["client.pem"]) {
+		t.Fatalf("Kubeconfig must authenticate to the service with the client certificate")
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(files["client-ca.pem"])
+	block, _ := pem.Decode(files["client.pem"])
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil || cert.Subject.CommonName != "kube-apiserver" {
+		t.Errorf("Client certificate must be signed by the client CA: %v", err)
+	}
+	manifest = files["manifest.yaml"]
+	secrets := manifestObjects(t, manifest, "Secret", func() interface{} { return &v1.Secret{} })
+	if len(secrets) != 2 || !bytes.Equal(secrets[1].(*v1.Secret).Data["ca.pem"], files["client-ca.pem"]) {
+		t.Errorf("Manifest must contain the client CA secret")
+	}
+	if !bytes.Contains(manifest, []byte("- --clientCAFile=/client-ca/ca.pem\n")) || !bytes.Contains(manifest, []byte("- --allowedClientName=kube-apiserver\n")) {
+		t.Errorf("Client authentication must be enabled in the deployment")
+	}
+	if !bytes.Contains(files["admission-config.yaml"], []byte("kubeConfigFile: /etc/kubernetes/admission/admission-kubeconfig.yaml\n")) {
+		t.Errorf("Admission configuration must reference the kubeconfig")
+	}
+
+	invalid := map[string]func(options *GenOptions){
+		"keyType":       func(options *GenOptions) { options.KeyType = "dsa" },
+		"failurePolicy": func(options *GenOptions) { options.FailurePolicy = "Allow" },
+		"timeout":       func(options *GenOptions) { options.TimeoutSeconds = 31 },
+		"selector":      func(options *GenOptions) { options.NamespaceSelector = "team in ml" },
+		"webhookName":   func(options *GenOptions) { options.WebhookName = "simple-admission" },
+		"validity":      func(options *GenOptions) { options.CAValidity = 0 },
+	}
+	for key, mutate := range invalid {
+		options := genOptions()
+		mutate(&options)
+		if _, err := Generate(options); err == nil {
+			t.Errorf("Invalid option `%v` was accepted", key)
+		}
+	}
+}
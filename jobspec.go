@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+// checkJobSpec validates the retries, parallelism and controller fields of the job.
+// Only Indexed jobs can run more than one completion, each index is still limited
+// by backoffLimitPerIndex and maxFailedIndexes.
+func checkJobSpec(spec *batchv1.JobSpec, profile *Profile) error {
+	policy := &profile.Job
+
+	if spec.Suspend != nil && *spec.Suspend && !policy.AllowSuspend {
+		return fmt.Errorf("suspend must not be used")
+	}
+
+	if spec.ManagedBy != nil && !contains(policy.ManagedBy, *spec.ManagedBy) {
+		return fmt.Errorf("managedBy %v is not allowed", *spec.ManagedBy)
+	}
+
+	if spec.PodReplacementPolicy != nil && !contains(policy.PodReplacementPolicies, string(*spec.PodReplacementPolicy)) {
+		return fmt.Errorf("podReplacementPolicy %v is not allowed", *spec.PodReplacementPolicy)
+	}
+
+	if spec.PodFailurePolicy != nil && !policy.AllowPodFailurePolicy {
+		return fmt.Errorf("podFailurePolicy must not be used")
+	}
+
+	if spec.SuccessPolicy != nil && !policy.AllowSuccessPolicy {
+		return fmt.Errorf("successPolicy must not be used")
+	}
+
+	if spec.CompletionMode != nil && *spec.CompletionMode == batchv1.IndexedCompletion {
+		if policy.MaxIndexedCompletions == 0 {
+			return fmt.Errorf("Indexed completionMode must not be used")
+		}
+		if spec.Completions == nil || *spec.Completions > policy.MaxIndexedCompletions {
+			return fmt.Errorf("Completions of an Indexed job must be set up to %v", policy.MaxIndexedCompletions)
+		}
+		if spec.Parallelism != nil && *spec.Parallelism > policy.MaxIndexedParallelism {
+			return fmt.Errorf("Parallelism of an Indexed job must not be greater than %v", policy.MaxIndexedParallelism)
+		}
+	} else {
+		if spec.Parallelism != nil && *spec.Parallelism != 1 {
+			return fmt.Errorf("Parallelism must not be used")
+		}
+
+		if spec.Completions != nil && *spec.Completions != 1 {
+			return fmt.Errorf("Completions must not be used")
+		}
+	}
+
+	if spec.BackoffLimitPerIndex != nil {
+		// backoffLimit defaults to the max int32 in this mode, the failures are bounded per index instead
+		if *spec.BackoffLimitPerIndex > policy.MaxBackoffLimitPerIndex {
+			return fmt.Errorf("backoffLimitPerIndex must not be greater than %v", policy.MaxBackoffLimitPerIndex)
+		}
+		if spec.MaxFailedIndexes == nil || *spec.MaxFailedIndexes > policy.MaxFailedIndexes {
+			return fmt.Errorf("maxFailedIndexes must be set up to %v when using backoffLimitPerIndex", policy.MaxFailedIndexes)
+		}
+		return nil
+	}
+
+	if spec.BackoffLimit == nil || *spec.BackoffLimit != 1 {
+		return fmt.Errorf("backoffLimit mus be set to 1")
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+func int32Ptr(value int32) *int32 {
+	return &value
+}
+
+func TestJobSpec(t *testing.T) {
+	indexed := batchv1.IndexedCompletion
+	suspend := true
+	failed := batchv1.Failed
+	external := "example.com/multikueue"
+
+	profile := defaultProfile()
+	profile.Job.MaxIndexedCompletions = 10
+	profile.Job.MaxIndexedParallelism = 2
+	profile.Job.MaxBackoffLimitPerIndex = 1
+	profile.Job.MaxFailedIndexes = 2
+
+	cases := map[string]struct {
+		spec    batchv1.JobSpec
+		allowed bool
+	}{
+		"nonIndexed":          {batchv1.JobSpec{BackoffLimit: int32Ptr(1), Completions: int32Ptr(1)}, true},
+		"indexed":             {batchv1.JobSpec{BackoffLimit: int32Ptr(1), CompletionMode: &indexed, Completions: int32Ptr(10), Parallelism: int32Ptr(2)}, true},
+		"indexedCompletions":  {batchv1.JobSpec{BackoffLimit: int32Ptr(1), CompletionMode: &indexed, Completions: int32Ptr(11)}, false},
+		"indexedParallelism":  {batchv1.JobSpec{BackoffLimit: int32Ptr(1), CompletionMode: &indexed, Completions: int32Ptr(4), Parallelism: int32Ptr(4)}, false},
+		"indexedNoCompletion": {batchv1.JobSpec{BackoffLimit: int32Ptr(1), CompletionMode: &indexed}, false},
+		"perIndex":            {batchv1.JobSpec{BackoffLimit: int32Ptr(2147483647), CompletionMode: &indexed, Completions: int32Ptr(4), BackoffLimitPerIndex: int32Ptr(1), MaxFailedIndexes: int32Ptr(2)}, true},
+		"perIndexTooHigh":     {batchv1.JobSpec{CompletionMode: &indexed, Completions: int32Ptr(4), BackoffLimitPerIndex: int32Ptr(3), MaxFailedIndexes: int32Ptr(2)}, false},
+		"perIndexNoMaxFailed": {batchv1.JobSpec{CompletionMode: &indexed, Completions: int32Ptr(4), BackoffLimitPerIndex: int32Ptr(1)}, false},
+		"suspend":             {batchv1.JobSpec{BackoffLimit: int32Ptr(1), Suspend: &suspend}, false},
+		"podFailurePolicy":    {batchv1.JobSpec{BackoffLimit: int32Ptr(1), PodFailurePolicy: &batchv1.PodFailurePolicy{}}, false},
+		"successPolicy":       {batchv1.JobSpec{BackoffLimit: int32Ptr(1), SuccessPolicy: &batchv1.SuccessPolicy{}}, false},
+		"replacementFailed":   {batchv1.JobSpec{BackoffLimit: int32Ptr(1), PodReplacementPolicy: &failed}, true},
+		"managedByExternal":   {batchv1.JobSpec{BackoffLimit: int32Ptr(1), ManagedBy: &external}, false},
+	}
+
+	for key, val := range cases {
+		err := checkJobSpec(&val.spec, &profile)
+		if val.allowed && err != nil {
+			t.Errorf("Valid job spec `%v` was denied: %v", key, err)
+		}
+		if !val.allowed && err == nil {
+			t.Errorf("Invalid job spec `%v` was allowed", key)
+		}
+	}
+
+	profile = defaultProfile()
+	spec := batchv1.JobSpec{BackoffLimit: int32Ptr(1), CompletionMode: &indexed, Completions: int32Ptr(1)}
+	if err := checkJobSpec(&spec, &profile); err == nil {
+		t.Errorf("Indexed jobs must be denied by default")
+	}
+}
@@ -9,40 +9,169 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
 )
 
 var (
-	certFile, keyFile, runtimeClass, port string
+	certFile, keyFile, runtimeClass, port, policyFile, kubeconfig string
+	// Self-managed certificates
+	selfManagedCerts                          bool
+	namespace, service, webhookName, caSecret string
+	caValidity, certValidity                  time.Duration
+	keyType                                   string
+	// Client authentication
+	clientCAFile       string
+	allowedClientNames stringList
+	// TLS parameters
+	tlsMinVersion, tlsMaxVersion, tlsCipherSuites, tlsCurves string
+	logTLSConnections                                        bool
 )
 
+// commands run instead of the webhook server when named by the first argument
+var commands = map[string]func(args []string) error{
+	"export": exportCommand,
+	"gen":    genCommand,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Printf("Error: %v", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	flag.StringVar(&certFile, "certFileFile", "/certs/server.pem", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&keyFile, "keyFileFile", "/certs/server-key.pem", "File containing the x509 private key to --certFileFile.")
 	flag.StringVar(&runtimeClass, "runtimeClass", "gvisor", "RuntimeClass of the sandboxed environment")
 	flag.StringVar(&port, "port", "8443", "Port to listen")
+	flag.StringVar(&policyFile, "policy", "", "File containing the policy profiles, if empty the default profile is used for every namespace")
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "Kubeconfig used for cluster lookups, defaults to the in-cluster configuration")
+	flag.BoolVar(&selfManagedCerts, "selfManagedCerts", false, "Issue the serving certificate from a CA kept in --caSecret and patch the caBundle of the webhooks, instead of loading --certFileFile")
+	flag.StringVar(&namespace, "namespace", "default", "Namespace of the webhook service and of --caSecret")
+	flag.StringVar(&service, "service", "simple-admission", "Service of the webhook, the self-managed certificate is valid for its DNS names")
+	flag.StringVar(&webhookName, "webhookName", "", "Webhook configurations patched with the self-managed CA, defaults to <service>.<namespace>.svc")
+	flag.StringVar(&caSecret, "caSecret", "admission-ca", "Secret with the self-managed CA, created if it does not exist")
+	flag.DurationVar(&caValidity, "caValidity", 5*365*24*time.Hour, "Validity of the self-managed CA when it is created")
+	flag.DurationVar(&certValidity, "certValidity", 24*time.Hour, "Validity of the self-managed serving certificate, renewed when a third is left")
+	flag.StringVar(&keyType, "keyType", KeyECDSAP256, fmt.Sprintf("Key type of the self-managed CA and serving certificate, one of %v", strings.Join(keyTypes, ", ")))
+	flag.StringVar(&clientCAFile, "clientCAFile", "", "Require client certificates signed by the CA in this file, e.g. the certificate of the apiserver")
+	flag.Var(&allowedClientNames, "allowedClientName", "Glob pattern of the common name or SAN of the allowed client certificates, * also matches the / of URIs. Can be repeated, defaults to any certificate signed by --clientCAFile")
+	flag.StringVar(&tlsMinVersion, "tlsMinVersion", "1.2", "Minimum TLS version, 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&tlsMaxVersion, "tlsMaxVersion", "1.3", "Maximum TLS version, 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&tlsCipherSuites, "tlsCipherSuites", "", "Comma separated TLS 1.2 cipher suites, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. Defaults to the Go defaults")
+	flag.StringVar(&tlsCurves, "tlsCurves", "", "Comma separated key exchange groups: X25519, X25519MLKEM768, P-256, P-384 or P-521. Defaults to the Go defaults")
+
+	flag.BoolVar(&logTLSConnections, "logTLSConnections", false, "Log the TLS version, cipher suite and curve negotiated by every connection")
 
 	flag.Parse()
 
-	certs, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		log.Printf("Error loading key pair: %v", err)
+	var err error
+	var policy *Policy
+	if policyFile != "" {
+		policy, err = LoadPolicy(policyFile)
+		if err != nil {
+			log.Printf("Error loading policy: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	config, configErr := LoadClientConfig(kubeconfig)
+	var cluster *Cluster
+	if configErr != nil {
+		log.Printf("Warning: cluster lookups are disabled: %v", configErr)
+	} else if cluster, err = NewCluster(ctx, config, policy); err != nil {
+		log.Printf("Error starting cluster lookups: %v", err)
 		os.Exit(1)
 	}
 
 	server := &http.Server{
-		Addr: fmt.Sprintf(":%v", port),
-		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{certs},
-		},
+		Addr:      fmt.Sprintf(":%v", port),
+		TLSConfig: &tls.Config{},
+	}
+	if selfManagedCerts {
+		if configErr != nil {
+			log.Printf("Error: self-managed certificates need access to the cluster: %v", configErr)
+			os.Exit(1)
+		}
+		if !contains(keyTypes, keyType) {
+			log.Printf("Error: unknown key type %v, must be one of %v", keyType, strings.Join(keyTypes, ", "))
+			os.Exit(1)
+		}
+		client, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			log.Printf("Error creating the client: %v", err)
+			os.Exit(1)
+		}
+		if webhookName == "" {
+			webhookName = fmt.Sprintf("%v.%v.svc", service, namespace)
+		}
+		manager := &CertManager{
+			Client:          client,
+			Namespace:       namespace,
+			SecretName:      caSecret,
+			Service:         service,
+			WebhookName:     webhookName,
+			CAValidity:      caValidity,
+			CertValidity:    certValidity,
+			KeyType:         keyType,
+			RefreshInterval: time.Minute,
+		}
+		if err := manager.Start(ctx); err != nil {
+			log.Printf("Error starting self-managed certificates: %v", err)
+			os.Exit(1)
+		}
+		server.TLSConfig.GetCertificate = manager.GetCertificate
+	} else {
+		certs, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			log.Printf("Error loading key pair: %v", err)
+			os.Exit(1)
+		}
+		server.TLSConfig.Certificates = []tls.Certificate{certs}
+	}
+	if clientCAFile != "" {
+		if err := requireClientCerts(server.TLSConfig, clientCAFile, allowedClientNames); err != nil {
+			log.Printf("Error loading the client CA: %v", err)
+			os.Exit(1)
+		}
+	} else if len(allowedClientNames) > 0 {
+		log.Printf("Error: --allowedClientName requires --clientCAFile")
+		os.Exit(1)
+	}
+
+	tlsOptions := TLSOptions{
+		MinVersion:     tlsMinVersion,
+		MaxVersion:     tlsMaxVersion,
+		CipherSuites:   splitList(tlsCipherSuites),
+		Curves:         splitList(tlsCurves),
+		LogConnections: logTLSConnections,
+	}
+	if err := tlsOptions.apply(server.TLSConfig); err != nil {
+		log.Printf("Error in the TLS options: %v", err)
+		os.Exit(1)
 	}
+	log.Printf("Using %v", tlsOptions)
 
 	// Define server  handler
 	handler := AdmissionHandler{
 		RuntimeClass: runtimeClass,
+		Policy:       policy,
+		Cluster:      cluster,
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/validate", handler.handler)
+	mux.HandleFunc("/mutate", handler.mutateHandler)
 	server.Handler = mux
 
 	go func() {
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+// MetadataRule requires a label or annotation key, with an optional constraint on the value
+type MetadataRule struct {
+	Key string `json:"key"`
+	// Regex that the value must match
+	Pattern string `json:"pattern,omitempty"`
+	// List of allowed values
+	Values []string `json:"values,omitempty"`
+
+	regex *regexp.Regexp
+}
+
+// UnmarshalJSON compiles the pattern of the rule
+func (rule *MetadataRule) UnmarshalJSON(data []byte) error {
+	type plain MetadataRule
+	if err := json.Unmarshal(data, (*plain)(rule)); err != nil {
+		return err
+	}
+	if rule.Key == "" {
+		return fmt.Errorf("metadata rules must set a key")
+	}
+	if rule.Pattern == "" {
+		return nil
+	}
+	regex, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %v of key %v: %v", rule.Pattern, rule.Key, err)
+	}
+	rule.regex = regex
+	return nil
+}
+
+func (rule *MetadataRule) check(kind, location string, values map[string]string) error {
+	value, ok := values[rule.Key]
+	if !ok {
+		return fmt.Errorf("%v %v is required in %v", kind, rule.Key, location)
+	}
+	if rule.regex != nil && !rule.regex.MatchString(value) {
+		return fmt.Errorf("%v %v in %v must match %v", kind, rule.Key, location, rule.Pattern)
+	}
+	if len(rule.Values) > 0 && !contains(rule.Values, value) {
+		return fmt.Errorf("%v %v in %v must be one of %v", kind, rule.Key, location, rule.Values)
+	}
+	return nil
+}
+
+// checkMetadata validates the required labels of the job and its pod template, and the
+// required annotations of the job
+func checkMetadata(job *batchv1.Job, profile *Profile) error {
+	policy := &profile.Metadata
+	templateLabels := job.Spec.Template.Labels
+	for _, rule := range policy.Labels {
+		if err := rule.check("label", "metadata", job.Labels); err != nil {
+			return err
+		}
+		if err := rule.check("label", "spec.template.metadata", templateLabels); err != nil {
+			return err
+		}
+		if policy.ConsistentLabels && job.Labels[rule.Key] != templateLabels[rule.Key] {
+			return fmt.Errorf("label %v must have the same value in the job and in the pod template", rule.Key)
+		}
+	}
+
+	for _, rule := range policy.Annotations {
+		if err := rule.check("annotation", "metadata", job.Annotations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metadataPatches copies the required labels missing in the job or the template from the namespace labels
+func metadataPatches(job *batchv1.Job, profile *Profile, cluster *Cluster) []patchOperation {
+	policy := &profile.Metadata
+	if !policy.FillFromNamespace || len(policy.Labels) == 0 {
+		return nil
+	}
+	namespaceLabels, err := cluster.NamespaceLabels(job.Namespace)
+	if err != nil {
+		return nil
+	}
+
+	missing := func(pointer string, labels map[string]string) []patchOperation {
+		values := map[string]string{}
+		for _, rule := range policy.Labels {
+			if _, ok := labels[rule.Key]; ok {
+				continue
+			}
+			if value, ok := namespaceLabels[rule.Key]; ok {
+				values[rule.Key] = value
+			}
+		}
+		if len(values) == 0 {
+			return nil
+		}
+		if labels == nil {
+			return []patchOperation{{"add", pointer, values}}
+		}
+		patches := []patchOperation{}
+		for _, key := range sortedKeys(values) {
+			patches = append(patches, patchOperation{"add", pointer + "/" + escapePointer(key), values[key]})
+		}
+		return patches
+	}
+	return append(missing("/metadata/labels", job.Labels), missing("/spec/template/metadata/labels", job.Spec.Template.Labels)...)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+func metadataProfile(t *testing.T) *Profile {
+	profile := &Profile{}
+	if err := yaml.Unmarshal([]byte(`
+metadata:
+  labels:
+  - key: team
+  - key: cost-center
+    pattern: "^cc-[0-9]+$"
+  annotations:
+  - key: owner
+    values: ["alice", "bob"]
+  consistentLabels: true
+  fillFromNamespace: true
+`), profile); err != nil {
+		t.Fatal(err)
+	}
+	return profile
+}
+
+func metadataJob() *batchv1.Job {
+	job := &batchv1.Job{}
+	job.Namespace = "default"
+	job.Labels = map[string]string{"team": "data", "cost-center": "cc-10"}
+	job.Annotations = map[string]string{"owner": "alice"}
+	job.Spec.Template.Labels = map[string]string{"team": "data", "cost-center": "cc-10"}
+	return job
+}
+
+func TestMetadata(t *testing.T) {
+	cases := map[string]struct {
+		mutate  func(*batchv1.Job)
+		allowed bool
+	}{
+		"valid":           {func(job *batchv1.Job) {}, true},
+		"missingLabel":    {func(job *batchv1.Job) { delete(job.Labels, "team") }, false},
+		"missingTemplate": {func(job *batchv1.Job) { job.Spec.Template.Labels = nil }, false},
+		"pattern":         {func(job *batchv1.Job) { job.Labels["cost-center"] = "marketing" }, false},
+		"inconsistent":    {func(job *batchv1.Job) { job.Spec.Template.Labels["team"] = "web" }, false},
+		"missingOwner":    {func(job *batchv1.Job) { job.Annotations = nil }, false},
+		"ownerNotInEnum":  {func(job *batchv1.Job) { job.Annotations["owner"] = "mallory" }, false},
+	}
+
+	for key, val := range cases {
+		job := metadataJob()
+		val.mutate(job)
+		err := checkMetadata(job, metadataProfile(t))
+		if val.allowed && err != nil {
+			t.Errorf("Valid metadata `%v` was denied: %v", key, err)
+		}
+		if !val.allowed && err == nil {
+			t.Errorf("Invalid metadata `%v` was allowed", key)
+		}
+	}
+
+	if err := yaml.Unmarshal([]byte(`{"key": "team", "pattern": "("}`), &MetadataRule{}); err == nil {
+		t.Errorf("Invalid pattern was loaded")
+	}
+}
+
+func TestMetadataPatches(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(&k8meta.PartialObjectMetadata{ObjectMeta: k8meta.ObjectMeta{
+		Name: "default", Labels: map[string]string{"team": "data", "cost-center": "cc-10"},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	cluster := &Cluster{Namespaces: cache.NewGenericLister(indexer, schema.GroupResource{Resource: "namespaces"})}
+
+	job := metadataJob()
+	delete(job.Labels, "team")
+	job.Spec.Template.Labels = nil
+	patches := metadataPatches(job, metadataProfile(t), cluster)
+	if len(patches) != 2 || patches[0].Path != "/metadata/labels/team" || patches[1].Path != "/spec/template/metadata/labels" {
+		t.Fatalf("Unexpected patches %v", patches)
+	}
+
+	job.Labels = map[string]string{}
+	for i := 0; i < 10; i++ {
+		patches = metadataPatches(job, metadataProfile(t), cluster)
+		if len(patches) != 3 || patches[0].Path != "/metadata/labels/cost-center" || patches[1].Path != "/metadata/labels/team" {
+			t.Fatalf("Label patches must be ordered by key, got %v", patches)
+		}
+	}
+
+	if patches = metadataPatches(metadataJob(), metadataProfile(t), cluster); len(patches) != 0 {
+		t.Fatalf("Labels already set must not be patched, got %v", patches)
+	}
+	if patches = metadataPatches(job, metadataProfile(t), nil); len(patches) != 0 {
+		t.Fatalf("Labels must not be patched without cluster lookups, got %v", patches)
+	}
+}
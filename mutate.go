@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	admission "k8s.io/api/admission/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+const podSpecPointer = "/spec/template/spec"
+
+// JSON patch operation, see RFC 6902
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// MarshalJSON keeps empty values, like an empty label, and only omits the value of remove operations
+func (patch patchOperation) MarshalJSON() ([]byte, error) {
+	if patch.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{patch.Op, patch.Path})
+	}
+	type operation patchOperation
+	return json.Marshal(operation(patch))
+}
+
+// Handle mutation requests
+func (handler *AdmissionHandler) mutateHandler(w http.ResponseWriter, r *http.Request) {
+	handler.serve(w, r, handler.mutate)
+}
+
+// mutate fills the fields that the profile injects, it never denies a request
+func (handler *AdmissionHandler) mutate(ctx context.Context, request *admission.AdmissionRequest) *admission.AdmissionResponse {
+	response := &admission.AdmissionResponse{
+		Allowed: true,
+	}
+	// Most of the pod template is immutable, so only new jobs are patched
+	if request.Operation != admission.Create {
+		return response
+	}
+	job := decodeJob(request)
+	if job == nil {
+		return response
+	}
+
+	patches := mutateJob(job, handler.profile(job.Namespace), handler.Cluster)
+	if len(patches) == 0 {
+		return response
+	}
+	patch, err := json.Marshal(patches)
+	if err != nil {
+		log.Printf("Error encoding patch %v", err)
+		return response
+	}
+	patchType := admission.PatchTypeJSONPatch
+	response.Patch = patch
+	response.PatchType = &patchType
+	return response
+}
+
+func mutateJob(job *batchv1.Job, profile *Profile, cluster *Cluster) []patchOperation {
+	patches := []patchOperation{}
+	patches = append(patches, metadataPatches(job, profile, cluster)...)
+	patches = append(patches, placementPatches(&job.Spec.Template.Spec, profile)...)
+	if job.Spec.Template.Spec.PriorityClassName == "" && profile.Priority.Default != "" {
+		patches = append(patches, patchOperation{"add", podSpecPointer + "/priorityClassName", profile.Priority.Default})
+	}
+	return patches
+}
+
+// placementPatches adds the required node selector and the tolerations marked to be injected
+func placementPatches(spec *v1.PodSpec, profile *Profile) []patchOperation {
+	patches := []patchOperation{}
+	if profile.Placement.Inject && len(profile.Placement.NodeSelector) > 0 {
+		if spec.NodeSelector == nil {
+			patches = append(patches, patchOperation{"add", podSpecPointer + "/nodeSelector", profile.Placement.NodeSelector})
+		} else {
+			for _, key := range sortedKeys(profile.Placement.NodeSelector) {
+				if value := profile.Placement.NodeSelector[key]; spec.NodeSelector[key] != value {
+					patches = append(patches, patchOperation{"add", podSpecPointer + "/nodeSelector/" + escapePointer(key), value})
+				}
+			}
+		}
+	}
+
+	tolerations := []v1.Toleration{}
+	for _, rule := range profile.Placement.Tolerations {
+		if !rule.Inject || hasToleration(spec.Tolerations, &rule) {
+			continue
+		}
+		tolerations = append(tolerations, v1.Toleration{Key: rule.Key, Operator: v1.TolerationOpExists, Effect: rule.Effect})
+	}
+	if len(spec.Tolerations) == 0 && len(tolerations) > 0 {
+		patches = append(patches, patchOperation{"add", podSpecPointer + "/tolerations", tolerations})
+	} else {
+		for _, toleration := range tolerations {
+			patches = append(patches, patchOperation{"add", podSpecPointer + "/tolerations/-", toleration})
+		}
+	}
+	return patches
+}
+
+func hasToleration(tolerations []v1.Toleration, rule *TolerationRule) bool {
+	for i := range tolerations {
+		if rule.match(&tolerations[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// escapePointer escapes a key to be used in a JSON pointer, see RFC 6901
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
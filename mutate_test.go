@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestMutate(t *testing.T) {
+	review := loadValidJob(t)
+	handler := AdmissionHandler{RuntimeClass: "gvisor"}
+
+	response := handler.mutate(context.Background(), review.Request)
+	if !response.Allowed || response.Patch != nil {
+		t.Fatalf("Default profile must not patch the job, got %s", response.Patch)
+	}
+
+	profile := placementProfile()
+	profile.Placement.Inject = true
+	handler.Policy = &Policy{DefaultProfile: "sandbox", Profiles: map[string]*Profile{"sandbox": profile}}
+	response = handler.mutate(context.Background(), review.Request)
+	if !response.Allowed || response.PatchType == nil {
+		t.Fatalf("Expected a JSON patch")
+	}
+	patches := []patchOperation{}
+	if err := json.Unmarshal(response.Patch, &patches); err != nil {
+		t.Fatal(err)
+	}
+	if len(patches) != 2 {
+		t.Fatalf("Expected node selector and toleration patches, got %s", response.Patch)
+	}
+
+	review.Request.Namespace = "kube-system"
+	if response = handler.mutate(context.Background(), review.Request); response.Patch != nil {
+		t.Fatalf("Requests of kube-system must not be patched")
+	}
+}
+
+func TestPatchOperationJSON(t *testing.T) {
+	cases := map[string]struct {
+		patch    patchOperation
+		expected string
+	}{
+		"emptyString": {patch: patchOperation{"add", "/metadata/labels/team", ""}, expected: `{"op":"add","path":"/metadata/labels/team","value":""}`},
+		"false":       {patch: patchOperation{"replace", "/spec/suspend", false}, expected: `{"op":"replace","path":"/spec/suspend","value":false}`},
+		"zero":        {patch: patchOperation{"add", "/spec/priority", 0}, expected: `{"op":"add","path":"/spec/priority","value":0}`},
+		"remove":      {patch: patchOperation{Op: "remove", Path: "/spec/priority"}, expected: `{"op":"remove","path":"/spec/priority"}`},
+	}
+	for key, val := range cases {
+		data, err := json.Marshal([]patchOperation{val.patch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "["+val.expected+"]" {
+			t.Errorf("%v: expected %v, got %s", key, val.expected, data)
+		}
+	}
+}
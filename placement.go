@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// TolerationRule allows the tolerations with the key and effect, an empty effect allows every effect
+type TolerationRule struct {
+	Key    string         `json:"key"`
+	Effect v1.TaintEffect `json:"effect,omitempty"`
+	// Add the toleration with the Exists operator in the /mutate path
+	Inject bool `json:"inject,omitempty"`
+}
+
+func (rule *TolerationRule) match(toleration *v1.Toleration) bool {
+	return rule.Key == toleration.Key && (rule.Effect == "" || rule.Effect == toleration.Effect)
+}
+
+// allowedTolerations returns the tolerations of the profile, including the ones of the
+// runtime class scheduling when the profile builds on it
+func allowedTolerations(profile *Profile, cluster *Cluster) ([]TolerationRule, error) {
+	tolerations := append([]TolerationRule{}, profile.Placement.Tolerations...)
+	if !profile.Placement.FromRuntimeClass {
+		return tolerations, nil
+	}
+
+	runtimeClass, err := cluster.RuntimeClass(profile.RuntimeClass)
+	if err != nil {
+		return nil, fmt.Errorf("can't read runtimeClass %v: %v", profile.RuntimeClass, err)
+	}
+	if runtimeClass.Scheduling != nil {
+		for _, toleration := range runtimeClass.Scheduling.Tolerations {
+			tolerations = append(tolerations, TolerationRule{Key: toleration.Key, Effect: toleration.Effect})
+		}
+	}
+	return tolerations, nil
+}
+
+// checkPlacement requires the pod to select the sandbox nodes, to only use the allowed
+// tolerations and to not be pinned to a node. path is the path of the spec
+func checkPlacement(spec *v1.PodSpec, path *field.Path, profile *Profile, cluster *Cluster) error {
+	if spec.NodeName != "" && !profile.Placement.AllowNodeName {
+		return field.Forbidden(path.Child("nodeName"), "nodeName must not be set")
+	}
+
+	// The node selector of the runtime class doesn't need to be checked,
+	// the RuntimeClass admission plugin merges it in the pod
+	for _, key := range sortedKeys(profile.Placement.NodeSelector) {
+		if value := profile.Placement.NodeSelector[key]; spec.NodeSelector[key] != value && !affinityRequires(spec.Affinity, key, value) {
+			return field.Required(path.Child("nodeSelector").Key(key), fmt.Sprintf("nodeSelector or a required node affinity must select %v=%v", key, value))
+		}
+	}
+
+	tolerations, err := allowedTolerations(profile, cluster)
+	if err != nil {
+		return field.Forbidden(path.Child("tolerations"), err.Error())
+	}
+
+	for i, toleration := range spec.Tolerations {
+		allowed := false
+		for _, rule := range tolerations {
+			if rule.match(&spec.Tolerations[i]) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return field.Forbidden(path.Child("tolerations").Index(i), fmt.Sprintf("toleration %v with effect %v is not allowed", toleration.Key, toleration.Effect))
+		}
+	}
+	return nil
+}
+
+// affinityRequires returns if every required node selector term restricts the key to the value
+func affinityRequires(affinity *v1.Affinity, key, value string) bool {
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return false
+	}
+	terms := affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) == 0 {
+		return false
+	}
+	for _, term := range terms {
+		restricted := false
+		for _, expression := range term.MatchExpressions {
+			if expression.Key == key && expression.Operator == v1.NodeSelectorOpIn && len(expression.Values) == 1 && expression.Values[0] == value {
+				restricted = true
+			}
+		}
+		if !restricted {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	nodev1 "k8s.io/api/node/v1"
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	nodelisters "k8s.io/client-go/listers/node/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func placementProfile() *Profile {
+	profile := defaultProfile()
+	profile.RuntimeClass = "gvisor"
+	profile.Placement.NodeSelector = map[string]string{"pool": "sandbox"}
+	profile.Placement.Tolerations = append(profile.Placement.Tolerations, TolerationRule{Key: "sandbox", Effect: v1.TaintEffectNoSchedule, Inject: true})
+	return &profile
+}
+
+func runtimeClassCluster(t *testing.T, runtimeClasses ...*nodev1.RuntimeClass) *Cluster {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, runtimeClass := range runtimeClasses {
+		if err := indexer.Add(runtimeClass); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Cluster{RuntimeClasses: nodelisters.NewRuntimeClassLister(indexer)}
+}
+
+func TestPlacement(t *testing.T) {
+	selector := map[string]string{"pool": "sandbox"}
+	affinity := &v1.Affinity{NodeAffinity: &v1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+		NodeSelectorTerms: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{{Key: "pool", Operator: v1.NodeSelectorOpIn, Values: []string{"sandbox"}}}}},
+	}}}
+	cases := map[string]struct {
+		spec    v1.PodSpec
+		allowed bool
+	}{
+		"nodeSelector":        {v1.PodSpec{NodeSelector: selector}, true},
+		"affinity":            {v1.PodSpec{Affinity: affinity}, true},
+		"toleration":          {v1.PodSpec{NodeSelector: selector, Tolerations: []v1.Toleration{{Key: "sandbox", Effect: v1.TaintEffectNoSchedule}}}, true},
+		"defaultToleration":   {v1.PodSpec{NodeSelector: selector, Tolerations: []v1.Toleration{{Key: v1.TaintNodeNotReady, Effect: v1.TaintEffectNoExecute}}}, true},
+		"missingSelector":     {v1.PodSpec{}, false},
+		"wrongSelector":       {v1.PodSpec{NodeSelector: map[string]string{"pool": "default"}}, false},
+		"otherToleration":     {v1.PodSpec{NodeSelector: selector, Tolerations: []v1.Toleration{{Key: "gpu"}}}, false},
+		"wrongEffect":         {v1.PodSpec{NodeSelector: selector, Tolerations: []v1.Toleration{{Key: "sandbox", Effect: v1.TaintEffectNoExecute}}}, false},
+		"nodeName":            {v1.PodSpec{NodeSelector: selector, NodeName: "node-1"}, false},
+		"runtimeClassMissing": {v1.PodSpec{NodeSelector: selector, Tolerations: []v1.Toleration{{Key: "runtime"}}}, false},
+	}
+
+	for key, val := range cases {
+		err := checkPlacement(&val.spec, field.NewPath("spec"), placementProfile(), nil)
+		if val.allowed && err != nil {
+			t.Errorf("Valid placement `%v` was denied: %v", key, err)
+		}
+		if !val.allowed && err == nil {
+			t.Errorf("Invalid placement `%v` was allowed", key)
+		}
+	}
+}
+
+func TestPlacementFromRuntimeClass(t *testing.T) {
+	cluster := runtimeClassCluster(t, &nodev1.RuntimeClass{
+		ObjectMeta: k8meta.ObjectMeta{Name: "gvisor"},
+		Scheduling: &nodev1.Scheduling{Tolerations: []v1.Toleration{{Key: "runtime", Effect: v1.TaintEffectNoSchedule}}},
+	})
+	profile := placementProfile()
+	profile.Placement.FromRuntimeClass = true
+
+	spec := v1.PodSpec{NodeSelector: map[string]string{"pool": "sandbox"}, Tolerations: []v1.Toleration{{Key: "runtime", Effect: v1.TaintEffectNoSchedule}}}
+	if err := checkPlacement(&spec, field.NewPath("spec"), profile, cluster); err != nil {
+		t.Errorf("Toleration of the runtime class was denied: %v", err)
+	}
+	if err := checkPlacement(&spec, field.NewPath("spec"), profile, nil); err == nil {
+		t.Errorf("Runtime class tolerations were allowed without cluster lookups")
+	}
+}
+
+func TestPlacementPatches(t *testing.T) {
+	patches := placementPatches(&v1.PodSpec{}, placementProfile())
+	if len(patches) != 1 || patches[0].Path != "/spec/template/spec/tolerations" {
+		t.Fatalf("Node selector must not be injected unless enabled, got %v", patches)
+	}
+
+	profile := placementProfile()
+	profile.Placement.Inject = true
+	patches = placementPatches(&v1.PodSpec{}, profile)
+	if len(patches) != 2 || patches[0].Path != "/spec/template/spec/nodeSelector" || patches[1].Path != "/spec/template/spec/tolerations" {
+		t.Fatalf("Unexpected patches for an empty spec %v", patches)
+	}
+
+	spec := v1.PodSpec{
+		NodeSelector: map[string]string{"kubernetes.io/os": "linux"},
+		Tolerations:  []v1.Toleration{{Key: "other"}},
+	}
+	profile.Placement.NodeSelector["example.com/pool"] = "sandbox"
+	profile.Placement.NodeSelector["zone"] = "a"
+	expected := []string{"/spec/template/spec/nodeSelector/example.com~1pool", "/spec/template/spec/nodeSelector/pool", "/spec/template/spec/nodeSelector/zone", "/spec/template/spec/tolerations/-"}
+	for i := 0; i < 10; i++ {
+		patches = placementPatches(&spec, profile)
+		paths := []string{}
+		for _, patch := range patches {
+			paths = append(paths, patch.Path)
+		}
+		if strings.Join(paths, " ") != strings.Join(expected, " ") {
+			t.Fatalf("Patches must be ordered by key, expected %v, got %v", expected, paths)
+		}
+	}
+
+	spec = v1.PodSpec{NodeSelector: profile.Placement.NodeSelector, Tolerations: []v1.Toleration{{Key: "sandbox", Effect: v1.TaintEffectNoSchedule}}}
+	if patches = placementPatches(&spec, profile); len(patches) != 0 {
+		t.Errorf("Placement already set must not be patched, got %v", patches)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// checkPodFields restricts the pod fields that weaken the isolation of the sandbox:
+// DNS resolution, host aliases, shared namespaces, the hostname and the OS. path is the path of the spec
+func checkPodFields(spec *v1.PodSpec, path *field.Path, profile *Profile) error {
+	policy := &profile.Pod
+
+	dnsPolicy := spec.DNSPolicy
+	if dnsPolicy == "" {
+		dnsPolicy = v1.DNSClusterFirst
+	}
+	if !contains(policy.DNSPolicies, string(dnsPolicy)) {
+		return field.Forbidden(path.Child("dnsPolicy"), fmt.Sprintf("dnsPolicy %v is not allowed", dnsPolicy))
+	}
+	if spec.DNSConfig != nil {
+		for i, nameserver := range spec.DNSConfig.Nameservers {
+			if !contains(policy.Nameservers, nameserver) {
+				return field.Forbidden(path.Child("dnsConfig", "nameservers").Index(i), fmt.Sprintf("dnsConfig nameserver %v is not allowed", nameserver))
+			}
+		}
+	}
+
+	if len(spec.HostAliases) > 0 && !policy.AllowHostAliases {
+		return field.Forbidden(path.Child("hostAliases"), "hostAliases must not be set")
+	}
+
+	if spec.ShareProcessNamespace != nil && *spec.ShareProcessNamespace && !policy.AllowShareProcessNamespace {
+		return field.Forbidden(path.Child("shareProcessNamespace"), "shareProcessNamespace must be false")
+	}
+
+	if policy.RequireUserNamespace && (spec.HostUsers == nil || *spec.HostUsers) {
+		return field.Required(path.Child("hostUsers"), "hostUsers must be false")
+	}
+
+	if spec.SetHostnameAsFQDN != nil && *spec.SetHostnameAsFQDN && !policy.AllowSetHostnameAsFQDN {
+		return field.Forbidden(path.Child("setHostnameAsFQDN"), "setHostnameAsFQDN must be false")
+	}
+
+	if spec.OS != nil && !contains(policy.OS, string(spec.OS.Name)) {
+		return field.Forbidden(path.Child("os", "name"), fmt.Sprintf("os %v is not allowed", spec.OS.Name))
+	}
+	return nil
+}
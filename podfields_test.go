@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestPodFieldSwitches(t *testing.T) {
+	enabled, disabled := true, false
+	spec := v1.PodSpec{
+		DNSPolicy:             v1.DNSNone,
+		DNSConfig:             &v1.PodDNSConfig{Nameservers: []string{"10.0.0.10"}},
+		HostAliases:           []v1.HostAlias{{IP: "10.0.0.1", Hostnames: []string{"api"}}},
+		ShareProcessNamespace: &enabled,
+		SetHostnameAsFQDN:     &enabled,
+		OS:                    &v1.PodOS{Name: v1.Linux},
+	}
+
+	profile := defaultProfile()
+	if err := checkPodFields(&spec, field.NewPath("spec"), &profile); err == nil {
+		t.Fatalf("Default profile allowed the pod fields")
+	}
+
+	profile.Pod = PodPolicy{
+		DNSPolicies:                []string{string(v1.DNSClusterFirst), string(v1.DNSNone)},
+		Nameservers:                []string{"10.0.0.10"},
+		AllowHostAliases:           true,
+		AllowShareProcessNamespace: true,
+		AllowSetHostnameAsFQDN:     true,
+		OS:                         []string{string(v1.Linux)},
+	}
+	if err := checkPodFields(&spec, field.NewPath("spec"), &profile); err != nil {
+		t.Fatalf("Pod fields allowed by the profile were denied: %v", err)
+	}
+
+	profile.Pod.RequireUserNamespace = true
+	if err := checkPodFields(&spec, field.NewPath("spec"), &profile); err == nil {
+		t.Fatalf("Pod without user namespace was allowed")
+	}
+	spec.HostUsers = &disabled
+	if err := checkPodFields(&spec, field.NewPath("spec"), &profile); err != nil {
+		t.Fatalf("Pod with user namespace was denied: %v", err)
+	}
+}
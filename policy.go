@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+// Policy selects the profile used to validate the jobs of each namespace
+type Policy struct {
+	// Profile used for namespaces without an explicit mapping
+	DefaultProfile string `json:"defaultProfile,omitempty"`
+	// Namespace name to profile name
+	Namespaces map[string]string   `json:"namespaces,omitempty"`
+	Profiles   map[string]*Profile `json:"profiles,omitempty"`
+	// Other kinds whose embedded pod specs are validated with the pod and container checks
+	Workloads []WorkloadRule `json:"workloads,omitempty"`
+	// Rules declared as CEL expressions
+	CEL CELPolicy `json:"cel,omitempty"`
+	// Rules written in Rego
+	Rego RegoPolicy `json:"rego,omitempty"`
+	// Rules compiled to WASM modules
+	WASM WASMPolicy `json:"wasm,omitempty"`
+	// Rules evaluated by external HTTP or gRPC endpoints
+	External []ExternalRule `json:"external,omitempty"`
+
+	// Rules of the policy file, compiled when it is loaded
+	rules []Rule
+}
+
+// Profile contains the settings of the rules applied to a job
+type Profile struct {
+	RuntimeClass    string               `json:"runtimeClass,omitempty"`
+	Env             EnvPolicy            `json:"env,omitempty"`
+	SecretScan      SecretScan           `json:"secretScan,omitempty"`
+	Capabilities    CapabilityPolicy     `json:"capabilities,omitempty"`
+	Sysctls         SysctlPolicy         `json:"sysctls,omitempty"`
+	ServiceAccounts ServiceAccountPolicy `json:"serviceAccounts,omitempty"`
+	Placement       PlacementPolicy      `json:"placement,omitempty"`
+	Priority        PriorityPolicy       `json:"priority,omitempty"`
+	Pod             PodPolicy            `json:"pod,omitempty"`
+	Limits          LimitsPolicy         `json:"limits,omitempty"`
+	Metadata        MetadataPolicy       `json:"metadata,omitempty"`
+	Job             JobPolicy            `json:"job,omitempty"`
+	// Commands that containers are not allowed to run
+	DeniedCommands []CommandRule `json:"deniedCommands,omitempty"`
+}
+
+// EnvPolicy lists the sources that env and envFrom are allowed to reference
+type EnvPolicy struct {
+	Secrets    []ObjectRef `json:"secrets,omitempty"`
+	ConfigMaps []ObjectRef `json:"configMaps,omitempty"`
+	// Allowed fieldRef.fieldPath values, e.g. metadata.name
+	FieldRefs []string `json:"fieldRefs,omitempty"`
+	// Allowed resourceFieldRef.resource values, e.g. limits.cpu
+	ResourceFieldRefs []string `json:"resourceFieldRefs,omitempty"`
+	// Glob patterns of the env names that can be set, empty allows every name
+	AllowedNames []string `json:"allowedNames,omitempty"`
+	// Glob patterns of the env names that can't be set, matched ignoring case
+	DeniedNames []string `json:"deniedNames,omitempty"`
+}
+
+// ObjectRef matches a Secret or ConfigMap by name pattern and/or labels
+type ObjectRef struct {
+	// Glob pattern matched against the object name
+	Name string `json:"name,omitempty"`
+	// Selector matched against the labels of the object
+	Selector *k8meta.LabelSelector `json:"selector,omitempty"`
+	// Glob patterns of the keys that can be referenced, empty allows all keys
+	// (and is required to reference the object through envFrom)
+	Keys []string `json:"keys,omitempty"`
+}
+
+// CapabilityPolicy lists the capabilities that containers can add after dropping ALL
+type CapabilityPolicy struct {
+	// Names with or without the CAP_ prefix, in any case
+	Add []string `json:"add,omitempty"`
+}
+
+// SysctlPolicy lists the sysctls that pods can set
+type SysctlPolicy struct {
+	// Defaults to the sysctls considered safe by Kubernetes
+	Allowed []string `json:"allowed,omitempty"`
+	// Optional regex that the whole value of an allowed sysctl must match
+	Values map[string]string `json:"values,omitempty"`
+
+	values map[string]*regexp.Regexp
+}
+
+// ServiceAccountPolicy lists the identities that pods can use
+type ServiceAccountPolicy struct {
+	// Service account names, an empty serviceAccountName is the default service account
+	Allowed []string `json:"allowed,omitempty"`
+	// When set, automountServiceAccountToken must be false in the pod or in the service account
+	ForbidTokenAutomount bool `json:"forbidTokenAutomount,omitempty"`
+}
+
+// PlacementPolicy restricts the nodes where the pods can run
+type PlacementPolicy struct {
+	// Labels that the nodeSelector or every required node affinity term must select
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Allowed tolerations, defaults to the ones added by the DefaultTolerationSeconds plugin
+	Tolerations []TolerationRule `json:"tolerations,omitempty"`
+	// Also allow the tolerations of the runtime class scheduling
+	FromRuntimeClass bool `json:"fromRuntimeClass,omitempty"`
+	// Allow pinning pods to a node with nodeName
+	AllowNodeName bool `json:"allowNodeName,omitempty"`
+	// Inject the nodeSelector in the /mutate path
+	Inject bool `json:"inject,omitempty"`
+}
+
+// PriorityPolicy restricts the priority classes of the pods
+type PriorityPolicy struct {
+	// Allowed priorityClassName values, pods without priorityClassName are always allowed
+	Allowed []string `json:"allowed,omitempty"`
+	// Class set by the /mutate path when the pod doesn't set one, it must be allowed
+	Default string `json:"default,omitempty"`
+	// Deny pods that would preempt others, for untrusted tenants
+	ForbidPreemption bool `json:"forbidPreemption,omitempty"`
+	// Maximum priority value, resolved from the priority class
+	MaxValue *int32 `json:"maxValue,omitempty"`
+}
+
+// PodPolicy contains the switches of the pod fields related to isolation
+type PodPolicy struct {
+	// Allowed dnsPolicy values, defaults to ClusterFirst
+	DNSPolicies []string `json:"dnsPolicies,omitempty"`
+	// Nameservers that dnsConfig can add, defaults to none
+	Nameservers                []string `json:"nameservers,omitempty"`
+	AllowHostAliases           bool     `json:"allowHostAliases,omitempty"`
+	AllowShareProcessNamespace bool     `json:"allowShareProcessNamespace,omitempty"`
+	AllowSetHostnameAsFQDN     bool     `json:"allowSetHostnameAsFQDN,omitempty"`
+	// Require hostUsers: false, the cluster must support user namespaces
+	RequireUserNamespace bool `json:"requireUserNamespace,omitempty"`
+	// Allowed os.name values, defaults to linux
+	OS []string `json:"os,omitempty"`
+}
+
+// LimitsPolicy bounds the number of containers and the lifetime of the pod
+type LimitsPolicy struct {
+	// Zero, the default, allows any number
+	MaxContainers     int `json:"maxContainers,omitempty"`
+	MaxInitContainers int `json:"maxInitContainers,omitempty"`
+	// Defaults to 30, the Kubernetes default
+	MaxTerminationGracePeriodSeconds int64 `json:"maxTerminationGracePeriodSeconds"`
+	ForbidLifecycleHooks             bool  `json:"forbidLifecycleHooks,omitempty"`
+	ForbidExecProbes                 bool  `json:"forbidExecProbes,omitempty"`
+}
+
+// MetadataPolicy lists the labels and annotations that jobs must set
+type MetadataPolicy struct {
+	// Labels required in the job and in the pod template
+	Labels []MetadataRule `json:"labels,omitempty"`
+	// Annotations required in the job
+	Annotations []MetadataRule `json:"annotations,omitempty"`
+	// Required labels must have the same value in the job and in the pod template
+	ConsistentLabels bool `json:"consistentLabels,omitempty"`
+	// The /mutate path copies the missing required labels from the namespace labels
+	FillFromNamespace bool `json:"fillFromNamespace,omitempty"`
+}
+
+// JobPolicy constrains the job fields added after batch/v1 Jobs of Kubernetes 1.20
+type JobPolicy struct {
+	AllowSuspend          bool `json:"allowSuspend,omitempty"`
+	AllowPodFailurePolicy bool `json:"allowPodFailurePolicy,omitempty"`
+	AllowSuccessPolicy    bool `json:"allowSuccessPolicy,omitempty"`
+	// Maximum completions of Indexed jobs, 0 forbids the Indexed completion mode
+	MaxIndexedCompletions int32 `json:"maxIndexedCompletions,omitempty"`
+	// Maximum parallelism of Indexed jobs, defaults to 1
+	MaxIndexedParallelism int32 `json:"maxIndexedParallelism,omitempty"`
+	// Maximum backoffLimitPerIndex, 0 forbids retrying indexes
+	MaxBackoffLimitPerIndex int32 `json:"maxBackoffLimitPerIndex,omitempty"`
+	// Maximum maxFailedIndexes, required when backoffLimitPerIndex is set
+	MaxFailedIndexes int32 `json:"maxFailedIndexes,omitempty"`
+	// Allowed podReplacementPolicy values, defaults to TerminatingOrFailed and Failed
+	PodReplacementPolicies []string `json:"podReplacementPolicies,omitempty"`
+	// Allowed managedBy values, defaults to the built-in job controller
+	ManagedBy []string `json:"managedBy,omitempty"`
+}
+
+// SecretScan configures the detection of credentials hard-coded in the job
+type SecretScan struct {
+	// One of off, warn or deny
+	Mode string `json:"mode,omitempty"`
+	// Glob patterns of env names whose values are not scanned
+	AllowEnvNames []string `json:"allowEnvNames,omitempty"`
+	// Strings of at least MinLength characters with MinEntropy bits per character
+	// are reported, a MinEntropy of 0 disables the check
+	MinEntropy float64 `json:"minEntropy,omitempty"`
+	MinLength  int     `json:"minLength,omitempty"`
+}
+
+func defaultProfile() Profile {
+	return Profile{
+		Env: EnvPolicy{
+			DeniedNames: []string{"LD_*", "HTTP_PROXY", "HTTPS_PROXY", "FTP_PROXY", "ALL_PROXY", "NO_PROXY"},
+		},
+		Sysctls: SysctlPolicy{
+			Allowed: append([]string{}, safeSysctls...),
+		},
+		ServiceAccounts: ServiceAccountPolicy{
+			Allowed: []string{defaultServiceAccount},
+		},
+		Placement: PlacementPolicy{
+			Tolerations: []TolerationRule{
+				{Key: v1.TaintNodeNotReady, Effect: v1.TaintEffectNoExecute},
+				{Key: v1.TaintNodeUnreachable, Effect: v1.TaintEffectNoExecute},
+			},
+		},
+		Pod: PodPolicy{
+			DNSPolicies: []string{string(v1.DNSClusterFirst)},
+			OS:          []string{string(v1.Linux)},
+		},
+		Limits: LimitsPolicy{
+			MaxTerminationGracePeriodSeconds: 30,
+		},
+		Job: JobPolicy{
+			MaxIndexedParallelism:  1,
+			PodReplacementPolicies: []string{string(batchv1.TerminatingOrFailed), string(batchv1.Failed)},
+			ManagedBy:              []string{batchv1.JobControllerName},
+		},
+		SecretScan: SecretScan{
+			Mode:       ScanWarn,
+			MinEntropy: 4.5,
+			MinLength:  32,
+		},
+	}
+}
+
+// UnmarshalJSON fills the fields not present in the policy file with the defaults
+func (profile *Profile) UnmarshalJSON(data []byte) error {
+	type plain Profile
+	*profile = defaultProfile()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode((*plain)(profile))
+}
+
+// LoadPolicy reads a policy in YAML or JSON format
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("error parsing policy %v: %v", file, err)
+	}
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %v: %v", file, err)
+	}
+	return policy, nil
+}
+
+func (policy *Policy) validate() error {
+	if policy.DefaultProfile != "" && policy.Profiles[policy.DefaultProfile] == nil {
+		return fmt.Errorf("defaultProfile %v is not defined", policy.DefaultProfile)
+	}
+	for namespace, name := range policy.Namespaces {
+		if policy.Profiles[name] == nil {
+			return fmt.Errorf("profile %v of namespace %v is not defined", name, namespace)
+		}
+	}
+	for i := range policy.Workloads {
+		workload := &policy.Workloads[i]
+		// apps/v1 kinds default to their pod template
+		if len(workload.PodSpecPaths) == 0 && len(workload.PodTemplatePaths) == 0 && workload.isAppsWorkload() {
+			workload.PodTemplatePaths = append([]string{}, appsTemplatePaths...)
+		}
+		if err := workload.validate(); err != nil {
+			return err
+		}
+	}
+	rules, err := policy.CEL.compile(policy.Workloads)
+	if err != nil {
+		return err
+	}
+	regoRule, err := policy.Rego.compile()
+	if err != nil {
+		return err
+	}
+	if regoRule != nil {
+		rules = append(rules, regoRule)
+	}
+	wasmRules, err := policy.WASM.compile()
+	if err != nil {
+		return err
+	}
+	rules = append(rules, wasmRules...)
+	externalRules, err := compileExternal(policy.External)
+	if err != nil {
+		return err
+	}
+	rules = append(rules, externalRules...)
+	policy.rules = rules
+	for name, profile := range policy.Profiles {
+		if profile == nil {
+			return fmt.Errorf("profile %v is empty", name)
+		}
+		for _, ref := range append(profile.Env.Secrets, profile.Env.ConfigMaps...) {
+			if err := ref.validate(); err != nil {
+				return fmt.Errorf("profile %v: %v", name, err)
+			}
+		}
+		for _, pattern := range append(profile.Env.AllowedNames, profile.Env.DeniedNames...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("profile %v: invalid env name pattern %v: %v", name, pattern, err)
+			}
+		}
+		if err := profile.Sysctls.compile(); err != nil {
+			return fmt.Errorf("profile %v: %v", name, err)
+		}
+		if profile.Priority.Default != "" && !contains(profile.Priority.Allowed, profile.Priority.Default) {
+			return fmt.Errorf("profile %v: default priority class %v is not allowed", name, profile.Priority.Default)
+		}
+		if profile.Limits.MaxContainers < 0 || profile.Limits.MaxInitContainers < 0 || profile.Limits.MaxTerminationGracePeriodSeconds < 0 {
+			return fmt.Errorf("profile %v: limits must not be negative", name)
+		}
+		if err := profile.SecretScan.validate(); err != nil {
+			return fmt.Errorf("profile %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (scan *SecretScan) validate() error {
+	if scan.Mode != ScanOff && scan.Mode != ScanWarn && scan.Mode != ScanDeny {
+		return fmt.Errorf("secretScan mode must be one of %v, %v or %v", ScanOff, ScanWarn, ScanDeny)
+	}
+	for _, pattern := range scan.AllowEnvNames {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid env name pattern %v: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Profile returns the profile of the namespace, nil if none applies
+func (policy *Policy) Profile(namespace string) *Profile {
+	if name, ok := policy.Namespaces[namespace]; ok {
+		return policy.Profiles[name]
+	}
+	return policy.Profiles[policy.DefaultProfile]
+}
+
+// ClusterLookups lists the objects that the profiles of a policy read from the cluster, only their
+// informers are started and granted
+type ClusterLookups struct {
+	// Env allowlists match secrets or config maps by their labels
+	Secrets, ConfigMaps bool
+	// Token automount is inherited from the service account
+	ServiceAccounts bool
+	// Tolerations are read from the runtime class
+	RuntimeClasses bool
+	// Priority values or preemption are limited
+	PriorityClasses bool
+}
+
+// lookups returns the cluster lookups needed by the profiles, the built-in profile needs none
+func (policy *Policy) lookups() ClusterLookups {
+	lookups := ClusterLookups{}
+	if policy == nil {
+		return lookups
+	}
+	hasSelector := func(refs []ObjectRef) bool {
+		for _, ref := range refs {
+			if ref.Selector != nil {
+				return true
+			}
+		}
+		return false
+	}
+	for _, profile := range policy.Profiles {
+		if profile != nil {
+			lookups.Secrets = lookups.Secrets || hasSelector(profile.Env.Secrets)
+			lookups.ConfigMaps = lookups.ConfigMaps || hasSelector(profile.Env.ConfigMaps)
+			lookups.ServiceAccounts = lookups.ServiceAccounts || profile.ServiceAccounts.ForbidTokenAutomount
+			lookups.RuntimeClasses = lookups.RuntimeClasses || profile.Placement.FromRuntimeClass
+			lookups.PriorityClasses = lookups.PriorityClasses || profile.Priority.MaxValue != nil || profile.Priority.ForbidPreemption
+		}
+	}
+	return lookups
+}
+
+func (ref *ObjectRef) validate() error {
+	if ref.Name == "" && ref.Selector == nil {
+		return fmt.Errorf("env references must define a name or a selector")
+	}
+	if _, err := path.Match(ref.Name, ""); err != nil {
+		return fmt.Errorf("invalid name pattern %v: %v", ref.Name, err)
+	}
+	for _, key := range ref.Keys {
+		if _, err := path.Match(key, ""); err != nil {
+			return fmt.Errorf("invalid key pattern %v: %v", key, err)
+		}
+	}
+	if ref.Selector != nil {
+		if _, err := k8meta.LabelSelectorAsSelector(ref.Selector); err != nil {
+			return fmt.Errorf("invalid selector: %v", err)
+		}
+	}
+	return nil
+}
+
+// matchName returns if the name pattern matches, a ref without name matches every object
+func (ref *ObjectRef) matchName(name string) bool {
+	if ref.Name == "" {
+		return true
+	}
+	matched, _ := path.Match(ref.Name, name)
+	return matched
+}
+
+func (ref *ObjectRef) matchLabels(set map[string]string) bool {
+	if ref.Selector == nil {
+		return true
+	}
+	selector, err := k8meta.LabelSelectorAsSelector(ref.Selector)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(set))
+}
+
+// matchKey returns if the key can be referenced, an empty key means the whole object
+func (ref *ObjectRef) matchKey(key string) bool {
+	if len(ref.Keys) == 0 {
+		return true
+	}
+	if key == "" {
+		return false
+	}
+	for _, pattern := range ref.Keys {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys returns the keys of the map in order, so the output built from it is deterministic
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func writePolicy(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadPolicy(t *testing.T) {
+	policy, err := LoadPolicy(writePolicy(t, `
+defaultProfile: sandbox
+namespaces:
+  ci: trusted
+profiles:
+  sandbox: {}
+  trusted:
+    runtimeClass: runc
+    env:
+      secrets:
+      - name: ci-*
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := AdmissionHandler{RuntimeClass: "gvisor", Policy: policy}
+	if profile := handler.profile("default"); profile.RuntimeClass != "gvisor" {
+		t.Errorf("Default profile must use the runtimeClass flag, got %v", profile.RuntimeClass)
+	}
+	if profile := handler.profile("ci"); profile.RuntimeClass != "runc" || len(profile.Env.Secrets) != 1 {
+		t.Errorf("Namespace ci must use the trusted profile, got %+v", profile)
+	}
+	if lookups := policy.lookups(); lookups != (ClusterLookups{}) {
+		t.Errorf("References by name must not need lookups, got %+v", lookups)
+	}
+	policy.Profiles["trusted"].Env.ConfigMaps = []ObjectRef{{Selector: &k8meta.LabelSelector{MatchLabels: map[string]string{"env": "ci"}}}}
+	policy.Profiles["sandbox"].Priority.ForbidPreemption = true
+	if lookups := policy.lookups(); lookups != (ClusterLookups{ConfigMaps: true, PriorityClasses: true}) {
+		t.Errorf("References by selector must look up config maps and preemption priority classes, got %+v", lookups)
+	}
+}
+
+func TestInvalidPolicy(t *testing.T) {
+	policies := map[string]string{
+		"unknownField":   "profiles: {default: {unknown: true}}",
+		"missingDefault": "defaultProfile: missing",
+		"missingProfile": "namespaces: {ci: missing}",
+		"emptyRef":       "profiles: {default: {env: {secrets: [{keys: [token]}]}}}",
+		"badPattern":     "profiles: {default: {env: {configMaps: [{name: '['}]}}}",
+	}
+
+	for key, val := range policies {
+		if _, err := LoadPolicy(writePolicy(t, val)); err == nil {
+			t.Errorf("Invalid policy `%v` was loaded", key)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	schedulingv1 "k8s.io/api/scheduling/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// checkPriority requires an allowed priority class, below the maximum value of the profile and
+// that doesn't preempt other pods when the profile forbids it. path is the path of the spec
+func checkPriority(spec *v1.PodSpec, path *field.Path, profile *Profile, cluster *Cluster) error {
+	policy := &profile.Priority
+	if spec.PriorityClassName != "" && !contains(policy.Allowed, spec.PriorityClassName) {
+		return field.Forbidden(path.Child("priorityClassName"), fmt.Sprintf("priorityClassName %v is not allowed", spec.PriorityClassName))
+	}
+	if policy.MaxValue == nil && !policy.ForbidPreemption {
+		return nil
+	}
+
+	class, err := cluster.PriorityClass(spec.PriorityClassName)
+	if err != nil {
+		return field.Forbidden(path.Child("priorityClassName"), fmt.Sprintf("can't read priorityClass %v: %v", spec.PriorityClassName, err))
+	}
+
+	if policy.MaxValue != nil {
+		value := int32(0)
+		if class != nil {
+			value = class.Value
+		}
+		if spec.Priority != nil && *spec.Priority > value {
+			value = *spec.Priority
+		}
+		if value > *policy.MaxValue {
+			return field.Forbidden(path.Child("priorityClassName"), fmt.Sprintf("priority %v is greater than the maximum %v", value, *policy.MaxValue))
+		}
+	}
+
+	if policy.ForbidPreemption {
+		// The priority admission plugin fills preemptionPolicy from the class, and rejects pods that set a different value
+		preemption := v1.PreemptLowerPriority
+		if spec.PreemptionPolicy != nil {
+			preemption = *spec.PreemptionPolicy
+		} else if class != nil && class.PreemptionPolicy != nil {
+			preemption = *class.PreemptionPolicy
+		}
+		if preemption != v1.PreemptNever {
+			return field.Forbidden(path.Child("preemptionPolicy"), fmt.Sprintf("preemptionPolicy %v is not allowed, use a priorityClass with preemptionPolicy Never", preemption))
+		}
+	}
+	return nil
+}
+
+// globalDefaultPriorityClass returns the class used by pods without priorityClassName, nil if none
+func globalDefaultPriorityClass(classes []*schedulingv1.PriorityClass) *schedulingv1.PriorityClass {
+	var result *schedulingv1.PriorityClass
+	for _, class := range classes {
+		// Same as the priority admission plugin, the lowest value wins if several are marked as default
+		if class.GlobalDefault && (result == nil || class.Value < result.Value) {
+			result = class
+		}
+	}
+	return result
+}
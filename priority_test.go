@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	schedulingv1 "k8s.io/api/scheduling/v1"
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	schedulinglisters "k8s.io/client-go/listers/scheduling/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func priorityCluster(t *testing.T, classes ...*schedulingv1.PriorityClass) *Cluster {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, class := range classes {
+		if err := indexer.Add(class); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Cluster{PriorityClasses: schedulinglisters.NewPriorityClassLister(indexer)}
+}
+
+func priorityClass(name string, value int32, preemption v1.PreemptionPolicy, globalDefault bool) *schedulingv1.PriorityClass {
+	return &schedulingv1.PriorityClass{ObjectMeta: k8meta.ObjectMeta{Name: name}, Value: value, PreemptionPolicy: &preemption, GlobalDefault: globalDefault}
+}
+
+func TestPriority(t *testing.T) {
+	cluster := priorityCluster(t,
+		priorityClass("batch-low", 100, v1.PreemptNever, false),
+		priorityClass("batch-high", 5000, v1.PreemptNever, false),
+		priorityClass("batch-preempt", 100, v1.PreemptLowerPriority, false),
+		priorityClass("system-cluster-critical", 2000000000, v1.PreemptLowerPriority, false),
+	)
+	maxValue := int32(1000)
+	never := v1.PreemptNever
+
+	cases := map[string]struct {
+		spec    v1.PodSpec
+		allowed bool
+		// Extra classes allowed by the profile
+		allowedClasses []string
+	}{
+		"allowed":        {spec: v1.PodSpec{PriorityClassName: "batch-low"}, allowed: true},
+		"notAllowed":     {spec: v1.PodSpec{PriorityClassName: "system-cluster-critical"}, allowed: false},
+		"aboveMax":       {spec: v1.PodSpec{PriorityClassName: "batch-high"}, allowed: false},
+		"preempts":       {spec: v1.PodSpec{PriorityClassName: "batch-preempt"}, allowed: false},
+		"noClass":        {spec: v1.PodSpec{}, allowed: false},
+		"noClassNever":   {spec: v1.PodSpec{PreemptionPolicy: &never}, allowed: true},
+		"missingInCache": {spec: v1.PodSpec{PriorityClassName: "batch-missing"}, allowed: false, allowedClasses: []string{"batch-missing"}},
+	}
+
+	for key, val := range cases {
+		profile := defaultProfile()
+		profile.Priority = PriorityPolicy{Allowed: append([]string{"batch-low", "batch-high", "batch-preempt"}, val.allowedClasses...), ForbidPreemption: true, MaxValue: &maxValue}
+		err := checkPriority(&val.spec, field.NewPath("spec"), &profile, cluster)
+		if val.allowed && err != nil {
+			t.Errorf("Valid priority `%v` was denied: %v", key, err)
+		}
+		if !val.allowed && err == nil {
+			t.Errorf("Invalid priority `%v` was allowed", key)
+		}
+	}
+}
+
+func TestGlobalDefaultPriority(t *testing.T) {
+	maxValue := int32(1000)
+	profile := defaultProfile()
+	profile.Priority.MaxValue = &maxValue
+
+	cluster := priorityCluster(t, priorityClass("default-high", 2000, v1.PreemptNever, true))
+	if err := checkPriority(&v1.PodSpec{}, field.NewPath("spec"), &profile, cluster); err == nil {
+		t.Errorf("Global default class above the maximum was allowed")
+	}
+	if err := checkPriority(&v1.PodSpec{}, field.NewPath("spec"), &profile, priorityCluster(t)); err != nil {
+		t.Errorf("Pod without priority class was denied: %v", err)
+	}
+	if err := checkPriority(&v1.PodSpec{}, field.NewPath("spec"), &profile, nil); err == nil {
+		t.Errorf("Maximum priority was allowed without cluster lookups")
+	}
+}
+
+func TestDefaultPriorityPatch(t *testing.T) {
+	profile := defaultProfile()
+	profile.Priority = PriorityPolicy{Allowed: []string{"batch-low"}, Default: "batch-low"}
+	review := loadValidJob(t)
+	job := loadJob(t, review)
+
+	patches := mutateJob(job, &profile, nil)
+	if len(patches) != 1 || patches[0].Path != "/spec/template/spec/priorityClassName" || patches[0].Value != "batch-low" {
+		t.Fatalf("Expected the default priority class patch, got %v", patches)
+	}
+
+	job.Spec.Template.Spec.PriorityClassName = "batch-low"
+	if patches = mutateJob(job, &profile, nil); len(patches) != 0 {
+		t.Fatalf("Priority class already set must not be patched, got %v", patches)
+	}
+}
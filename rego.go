@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/open-policy-agent/opa/v1/ast"
+	"github.com/open-policy-agent/opa/v1/rego"
+)
+
+// Defaults of the Rego backend
+const (
+	defaultRegoPackage = "kubernetes.admission"
+	defaultRegoTimeout = time.Second
+)
+
+// RegoPolicy loads Rego modules evaluated with the embedded OPA library, once per request.
+// The rules deny[msg], violation[{"msg": msg, "field": field}] and warn[msg] of the package
+// are merged with the results of the built-in rules.
+type RegoPolicy struct {
+	// Directory with the .rego modules, loaded recursively. Empty disables the backend
+	Directory string `json:"directory,omitempty"`
+	// Package of the rules, defaults to kubernetes.admission
+	Package string `json:"package,omitempty"`
+	// Maximum duration of an evaluation, defaults to 1s
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// regoRule is the Rule of the prepared Rego query
+type regoRule struct {
+	pkg     string
+	query   rego.PreparedEvalQuery
+	timeout time.Duration
+}
+
+// compile loads and compiles the modules, nil when the backend is disabled
+func (policy *RegoPolicy) compile() (Rule, error) {
+	if policy.Directory == "" {
+		return nil, nil
+	}
+	pkg := policy.Package
+	if pkg == "" {
+		pkg = defaultRegoPackage
+	}
+	if _, err := ast.ParseRef("data." + pkg); err != nil {
+		return nil, fmt.Errorf("invalid rego package %v", pkg)
+	}
+	timeout := defaultRegoTimeout
+	if policy.Timeout != "" {
+		parsed, err := time.ParseDuration(policy.Timeout)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid rego timeout %v", policy.Timeout)
+		}
+		timeout = parsed
+	}
+
+	modules, err := loadRegoModules(policy.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("error loading rego modules from %v: %v", policy.Directory, err)
+	}
+	options := []func(*rego.Rego){rego.Query("data." + pkg), rego.StrictBuiltinErrors(true)}
+	for _, module := range modules {
+		options = append(options, rego.ParsedModule(module))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	query, err := rego.New(options...).PrepareForEval(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error loading rego modules from %v: %v", policy.Directory, err)
+	}
+	return &regoRule{pkg: pkg, query: query, timeout: timeout}, nil
+}
+
+// loadRegoModules parses the .rego files of the directory, data files are ignored. Modules that
+// aren't valid in the OPA 1.0 syntax are parsed with the previous one, e.g. deny[msg] { ... }
+func loadRegoModules(directory string) ([]*ast.Module, error) {
+	modules := []*ast.Module{}
+	err := filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || filepath.Ext(path) != ".rego" {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		module, err := ast.ParseModuleWithOpts(path, string(data), ast.ParserOptions{RegoVersion: ast.RegoV1})
+		if err != nil {
+			// The error of the current syntax is reported when both fail
+			v0Module, v0Err := ast.ParseModuleWithOpts(path, string(data), ast.ParserOptions{RegoVersion: ast.RegoV0})
+			if v0Err != nil {
+				return err
+			}
+			module = v0Module
+		}
+		modules = append(modules, module)
+		return nil
+	})
+	return modules, err
+}
+
+func (rule *regoRule) ID() string          { return "rego." + strings.ReplaceAll(rule.pkg, ".", "_") }
+func (rule *regoRule) Description() string { return "Rego rules of data." + rule.pkg }
+func (rule *regoRule) Severity() Severity  { return SeverityDeny }
+
+// Evaluate queries the package with the AdmissionReview as input, errors and timeouts deny the request
+func (rule *regoRule) Evaluate(ctx context.Context, object *Object, profile *Profile) []Violation {
+	if object.Request == nil {
+		return nil
+	}
+	input, err := admissionReviewInput(ctx, object)
+	if err != nil {
+		return []Violation{{Message: fmt.Sprintf("rego: %v", err)}}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rule.timeout)
+	defer cancel()
+	results, err := rule.query.Eval(ctx, rego.EvalInput(input))
+	if err != nil {
+		return []Violation{{Message: fmt.Sprintf("rego evaluation failed: %v", err)}}
+	}
+	if len(results) == 0 || len(results[0].Expressions) == 0 {
+		return nil
+	}
+	document, ok := results[0].Expressions[0].Value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	result := []Violation{}
+	for _, message := range regoSet(document["deny"]) {
+		result = append(result, Violation{Message: regoMessage(message)})
+	}
+	for _, value := range regoSet(document["violation"]) {
+		violation := Violation{Message: regoMessage(value)}
+		if values, ok := value.(map[string]interface{}); ok {
+			violation.Field, _ = values["field"].(string)
+		}
+		result = append(result, violation)
+	}
+	// Warnings go last so the first violation is always a denial
+	for _, message := range regoSet(document["warn"]) {
+		result = append(result, Violation{Message: regoMessage(message), Severity: SeverityWarn})
+	}
+	return result
+}
+
+// admissionReviewInput returns the AdmissionReview of the request, the input of the queries, with
+// the apiVersion of the review received by the webhook
+func admissionReviewInput(ctx context.Context, object *Object) (map[string]interface{}, error) {
+	data, err := json.Marshal(object.Request)
+	if err != nil {
+		return nil, err
+	}
+	var request interface{}
+	if err := json.Unmarshal(data, &request); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"apiVersion": reviewAPIVersion(ctx),
+		"kind":       "AdmissionReview",
+		"request":    request,
+	}, nil
+}
+
+// regoSet returns the sorted items of a set, sets are decoded as arrays in any order
+func regoSet(value interface{}) []interface{} {
+	items, _ := value.([]interface{})
+	sort.SliceStable(items, func(i, j int) bool {
+		return regoMessage(items[i]) < regoMessage(items[j])
+	})
+	return items
+}
+
+func regoMessage(value interface{}) string {
+	if message, ok := value.(string); ok {
+		return message
+	}
+	if values, ok := value.(map[string]interface{}); ok {
+		if message, ok := values["msg"].(string); ok {
+			return message
+		}
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
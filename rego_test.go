@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func regoHandler(t *testing.T, modules map[string]string, settings string) (*AdmissionHandler, error) {
+	directory := t.TempDir()
+	for name, module := range modules {
+		if err := os.WriteFile(filepath.Join(directory, name), []byte(module), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy := &Policy{Rego: RegoPolicy{Directory: directory}}
+	for _, setting := range strings.Split(settings, ",") {
+		switch {
+		case strings.HasPrefix(setting, "timeout="):
+			policy.Rego.Timeout = strings.TrimPrefix(setting, "timeout=")
+		}
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return &AdmissionHandler{RuntimeClass: "gvisor", Policy: policy}, nil
+}
+
+func TestRegoRules(t *testing.T) {
+	handler, err := regoHandler(t, map[string]string{
+		"deny.rego": `package kubernetes.admission
+
+deny contains msg if {
+	input.request.object.metadata.labels.team == "blocked"
+	msg := "team blocked can't run jobs"
+}
+
+violation contains {"msg": msg, "field": "spec.template.spec.containers[0].image"} if {
+	image := input.request.object.spec.template.spec.containers[0].image
+	not startswith(image, "registry.internal/")
+	msg := sprintf("image %v is not from registry.internal", [image])
+}
+
+warn contains "job without owner" if {
+	not input.request.object.metadata.labels.owner
+}
+`,
+		"data.json": `{"ignored": true}`,
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	review := loadValidJob(t)
+	allowed, _, err := checkRequest(context.Background(), review.Request, handler)
+	if allowed || err.Error() != "spec.template.spec.containers[0].image: image busybox is not from registry.internal" {
+		t.Fatalf("Violation must deny with its field, got %v", err)
+	}
+
+	job := loadJob(t, review)
+	job.Spec.Template.Spec.Containers[0].Image = "registry.internal/busybox"
+	saveJob(t, review, job)
+	allowed, warnings, err := checkRequest(context.Background(), review.Request, handler)
+	if !allowed || len(warnings) != 1 || warnings[0] != "job without owner" {
+		t.Fatalf("Job must be allowed with the rego warning, got %v %v", warnings, err)
+	}
+
+	job.Labels = map[string]string{"team": "blocked", "owner": "ml"}
+	saveJob(t, review, job)
+	if allowed, _, err = checkRequest(context.Background(), review.Request, handler); allowed || err.Error() != "team blocked can't run jobs" {
+		t.Fatalf("Deny rule must deny, got %v", err)
+	}
+
+	job.Spec.Template.Spec.HostPID = true
+	saveJob(t, review, job)
+	if allowed, _, err = checkRequest(context.Background(), review.Request, handler); allowed || err.Error() != "spec.template.spec.hostPID: Forbidden: HostPID must be false" {
+		t.Fatalf("Built-in rules must run before rego, got %v", err)
+	}
+}
+
+func TestRegoV0Syntax(t *testing.T) {
+	handler, err := regoHandler(t, map[string]string{
+		// The queries of the feature request, in the syntax before OPA 1.0
+		"v0.rego": `package kubernetes.admission
+
+deny[msg] {
+	input.request.object.metadata.labels.team == "blocked"
+	msg := "team blocked can't run jobs"
+}
+
+violation[{"msg": msg, "field": "metadata.namespace"}] {
+	input.request.namespace == "default"
+	msg := "default namespace is not allowed"
+}
+`,
+		"v1.rego": `package kubernetes.admission
+
+warn contains "job without owner" if {
+	not input.request.object.metadata.labels.owner
+}
+`,
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	review := loadValidJob(t)
+	allowed, _, err := checkRequest(context.Background(), review.Request, handler)
+	if allowed || err.Error() != "metadata.namespace: default namespace is not allowed" {
+		t.Fatalf("v0 violation rule must deny, got %v", err)
+	}
+
+	job := loadJob(t, review)
+	job.Namespace = "ci"
+	job.Labels = map[string]string{"team": "blocked"}
+	review.Request.Namespace = "ci"
+	saveJob(t, review, job)
+	if allowed, _, err = checkRequest(context.Background(), review.Request, handler); allowed || err.Error() != "team blocked can't run jobs" {
+		t.Fatalf("v0 deny rule must deny, got %v", err)
+	}
+}
+
+func TestRegoFailures(t *testing.T) {
+	for _, module := range []string{"package kubernetes.admission\ndeny contains", "package kubernetes.admission\ndeny[msg] {"} {
+		if _, err := regoHandler(t, map[string]string{"invalid.rego": module}, ""); err == nil {
+			t.Fatalf("Invalid module `%v` was loaded", module)
+		}
+	}
+
+	handler, err := regoHandler(t, map[string]string{"slow.rego": `package kubernetes.admission
+
+deny contains "slow" if {
+	count([x | some i in numbers.range(1, 10000000); x := i * 2]) < 0
+}
+`}, "timeout=10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed, _, err := checkRequest(context.Background(), loadValidJob(t).Request, handler); allowed || !strings.Contains(err.Error(), "rego evaluation failed") {
+		t.Fatalf("Evaluation over the timeout must deny, got %v", err)
+	}
+}
+
+func TestRegoReviewVersion(t *testing.T) {
+	handler, err := regoHandler(t, map[string]string{"version.rego": `package kubernetes.admission
+
+deny contains sprintf("apiVersion %v", [input.apiVersion]) if {
+	input.apiVersion != "admission.k8s.io/v1"
+}
+`}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{"admission.k8s.io/v1", "admission.k8s.io/v1beta1"} {
+		review := loadValidJob(t)
+		review.APIVersion = version
+		body, err := json.Marshal(review)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler.handler(rr, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+		response := struct{ Response struct{ Allowed bool } }{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Response.Allowed != (version == "admission.k8s.io/v1") {
+			t.Errorf("Input must use the apiVersion %v of the review, allowed %v", version, response.Response.Allowed)
+		}
+	}
+}
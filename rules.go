@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	admission "k8s.io/api/admission/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Severity of the violations of a rule
+type Severity string
+
+const (
+	// SeverityDeny violations deny the request
+	SeverityDeny Severity = "deny"
+	// SeverityWarn violations are returned as warnings to the user
+	SeverityWarn Severity = "warn"
+)
+
+// Object is what the rules evaluate, a pod spec with the job it belongs to
+type Object struct {
+	// Nil for the pod templates of other workloads
+	Job       *batchv1.Job
+	PodSpec   *v1.PodSpec
+	SpecPath  *field.Path
+	Namespace string
+	// Nil when the cluster lookups are disabled
+	Cluster *Cluster
+	// Request being admitted, only set for the rules evaluated once per request
+	Request *admission.AdmissionRequest
+
+	// Variables of the CEL expressions and WASM modules, decoded on first use
+	variables map[string]interface{}
+}
+
+// Violation is a constraint of a rule that the object doesn't meet
+type Violation struct {
+	// Path of the field, empty when the violation is about the whole object
+	Field   string
+	Message string
+	// Overrides the severity of the rule when set
+	Severity Severity
+}
+
+func (violation Violation) Error() string {
+	if violation.Field == "" {
+		return violation.Message
+	}
+	return fmt.Sprintf("%v: %v", violation.Field, violation.Message)
+}
+
+// Rule is a check run against every job and workload pod spec. The ID is
+// <group>.<name>, the group is used by the ruleGroups of the workloads.
+type Rule interface {
+	ID() string
+	Description() string
+	Severity() Severity
+	Evaluate(ctx context.Context, object *Object, profile *Profile) []Violation
+}
+
+// Registered rules, evaluated in registration order
+var registry []Rule
+
+// RegisterRule adds a rule to the registry, custom rules register from an init function.
+// It panics when the ID is invalid or already registered.
+func RegisterRule(rule Rule) {
+	id := rule.ID()
+	if dot := strings.Index(id, "."); dot <= 0 || dot == len(id)-1 {
+		panic(fmt.Sprintf("rule ID %v must be <group>.<name>", id))
+	}
+	for _, registered := range registry {
+		if registered.ID() == id {
+			panic(fmt.Sprintf("rule %v is already registered", id))
+		}
+	}
+	registry = append(registry, rule)
+}
+
+// Rules returns the registered rules
+func Rules() []Rule {
+	return append([]Rule{}, registry...)
+}
+
+// ruleGroup returns the group of the rule, the prefix of its ID
+func ruleGroup(rule Rule) string {
+	return strings.SplitN(rule.ID(), ".", 2)[0]
+}
+
+// registeredGroups returns the sorted groups of the registered rules
+func registeredGroups() []string {
+	groups := []string{}
+	for _, rule := range registry {
+		if group := ruleGroup(rule); !contains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// evaluateRules runs the rules of the groups, every rule when empty. It returns the first
+// denial and the warnings of the rules evaluated before it.
+func evaluateRules(ctx context.Context, rules []Rule, object *Object, profile *Profile, groups []string) (bool, []string, error) {
+	warnings := []string{}
+	for _, rule := range rules {
+		if len(groups) > 0 && !contains(groups, ruleGroup(rule)) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return false, nil, fmt.Errorf("evaluation of the rules was interrupted: %v", err)
+		}
+		for _, violation := range rule.Evaluate(ctx, object, profile) {
+			severity := violation.Severity
+			if severity == "" {
+				severity = rule.Severity()
+			}
+			if severity == SeverityWarn {
+				warnings = append(warnings, violation.Error())
+				continue
+			}
+			return false, nil, violation
+		}
+	}
+	if len(warnings) == 0 {
+		return true, nil, nil
+	}
+	return true, warnings, nil
+}
+
+// ruleFunc is a Rule implemented by a function
+type ruleFunc struct {
+	id          string
+	description string
+	severity    Severity
+	evaluate    func(ctx context.Context, object *Object, profile *Profile) []Violation
+}
+
+// NewRule returns a rule evaluated by the function
+func NewRule(id, description string, severity Severity, evaluate func(ctx context.Context, object *Object, profile *Profile) []Violation) Rule {
+	return &ruleFunc{id: id, description: description, severity: severity, evaluate: evaluate}
+}
+
+func (rule *ruleFunc) ID() string          { return rule.id }
+func (rule *ruleFunc) Description() string { return rule.description }
+func (rule *ruleFunc) Severity() Severity  { return rule.severity }
+
+func (rule *ruleFunc) Evaluate(ctx context.Context, object *Object, profile *Profile) []Violation {
+	return rule.evaluate(ctx, object, profile)
+}
+
+// violations converts the error of a check, keeping the path of field errors
+func violations(err error) []Violation {
+	if err == nil {
+		return nil
+	}
+	if fieldErr, ok := err.(*field.Error); ok {
+		return []Violation{{Field: fieldErr.Field, Message: fieldErr.ErrorBody()}}
+	}
+	return []Violation{{Message: err.Error()}}
+}
+
+// violationsDocument is the JSON returned by the WASM modules and the external validators
+type violationsDocument struct {
+	Violations []struct {
+		Message  string   `json:"message"`
+		Field    string   `json:"field,omitempty"`
+		Severity Severity `json:"severity,omitempty"`
+	} `json:"violations"`
+}
+
+// violations returns the violations of the document, denials first
+func (document *violationsDocument) violations() []Violation {
+	denials, warnings := []Violation{}, []Violation{}
+	for _, violation := range document.Violations {
+		if violation.Severity == SeverityWarn {
+			warnings = append(warnings, Violation{Field: violation.Field, Message: violation.Message, Severity: SeverityWarn})
+		} else {
+			denials = append(denials, Violation{Field: violation.Field, Message: violation.Message, Severity: SeverityDeny})
+		}
+	}
+	return append(denials, warnings...)
+}
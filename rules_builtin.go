@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Groups of the built-in rules
+const (
+	GroupJob             = "job"
+	GroupRuntime         = "runtime"
+	GroupHost            = "host"
+	GroupPod             = "pod"
+	GroupLimits          = "limits"
+	GroupCommands        = "commands"
+	GroupSecurityContext = "securityContext"
+	GroupPorts           = "ports"
+	GroupEnv             = "env"
+	GroupVolumes         = "volumes"
+	GroupResources       = "resources"
+	GroupSecrets         = "secrets"
+)
+
+func init() {
+	registerJobRules()
+	registerPodRules()
+	registerContainerRules()
+	RegisterRule(NewRule(GroupSecrets+".scan", "Env values, commands, args and annotations must not contain credentials", SeverityWarn, checkSecretsRule))
+}
+
+// jobRule returns a rule that only applies to jobs
+func jobRule(id, description string, check func(job *batchv1.Job, profile *Profile) error) Rule {
+	return NewRule(id, description, SeverityDeny, func(ctx context.Context, object *Object, profile *Profile) []Violation {
+		if object.Job == nil {
+			return nil
+		}
+		return violations(check(object.Job, profile))
+	})
+}
+
+// podRule returns a rule evaluated once per pod spec
+func podRule(id, description string, check func(object *Object, profile *Profile) error) Rule {
+	return NewRule(id, description, SeverityDeny, func(ctx context.Context, object *Object, profile *Profile) []Violation {
+		return violations(check(object, profile))
+	})
+}
+
+// containerRule returns a rule evaluated for every init container and container
+func containerRule(id, description string, check func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error) Rule {
+	return NewRule(id, description, SeverityDeny, func(ctx context.Context, object *Object, profile *Profile) []Violation {
+		for i := range object.PodSpec.InitContainers {
+			if err := check(&object.PodSpec.InitContainers[i], object.SpecPath.Child("initContainers").Index(i), object, profile); err != nil {
+				return violations(err)
+			}
+		}
+		for i := range object.PodSpec.Containers {
+			if err := check(&object.PodSpec.Containers[i], object.SpecPath.Child("containers").Index(i), object, profile); err != nil {
+				return violations(err)
+			}
+		}
+		return nil
+	})
+}
+
+func registerJobRules() {
+	RegisterRule(jobRule(GroupJob+".metadata", "Labels and annotations of the job must follow the metadata rules", checkMetadata))
+	RegisterRule(jobRule(GroupJob+".activeDeadline", "Jobs must set activeDeadlineSeconds", func(job *batchv1.Job, profile *Profile) error {
+		if job.Spec.ActiveDeadlineSeconds == nil || *job.Spec.ActiveDeadlineSeconds == 0 {
+			return field.Required(field.NewPath("spec", "activeDeadlineSeconds"), "activeDeadlineSeconds must be set")
+		}
+		return nil
+	}))
+	RegisterRule(jobRule(GroupJob+".spec", "Retries, parallelism and controller fields of the job must be within the limits", func(job *batchv1.Job, profile *Profile) error {
+		return checkJobSpec(&job.Spec, profile)
+	}))
+	// TTLSecondsAfterFinished is an alpha feature, and must be enabled manually
+	RegisterRule(jobRule(GroupJob+".restartPolicy", "Pods of the job must not restart", func(job *batchv1.Job, profile *Profile) error {
+		if job.Spec.Template.Spec.RestartPolicy != "Never" {
+			return field.Forbidden(field.NewPath("spec", "template", "spec", "restartPolicy"), "Job is not allowed to restart")
+		}
+		return nil
+	}))
+}
+
+func registerPodRules() {
+	RegisterRule(podRule(GroupRuntime+".runtimeClass", "Pods must use the RuntimeClass of the profile", func(object *Object, profile *Profile) error {
+		spec := object.PodSpec
+		if spec.RuntimeClassName == nil || *spec.RuntimeClassName != profile.RuntimeClass {
+			runtimeClass := "<nil>"
+			if spec.RuntimeClassName != nil {
+				runtimeClass = *spec.RuntimeClassName
+			}
+			return field.Forbidden(object.SpecPath.Child("runtimeClassName"), fmt.Sprintf("wrong RuntimeClass %v is set, must be %v", runtimeClass, profile.RuntimeClass))
+		}
+		return nil
+	}))
+	RegisterRule(podRule(GroupHost+".network", "Pods must not use the host network", func(object *Object, profile *Profile) error {
+		if object.PodSpec.HostNetwork {
+			return field.Forbidden(object.SpecPath.Child("hostNetwork"), "HostNetwork must not be set")
+		}
+		return nil
+	}))
+	RegisterRule(podRule(GroupHost+".ipc", "Pods must not use the host IPC namespace", func(object *Object, profile *Profile) error {
+		if object.PodSpec.HostIPC {
+			return field.Forbidden(object.SpecPath.Child("hostIPC"), "HostIPC must be false")
+		}
+		return nil
+	}))
+	RegisterRule(podRule(GroupHost+".pid", "Pods must not use the host PID namespace", func(object *Object, profile *Profile) error {
+		if object.PodSpec.HostPID {
+			return field.Forbidden(object.SpecPath.Child("hostPID"), "HostPID must be false")
+		}
+		return nil
+	}))
+	RegisterRule(podRule(GroupPod+".fields", "DNS, host aliases, process namespace and OS of the pod must be allowed by the profile", func(object *Object, profile *Profile) error {
+		return checkPodFields(object.PodSpec, object.SpecPath, profile)
+	}))
+	RegisterRule(podRule(GroupPod+".serviceAccount", "Pods must use an allowed service account without an automounted token", func(object *Object, profile *Profile) error {
+		return checkServiceAccount(object.PodSpec, object.SpecPath, object.Namespace, profile, object.Cluster)
+	}))
+	RegisterRule(podRule(GroupPod+".placement", "Node selectors, affinity and tolerations must be allowed by the profile", func(object *Object, profile *Profile) error {
+		return checkPlacement(object.PodSpec, object.SpecPath, profile, object.Cluster)
+	}))
+	RegisterRule(podRule(GroupPod+".priority", "Pods must use an allowed priority class", func(object *Object, profile *Profile) error {
+		return checkPriority(object.PodSpec, object.SpecPath, profile, object.Cluster)
+	}))
+	RegisterRule(podRule(GroupPod+".sysctls", "Pods must only set the sysctls allowed by the profile", func(object *Object, profile *Profile) error {
+		if object.PodSpec.SecurityContext == nil {
+			return nil
+		}
+		return checkSysctls(object.PodSpec.SecurityContext.Sysctls, object.SpecPath.Child("securityContext", "sysctls"), profile)
+	}))
+	RegisterRule(podRule(GroupLimits+".containers", "Pods must not define more containers than the limit", func(object *Object, profile *Profile) error {
+		if profile.Limits.MaxContainers > 0 && len(object.PodSpec.Containers) > profile.Limits.MaxContainers {
+			return field.TooMany(object.SpecPath.Child("containers"), len(object.PodSpec.Containers), profile.Limits.MaxContainers)
+		}
+		return nil
+	}))
+	RegisterRule(podRule(GroupLimits+".initContainers", "Pods must not define more init containers than the limit", func(object *Object, profile *Profile) error {
+		if profile.Limits.MaxInitContainers > 0 && len(object.PodSpec.InitContainers) > profile.Limits.MaxInitContainers {
+			return field.TooMany(object.SpecPath.Child("initContainers"), len(object.PodSpec.InitContainers), profile.Limits.MaxInitContainers)
+		}
+		return nil
+	}))
+	RegisterRule(podRule(GroupLimits+".terminationGracePeriod", "The termination grace period must not exceed the limit", func(object *Object, profile *Profile) error {
+		grace := object.PodSpec.TerminationGracePeriodSeconds
+		if grace != nil && *grace > profile.Limits.MaxTerminationGracePeriodSeconds {
+			return field.Forbidden(object.SpecPath.Child("terminationGracePeriodSeconds"), fmt.Sprintf("terminationGracePeriodSeconds must not be greater than %v", profile.Limits.MaxTerminationGracePeriodSeconds))
+		}
+		return nil
+	}))
+	RegisterRule(podRule(GroupVolumes+".volumes", "Pods must not declare volumes", func(object *Object, profile *Profile) error {
+		if len(object.PodSpec.Volumes) > 0 {
+			return field.Forbidden(object.SpecPath.Child("volumes"), fmt.Sprintf("There are more than one volume declared %v", len(object.PodSpec.Volumes)))
+		}
+		return nil
+	}))
+}
+
+func registerContainerRules() {
+	RegisterRule(containerRule(GroupLimits+".hooks", "Lifecycle hooks and exec probes must be allowed by the profile", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		return checkContainerHooks(container, path, profile)
+	}))
+	RegisterRule(containerRule(GroupCommands+".command", "Env names and commands of the containers must be allowed by the profile", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		return checkContainerCommand(container, path, profile)
+	}))
+	RegisterRule(containerRule(GroupSecurityContext+".required", "Containers must set a securityContext", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		if container.SecurityContext == nil {
+			return field.Required(path.Child("securityContext"), "SecurityContext must be set for the container")
+		}
+		return nil
+	}))
+	RegisterRule(containerRule(GroupSecurityContext+".runAsNonRoot", "Containers must run as non root", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		if securityContext := container.SecurityContext; securityContext != nil && (securityContext.RunAsNonRoot == nil || !*securityContext.RunAsNonRoot) {
+			return field.Required(path.Child("securityContext", "runAsNonRoot"), "RunAsNonRoot must be set per container")
+		}
+		return nil
+	}))
+	RegisterRule(containerRule(GroupSecurityContext+".allowPrivilegeEscalation", "Containers must disable privilege escalation", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		if securityContext := container.SecurityContext; securityContext != nil && (securityContext.AllowPrivilegeEscalation == nil || *securityContext.AllowPrivilegeEscalation) {
+			return field.Required(path.Child("securityContext", "allowPrivilegeEscalation"), "AllowPrivilegeEscalation must be false per container")
+		}
+		return nil
+	}))
+	RegisterRule(containerRule(GroupSecurityContext+".privileged", "Containers must not be privileged", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		if securityContext := container.SecurityContext; securityContext != nil && (securityContext.Privileged == nil || *securityContext.Privileged) {
+			return field.Required(path.Child("securityContext", "privileged"), "Privileged must be false per container")
+		}
+		return nil
+	}))
+	RegisterRule(containerRule(GroupSecurityContext+".capabilities", "Containers must drop every capability not allowed by the profile", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		if container.SecurityContext == nil {
+			return nil
+		}
+		return checkCapabilities(container.SecurityContext.Capabilities, path.Child("securityContext", "capabilities"), profile)
+	}))
+	RegisterRule(containerRule(GroupPorts+".containerPorts", "Containers must not define ports", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		if len(container.Ports) > 0 {
+			return field.Forbidden(path.Child("ports"), "No port must be defined")
+		}
+		return nil
+	}))
+	RegisterRule(containerRule(GroupEnv+".sources", "Env and envFrom must only reference the sources allowed by the profile", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		return checkEnv(container, path, object.Namespace, profile, object.Cluster)
+	}))
+	RegisterRule(containerRule(GroupVolumes+".devices", "Containers must not use volume devices", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		if len(container.VolumeDevices) > 0 {
+			return field.Forbidden(path.Child("volumeDevices"), "VolumeDevices are not supported")
+		}
+		return nil
+	}))
+	RegisterRule(containerRule(GroupVolumes+".mounts", "Containers must not mount volumes", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		if len(container.VolumeMounts) > 0 {
+			return field.Forbidden(path.Child("volumeMounts"), "VolumeMounts are not supported")
+		}
+		return nil
+	}))
+	RegisterRule(containerRule(GroupResources+".cpu", "Containers must set equal cpu requests and limits", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		requests, limits := container.Resources.Requests.Cpu(), container.Resources.Limits.Cpu()
+		if requests.IsZero() || limits.IsZero() {
+			return field.Required(path.Child("resources"), "Container cpu requests and limit must be set")
+		}
+		if !requests.Equal(*limits) {
+			return field.Invalid(path.Child("resources", "requests", "cpu"), requests.String(), "CPU request must be set and equal to limits")
+		}
+		return nil
+	}))
+	RegisterRule(containerRule(GroupResources+".memory", "Containers must set equal memory requests and limits", func(container *v1.Container, path *field.Path, object *Object, profile *Profile) error {
+		requests, limits := container.Resources.Requests.Memory(), container.Resources.Limits.Memory()
+		if requests.IsZero() || limits.IsZero() {
+			return field.Required(path.Child("resources"), "Container memory requests and limit must be set")
+		}
+		if !requests.Equal(*limits) {
+			return field.Invalid(path.Child("resources", "requests", "memory"), requests.String(), "Memory request must be set and equal to limits")
+		}
+		return nil
+	}))
+}
+
+// checkSecretsRule reports the findings of the secret scan, as denials in deny mode
+func checkSecretsRule(ctx context.Context, object *Object, profile *Profile) []Violation {
+	if object.Job == nil {
+		return nil
+	}
+	allowed, findings, err := checkSecrets(object.Job, profile)
+	if !allowed {
+		return []Violation{{Message: err.Error(), Severity: SeverityDeny}}
+	}
+	result := []Violation{}
+	for _, finding := range findings {
+		result = append(result, Violation{Message: finding})
+	}
+	return result
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func findRule(t *testing.T, id string) Rule {
+	for _, rule := range Rules() {
+		if rule.ID() == id {
+			return rule
+		}
+	}
+	t.Fatalf("Rule %v is not registered", id)
+	return nil
+}
+
+func ruleObject(job *batchv1.Job) *Object {
+	return &Object{Job: job, PodSpec: &job.Spec.Template.Spec, SpecPath: field.NewPath("spec", "template", "spec"), Namespace: job.Namespace}
+}
+
+func TestBuiltinRules(t *testing.T) {
+	cases := map[string]struct {
+		job     func(job *batchv1.Job)
+		profile func(profile *Profile)
+		field   string
+	}{
+		"job.metadata": {
+			job:     func(job *batchv1.Job) { delete(job.Labels, "team") },
+			profile: func(profile *Profile) { profile.Metadata.Labels = []MetadataRule{{Key: "team"}} },
+		},
+		"job.activeDeadline":   {job: func(job *batchv1.Job) { job.Spec.ActiveDeadlineSeconds = nil }, field: "spec.activeDeadlineSeconds"},
+		"job.spec":             {job: func(job *batchv1.Job) { *job.Spec.Parallelism = 2 }},
+		"job.restartPolicy":    {job: func(job *batchv1.Job) { job.Spec.Template.Spec.RestartPolicy = v1.RestartPolicyOnFailure }, field: "spec.template.spec.restartPolicy"},
+		"runtime.runtimeClass": {job: func(job *batchv1.Job) { job.Spec.Template.Spec.RuntimeClassName = nil }, field: "spec.template.spec.runtimeClassName"},
+		"host.network":         {job: func(job *batchv1.Job) { job.Spec.Template.Spec.HostNetwork = true }, field: "spec.template.spec.hostNetwork"},
+		"host.ipc":             {job: func(job *batchv1.Job) { job.Spec.Template.Spec.HostIPC = true }, field: "spec.template.spec.hostIPC"},
+		"host.pid":             {job: func(job *batchv1.Job) { job.Spec.Template.Spec.HostPID = true }, field: "spec.template.spec.hostPID"},
+		"pod.fields":           {job: func(job *batchv1.Job) { job.Spec.Template.Spec.DNSPolicy = v1.DNSNone }, field: "spec.template.spec.dnsPolicy"},
+		"pod.serviceAccount":   {job: func(job *batchv1.Job) { job.Spec.Template.Spec.ServiceAccountName = "admin" }, field: "spec.template.spec.serviceAccountName"},
+		"pod.placement":        {job: func(job *batchv1.Job) { job.Spec.Template.Spec.NodeName = "node" }, field: "spec.template.spec.nodeName"},
+		"pod.priority":         {job: func(job *batchv1.Job) { job.Spec.Template.Spec.PriorityClassName = "system-node-critical" }, field: "spec.template.spec.priorityClassName"},
+		"pod.sysctls": {job: func(job *batchv1.Job) {
+			job.Spec.Template.Spec.SecurityContext.Sysctls = []v1.Sysctl{{Name: "kernel.shm_rmid_forced", Value: "1"}, {Name: "net.core.somaxconn"}}
+		}, field: "spec.template.spec.securityContext.sysctls[1].name"},
+		"limits.containers": {
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Containers = append(job.Spec.Template.Spec.Containers, v1.Container{})
+			},
+			profile: func(profile *Profile) { profile.Limits.MaxContainers = 1 },
+			field:   "spec.template.spec.containers",
+		},
+		"limits.initContainers": {
+			job:     func(job *batchv1.Job) { job.Spec.Template.Spec.InitContainers = []v1.Container{{}, {}} },
+			profile: func(profile *Profile) { profile.Limits.MaxInitContainers = 1 },
+			field:   "spec.template.spec.initContainers",
+		},
+		"limits.terminationGracePeriod": {job: func(job *batchv1.Job) { *job.Spec.Template.Spec.TerminationGracePeriodSeconds = 3600 }, field: "spec.template.spec.terminationGracePeriodSeconds"},
+		"limits.hooks": {
+			job: func(job *batchv1.Job) {
+				job.Spec.Template.Spec.Containers[0].Lifecycle = &v1.Lifecycle{PostStart: &v1.LifecycleHandler{}}
+			},
+			profile: func(profile *Profile) { profile.Limits.ForbidLifecycleHooks = true },
+			field:   "spec.template.spec.containers[0].lifecycle",
+		},
+		"commands.command": {
+			job:     func(job *batchv1.Job) { job.Spec.Template.Spec.Containers[0].Command = []string{"sh", "-c", "id"} },
+			profile: func(profile *Profile) { profile.DeniedCommands = []CommandRule{{Prefix: []string{"sh", "-c"}}} },
+			field:   "spec.template.spec.containers[0].command[0]",
+		},
+		"securityContext.required":     {job: func(job *batchv1.Job) { job.Spec.Template.Spec.Containers[0].SecurityContext = nil }, field: "spec.template.spec.containers[0].securityContext"},
+		"securityContext.runAsNonRoot": {job: func(job *batchv1.Job) { job.Spec.Template.Spec.Containers[0].SecurityContext.RunAsNonRoot = nil }, field: "spec.template.spec.containers[0].securityContext.runAsNonRoot"},
+		"securityContext.allowPrivilegeEscalation": {job: func(job *batchv1.Job) {
+			*job.Spec.Template.Spec.Containers[0].SecurityContext.AllowPrivilegeEscalation = true
+		}, field: "spec.template.spec.containers[0].securityContext.allowPrivilegeEscalation"},
+		"securityContext.privileged":   {job: func(job *batchv1.Job) { *job.Spec.Template.Spec.Containers[0].SecurityContext.Privileged = true }, field: "spec.template.spec.containers[0].securityContext.privileged"},
+		"securityContext.capabilities": {job: func(job *batchv1.Job) { job.Spec.Template.Spec.Containers[0].SecurityContext.Capabilities.Drop = nil }, field: "spec.template.spec.containers[0].securityContext.capabilities.drop"},
+		"ports.containerPorts": {job: func(job *batchv1.Job) {
+			job.Spec.Template.Spec.Containers[0].Ports = []v1.ContainerPort{{ContainerPort: 80}}
+		}, field: "spec.template.spec.containers[0].ports"},
+		"env.sources":     {job: func(job *batchv1.Job) { job.Spec.Template.Spec.Containers[0].EnvFrom = []v1.EnvFromSource{{}} }, field: "spec.template.spec.containers[0].envFrom[0]"},
+		"volumes.devices": {job: func(job *batchv1.Job) { job.Spec.Template.Spec.Containers[0].VolumeDevices = []v1.VolumeDevice{{}} }, field: "spec.template.spec.containers[0].volumeDevices"},
+		"volumes.mounts":  {job: func(job *batchv1.Job) { job.Spec.Template.Spec.Containers[0].VolumeMounts = []v1.VolumeMount{{}} }, field: "spec.template.spec.containers[0].volumeMounts"},
+		"volumes.volumes": {job: func(job *batchv1.Job) { job.Spec.Template.Spec.Volumes = []v1.Volume{{}} }, field: "spec.template.spec.volumes"},
+		"resources.cpu":   {job: func(job *batchv1.Job) { delete(job.Spec.Template.Spec.Containers[0].Resources.Limits, v1.ResourceCPU) }, field: "spec.template.spec.containers[0].resources"},
+		"resources.memory": {job: func(job *batchv1.Job) {
+			job.Spec.Template.Spec.Containers[0].Resources.Limits[v1.ResourceMemory] = resource.MustParse("1Gi")
+		}, field: "spec.template.spec.containers[0].resources.requests.memory"},
+		"secrets.scan": {job: func(job *batchv1.Job) { job.Annotations["token"] = testJWT }},
+	}
+
+	for _, rule := range Rules() {
+		if _, ok := cases[rule.ID()]; !ok {
+			t.Errorf("Built-in rule %v has no test case", rule.ID())
+		}
+		if rule.Description() == "" {
+			t.Errorf("Rule %v has no description", rule.ID())
+		}
+	}
+
+	valid := loadJob(t, loadValidJob(t))
+	valid.Labels = map[string]string{"team": "ml"}
+	valid.Spec.Template.Labels["team"] = "ml"
+	for id, val := range cases {
+		rule := findRule(t, id)
+		profile := defaultProfile()
+		profile.RuntimeClass = "gvisor"
+		if val.profile != nil {
+			val.profile(&profile)
+		}
+		if violations := rule.Evaluate(context.Background(), ruleObject(valid.DeepCopy()), &profile); len(violations) > 0 {
+			t.Errorf("Rule %v reported the valid job: %v", id, violations)
+		}
+
+		job := valid.DeepCopy()
+		if val.job != nil {
+			val.job(job)
+		}
+		if violations := rule.Evaluate(context.Background(), ruleObject(job), &profile); len(violations) == 0 {
+			t.Errorf("Rule %v didn't report the invalid job", id)
+		} else if violations[0].Field != val.field {
+			t.Errorf("Rule %v must report the field %v, got %v", id, val.field, violations[0].Field)
+		}
+	}
+}
+
+func TestEvaluateRules(t *testing.T) {
+	job := loadJob(t, loadValidJob(t))
+	job.Annotations["token"] = testJWT
+	job.Spec.Template.Spec.Containers[0].Ports = []v1.ContainerPort{{ContainerPort: 80}}
+	profile := defaultProfile()
+	profile.RuntimeClass = "gvisor"
+
+	allowed, _, err := evaluateRules(context.Background(), registry, ruleObject(job), &profile, nil)
+	if allowed || err == nil || err.Error() != "spec.template.spec.containers[0].ports: Forbidden: No port must be defined" {
+		t.Fatalf("Job with ports must be denied, got %v", err)
+	}
+
+	allowed, warnings, err := evaluateRules(context.Background(), registry, ruleObject(job), &profile, []string{GroupHost, GroupSecrets})
+	if !allowed || len(warnings) != 1 {
+		t.Fatalf("Only the selected groups must run, got %v %v", warnings, err)
+	}
+
+	object := ruleObject(job)
+	object.Job = nil
+	if allowed, warnings, _ = evaluateRules(context.Background(), registry, object, &profile, []string{GroupJob, GroupSecrets}); !allowed || len(warnings) > 0 {
+		t.Fatalf("Job rules must skip workload pod specs")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if allowed, _, _ = evaluateRules(ctx, registry, ruleObject(job), &profile, []string{GroupHost}); allowed {
+		t.Fatalf("Evaluation must fail closed when the context is done")
+	}
+}
+
+func TestInitContainerRules(t *testing.T) {
+	profile := defaultProfile()
+	profile.RuntimeClass = "gvisor"
+	cases := map[string]struct {
+		container func(container *v1.Container)
+		allowed   bool
+	}{
+		"valid": {container: func(container *v1.Container) {}, allowed: true},
+		"privileged": {container: func(container *v1.Container) {
+			privileged := true
+			container.SecurityContext.Privileged = &privileged
+		}},
+		"root": {container: func(container *v1.Container) { container.SecurityContext.RunAsNonRoot = nil }},
+		"capabilities": {container: func(container *v1.Container) {
+			container.SecurityContext.Capabilities.Add = []v1.Capability{"SYS_ADMIN"}
+		}},
+		"envFrom":   {container: func(container *v1.Container) { container.EnvFrom = []v1.EnvFromSource{{}} }},
+		"resources": {container: func(container *v1.Container) { container.Resources = v1.ResourceRequirements{} }},
+	}
+	for key, val := range cases {
+		job := loadJob(t, loadValidJob(t))
+		spec := &job.Spec.Template.Spec
+		spec.InitContainers = []v1.Container{*spec.Containers[0].DeepCopy()}
+		val.container(&spec.InitContainers[0])
+		allowed, _, err := evaluateRules(context.Background(), registry, ruleObject(job), &profile, nil)
+		if allowed != val.allowed {
+			t.Errorf("%v: unexpected allowed %v for the init container: %v", key, allowed, err)
+		}
+		if !allowed && !strings.HasPrefix(err.Error(), "spec.template.spec.initContainers[0].") {
+			t.Errorf("%v: denial must report the field of the init container, got %v", key, err)
+		}
+	}
+}
+
+func TestRegisterRule(t *testing.T) {
+	saved := registry
+	defer func() { registry = saved }()
+
+	custom := NewRule("custom.image", "Images must come from the internal registry", SeverityDeny, func(ctx context.Context, object *Object, profile *Profile) []Violation {
+		for i, container := range object.PodSpec.Containers {
+			if !strings.HasPrefix(container.Image, "registry.internal/") {
+				return []Violation{{Field: object.SpecPath.Child("containers").Index(i).Child("image").String(), Message: "must use registry.internal"}}
+			}
+		}
+		return nil
+	})
+	RegisterRule(custom)
+
+	handler := &AdmissionHandler{RuntimeClass: "gvisor"}
+	allowed, _, err := validateJob(context.Background(), loadJob(t, loadValidJob(t)), handler)
+	if allowed || err.Error() != "spec.template.spec.containers[0].image: must use registry.internal" {
+		t.Fatalf("Custom rule must deny with its field, got %v", err)
+	}
+	if !contains(registeredGroups(), "custom") {
+		t.Fatalf("Group of the custom rule must be usable in the policy")
+	}
+
+	for _, id := range []string{"custom.image", "custom", ".image", "custom."} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Rule %v must not be registered", id)
+				}
+			}()
+			RegisterRule(NewRule(id, "", SeverityDeny, nil))
+		}()
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Secret scanning modes
+const (
+	ScanOff  = "off"
+	ScanWarn = "warn"
+	ScanDeny = "deny"
+)
+
+// Annotation written by kubectl apply, it duplicates the values of the job
+const lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+
+var secretPatterns = []struct {
+	kind    string
+	pattern *regexp.Regexp
+}{
+	{"an AWS access key", regexp.MustCompile(`\b(AKIA|ASIA|ABIA|ACCA)[0-9A-Z]{16}\b`)},
+	{"a private key", regexp.MustCompile(`-----BEGIN ([A-Z0-9]+ )*PRIVATE KEY( BLOCK)?-----`)},
+	{"a JWT", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{5,}\.eyJ[A-Za-z0-9_-]{5,}\.[A-Za-z0-9_-]{10,}`)},
+	{"a GitHub token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+}
+
+// Characters splitting a value in candidate tokens for the entropy check
+var tokenSeparators = regexp.MustCompile(`[\s"'=:,;&|<>()\[\]{}]+`)
+
+// checkSecrets looks for credentials hard-coded in env values, commands, args and annotations.
+// Findings only name where the value was found, the value itself is never reported.
+func checkSecrets(job *batchv1.Job, profile *Profile) (bool, []string, error) {
+	scan := profile.SecretScan
+	if scan.Mode == ScanOff {
+		return true, nil, nil
+	}
+
+	findings := []string{}
+	report := func(location, value string) {
+		if kind := detectSecret(value, &scan); kind != "" {
+			findings = append(findings, fmt.Sprintf("%v looks like %v", location, kind))
+		}
+	}
+
+	scanAnnotations := func(prefix string, annotations map[string]string) {
+		for _, key := range sortedKeys(annotations) {
+			if key != lastAppliedAnnotation {
+				report(fmt.Sprintf("%v.annotations[%v]", prefix, key), annotations[key])
+			}
+		}
+	}
+	scanAnnotations("metadata", job.Annotations)
+	scanAnnotations("spec.template.metadata", job.Spec.Template.Annotations)
+
+	scanContainers := func(prefix string, containers []v1.Container) {
+		for i, container := range containers {
+			location := fmt.Sprintf("spec.template.spec.%v[%v]", prefix, i)
+			for j, env := range container.Env {
+				if !matchAny(scan.AllowEnvNames, env.Name) {
+					report(fmt.Sprintf("%v.env[%v] (%v)", location, j, env.Name), env.Value)
+				}
+			}
+			for j, command := range container.Command {
+				report(fmt.Sprintf("%v.command[%v]", location, j), command)
+			}
+			for j, arg := range container.Args {
+				report(fmt.Sprintf("%v.args[%v]", location, j), arg)
+			}
+		}
+	}
+	scanContainers("initContainers", job.Spec.Template.Spec.InitContainers)
+	scanContainers("containers", job.Spec.Template.Spec.Containers)
+
+	if len(findings) == 0 {
+		return true, nil, nil
+	}
+	if scan.Mode == ScanDeny {
+		return false, nil, fmt.Errorf("possible hard-coded credentials, use a secret reference instead: %v", strings.Join(findings, ", "))
+	}
+	return true, findings, nil
+}
+
+// detectSecret returns the kind of secret found in the value, empty if none
+func detectSecret(value string, scan *SecretScan) string {
+	for _, secret := range secretPatterns {
+		if secret.pattern.MatchString(value) {
+			return secret.kind
+		}
+	}
+	if scan.MinEntropy <= 0 {
+		return ""
+	}
+	for _, token := range tokenSeparators.Split(value, -1) {
+		if len(token) >= scan.MinLength && shannonEntropy(token) >= scan.MinEntropy {
+			return "a high entropy string"
+		}
+	}
+	return ""
+}
+
+// shannonEntropy returns the bits of entropy per character of the value
+func shannonEntropy(value string) float64 {
+	counts := map[rune]int{}
+	for _, char := range value {
+		counts[char]++
+	}
+	length := float64(len([]rune(value)))
+	entropy := 0.0
+	for _, count := range counts {
+		frequency := float64(count) / length
+		entropy -= frequency * math.Log2(frequency)
+	}
+	return entropy
+}
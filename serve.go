@@ -1,23 +1,51 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	admission "k8s.io/api/admission/v1beta1"
 	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
 	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
 type AdmissionHandler struct {
 	RuntimeClass string
+	// Optional, when nil every namespace uses the default profile
+	Policy *Policy
+	// Optional, rules that need to read other objects fail when nil
+	Cluster *Cluster
 }
 
-// Handle requests
+// profile returns the profile applied to the jobs of the namespace
+func (handler *AdmissionHandler) profile(namespace string) *Profile {
+	profile := defaultProfile()
+	if handler.Policy != nil {
+		if selected := handler.Policy.Profile(namespace); selected != nil {
+			profile = *selected
+		}
+	}
+	if profile.RuntimeClass == "" {
+		profile.RuntimeClass = handler.RuntimeClass
+	}
+	return &profile
+}
+
+// Handle validation requests
 func (handler *AdmissionHandler) handler(w http.ResponseWriter, r *http.Request) {
+	handler.serve(w, r, handler.validate)
+}
+
+// serve decodes the AdmissionReview and writes the response returned by review
+func (handler *AdmissionHandler) serve(w http.ResponseWriter, r *http.Request, review func(context.Context, *admission.AdmissionRequest) *admission.AdmissionResponse) {
 	var body []byte
 	if r.Body != nil {
 		data, err := ioutil.ReadAll(r.Body)
@@ -42,22 +70,16 @@ func (handler *AdmissionHandler) handler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	result, err := checkRequest(request.Request, handler)
-	response := admission.AdmissionResponse{
-		UID:     request.Request.UID,
-		Allowed: result,
-	}
-	if err != nil {
-		response.Result = &k8meta.Status{
-			Message: fmt.Sprintf("%v", err),
-			Reason:  k8meta.StatusReasonUnauthorized,
-		}
-	}
+	ctx, cancel := webhookContext(r)
+	defer cancel()
+	ctx = context.WithValue(ctx, reviewVersionKey{}, request.APIVersion)
+	response := review(ctx, request.Request)
+	response.UID = request.Request.UID
 
 	outReview := admission.AdmissionReview{
 		TypeMeta: request.TypeMeta,
 		Request:  request.Request,
-		Response: &response,
+		Response: response,
 	}
 	json, err := json.Marshal(outReview)
 
@@ -72,147 +94,157 @@ func (handler *AdmissionHandler) handler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
-func checkRequest(request *admission.AdmissionRequest, handler *AdmissionHandler) (bool, error) {
-	if request.Namespace == "kube-system" {
-		log.Printf("Warning: Controller is applied to kube-system, skipping")
-		return true, nil
+type reviewVersionKey struct{}
+
+// reviewAPIVersion returns the apiVersion of the AdmissionReview sent by the apiserver, by default
+// the version decoded by the handler
+func reviewAPIVersion(ctx context.Context) string {
+	if version, ok := ctx.Value(reviewVersionKey{}).(string); ok && version != "" {
+		return version
 	}
+	return admission.SchemeGroupVersion.String()
+}
 
-	if request.RequestKind.Group != "batch" || request.RequestKind.Kind != "Job" || request.Operation != "CREATE" {
-		log.Printf("Skipped resource [%v,%v,%v], check rules to exclude this resource", request.RequestKind.Group, request.RequestKind.Kind, request.Operation)
-		return true, nil
+// webhookContext returns the context of the request with a deadline before the webhook
+// timeout, sent by the apiserver in the timeout parameter, so a response is sent in time
+func webhookContext(r *http.Request) (context.Context, context.CancelFunc) {
+	timeout, err := time.ParseDuration(r.URL.Query().Get("timeout"))
+	if err != nil || timeout <= 0 {
+		return context.WithCancel(r.Context())
 	}
+	return context.WithTimeout(r.Context(), timeout-timeout/10)
+}
 
-	var job *batchv1.Job
-	err := json.Unmarshal(request.Object.Raw, &job)
+func (handler *AdmissionHandler) validate(ctx context.Context, request *admission.AdmissionRequest) *admission.AdmissionResponse {
+	result, warnings, err := checkRequest(ctx, request, handler)
+	response := &admission.AdmissionResponse{
+		Allowed:  result,
+		Warnings: warnings,
+	}
 	if err != nil {
-		log.Printf("Error parsing job %v", err)
-		return true, nil
+		response.Result = &k8meta.Status{
+			Message: fmt.Sprintf("%v", err),
+			Reason:  k8meta.StatusReasonUnauthorized,
+		}
 	}
-
-	return checkJob(job, handler)
+	return response
 }
 
-// Check that the applied job has all the security properties set
-func checkJob(request *batchv1.Job, handler *AdmissionHandler) (bool, error) {
-	if request.Spec.ActiveDeadlineSeconds == nil || *request.Spec.ActiveDeadlineSeconds == 0 {
-		return false, fmt.Errorf("activeDeadlineSeconds must be set")
+// decodeJob returns the job of the request, nil if the request must be skipped
+func decodeJob(request *admission.AdmissionRequest) *batchv1.Job {
+	if request.Namespace == "kube-system" {
+		log.Printf("Warning: Controller is applied to kube-system, skipping")
+		return nil
 	}
 
-	if request.Spec.BackoffLimit == nil || *request.Spec.BackoffLimit != 1 {
-		return false, fmt.Errorf("backoffLimit mus be set to 1")
+	if request.RequestKind.Group != "batch" || request.RequestKind.Kind != "Job" || (request.Operation != admission.Create && request.Operation != admission.Update) {
+		log.Printf("Skipped resource [%v,%v,%v], check rules to exclude this resource", request.RequestKind.Group, request.RequestKind.Kind, request.Operation)
+		return nil
 	}
 
-	if request.Spec.Parallelism != nil && *request.Spec.Parallelism != 1 {
-		return false, fmt.Errorf("Parallelism must not be used")
+	job, err := parseJob(request.Object.Raw, request.Namespace)
+	if err != nil {
+		log.Printf("Error parsing job %v", err)
+		return nil
 	}
+	return job
+}
 
-	if request.Spec.Completions != nil && *request.Spec.Completions != 1 {
-		return false, fmt.Errorf("Completions must not be used")
+func parseJob(raw []byte, namespace string) (*batchv1.Job, error) {
+	var job *batchv1.Job
+	if err := json.Unmarshal(raw, &job); err != nil {
+		return nil, err
 	}
-
-	// TTLSecondsAfterFinished is an alpha feature, and must be enabled manually
-	//if request.Spec.TTLSecondsAfterFinished == nil || *request.Spec.TTLSecondsAfterFinished == 0 {
-	//	return false, fmt.Errorf("ttlSecondsAfterFinished must be set greater than 0")
-	//}
-
-	spec := request.Spec.Template.Spec
-	if spec.RuntimeClassName == nil || *spec.RuntimeClassName != handler.RuntimeClass {
-		return false, fmt.Errorf("wrong RuntimeClass %v is set for job %v, must be %v", spec.RuntimeClassName, request.Name, handler.RuntimeClass)
+	if job == nil {
+		return nil, fmt.Errorf("object is empty")
 	}
-
-	if spec.HostNetwork != false {
-		return false, fmt.Errorf("HostNetwork must not be set")
+	if job.Namespace == "" {
+		job.Namespace = namespace
 	}
+	return job, nil
+}
 
-	if spec.HostIPC != false {
-		return false, fmt.Errorf("HostIPC must be false")
+// checkRequest returns if the request is allowed and the warnings for the user
+func checkRequest(ctx context.Context, request *admission.AdmissionRequest, handler *AdmissionHandler) (bool, []string, error) {
+	if rule := handler.workloadRule(request); rule != nil && request.Namespace != "kube-system" {
+		allowed, warnings, err := checkWorkload(ctx, request, rule, handler)
+		if allowed {
+			var policyWarnings []string
+			allowed, policyWarnings, err = handler.checkPolicyRules(ctx, request)
+			warnings = append(warnings, policyWarnings...)
+		}
+		if err != nil {
+			log.Printf("Denied %v %v/%v: %v", request.Kind.Kind, request.Namespace, request.Name, err)
+		}
+		return allowed, warnings, err
 	}
 
-	if spec.HostPID != false {
-		return false, fmt.Errorf("HostPID must be false")
+	job := decodeJob(request)
+	if job == nil {
+		return true, nil, nil
 	}
 
-	if spec.ServiceAccountName != "" {
-		return false, fmt.Errorf("You must not set a serviceAccount")
+	allowed, warnings, err := validateJob(ctx, job, handler)
+	if !allowed && request.Operation == admission.Update {
+		allowed, err = checkUpdate(ctx, request, job, handler, err)
 	}
-
-	if spec.RestartPolicy != "Never" {
-		return false, fmt.Errorf("Job is not allowed to restart")
+	if allowed {
+		var policyWarnings []string
+		allowed, policyWarnings, err = handler.checkPolicyRules(ctx, request)
+		warnings = append(warnings, policyWarnings...)
 	}
 
-	if spec.SecurityContext != nil && len(spec.SecurityContext.Sysctls) > 0 {
-		return false, fmt.Errorf("Sysctls must be empty")
+	// Findings never contain the secret values, so they are safe to log
+	if err != nil {
+		log.Printf("Denied job %v/%v: %v", job.Namespace, job.Name, err)
+	} else if len(warnings) > 0 {
+		log.Printf("Warnings for job %v/%v: %v", job.Namespace, job.Name, strings.Join(warnings, ", "))
 	}
+	return allowed, warnings, err
+}
 
-	for _, container := range spec.Containers {
-		if container.SecurityContext == nil {
-			return false, fmt.Errorf("SecurityContext must be set for the container")
-		}
-		context := *container.SecurityContext
-
-		if context.RunAsNonRoot == nil || *context.RunAsNonRoot != true {
-			return false, fmt.Errorf("RunAsNonRoot must be set per container")
-		}
-
-		if context.AllowPrivilegeEscalation == nil || *context.AllowPrivilegeEscalation != false {
-			return false, fmt.Errorf("AllowPrivilegeEscalation must be false per container")
-		}
-
-		if context.Privileged == nil || *context.Privileged != false {
-			return false, fmt.Errorf("Privileged must be false per container")
-		}
-
-		if context.Capabilities == nil || len(context.Capabilities.Drop) != 1 || context.Capabilities.Drop[0] != "all" {
-			return false, fmt.Errorf("Container must drop all capabilities (Only 'all' must be set)")
-		}
-
-		if len(context.Capabilities.Add) > 0 {
-			return false, fmt.Errorf("Container must not add any capabilites")
-		}
+// validateJob runs the registered rules against the job
+func validateJob(ctx context.Context, job *batchv1.Job, handler *AdmissionHandler) (bool, []string, error) {
+	return evaluateRules(ctx, registry, jobObject(job, handler), handler.profile(job.Namespace), nil)
+}
 
-		if len(container.Ports) > 0 {
-			return false, fmt.Errorf("No port must be defined")
-		}
+func jobObject(job *batchv1.Job, handler *AdmissionHandler) *Object {
+	return &Object{
+		Job:       job,
+		PodSpec:   &job.Spec.Template.Spec,
+		SpecPath:  field.NewPath("spec", "template", "spec"),
+		Namespace: job.Namespace,
+		Cluster:   handler.Cluster,
+	}
+}
 
-		if len(container.EnvFrom) > 0 {
-			return false, fmt.Errorf("EnvFrom must not be defined")
-		}
+// checkPolicyRules runs the rules declared in the policy file, once per request
+func (handler *AdmissionHandler) checkPolicyRules(ctx context.Context, request *admission.AdmissionRequest) (bool, []string, error) {
+	if handler.Policy == nil || len(handler.Policy.rules) == 0 {
+		return true, nil, nil
+	}
+	object := &Object{Namespace: request.Namespace, Cluster: handler.Cluster, Request: request}
+	return evaluateRules(ctx, handler.Policy.rules, object, handler.profile(request.Namespace), nil)
+}
 
-		for _, env := range container.Env {
-			if env.ValueFrom != nil {
-				return false, fmt.Errorf("env valueFrom can't be defined")
+// checkContainerHooks denies the lifecycle hooks and exec probes when the profile forbids them,
+// they run commands outside of the job command and can keep the pod alive past its deadline.
+// path is the path of the container
+func checkContainerHooks(container *v1.Container, path *field.Path, profile *Profile) error {
+	if profile.Limits.ForbidLifecycleHooks && container.Lifecycle != nil && (container.Lifecycle.PostStart != nil || container.Lifecycle.PreStop != nil) {
+		return field.Forbidden(path.Child("lifecycle"), fmt.Sprintf("lifecycle hooks are not allowed in container %v", container.Name))
+	}
+
+	if profile.Limits.ForbidExecProbes {
+		probes := []struct {
+			name  string
+			probe *v1.Probe
+		}{{"livenessProbe", container.LivenessProbe}, {"readinessProbe", container.ReadinessProbe}, {"startupProbe", container.StartupProbe}}
+		for _, probe := range probes {
+			if probe.probe != nil && probe.probe.Exec != nil {
+				return field.Forbidden(path.Child(probe.name, "exec"), fmt.Sprintf("exec probes are not allowed in container %v", container.Name))
 			}
 		}
-
-		if len(container.VolumeDevices) > 0 {
-			return false, fmt.Errorf("VolumeDevices are not supported")
-		}
-
-		if len(container.VolumeMounts) > 0 {
-			return false, fmt.Errorf("VolumeMounts are not supported")
-		}
-
-		if container.Resources.Requests.Cpu() == nil || container.Resources.Limits.Cpu() == nil || container.Resources.Requests.Cpu().IsZero() || container.Resources.Limits.Cpu().IsZero() {
-			return false, fmt.Errorf("Container cpu requests and limit must be set")
-		}
-
-		if !container.Resources.Requests.Cpu().Equal(*container.Resources.Limits.Cpu()) {
-			return false, fmt.Errorf("CPU request must be set and equal to limits")
-		}
-
-		if container.Resources.Requests.Memory() == nil || container.Resources.Limits.Memory() == nil || container.Resources.Requests.Memory().IsZero() || container.Resources.Limits.Memory().IsZero() {
-			return false, fmt.Errorf("Container memory requests and limit must be set")
-		}
-
-		if !container.Resources.Requests.Memory().Equal(*container.Resources.Limits.Memory()) {
-			return false, fmt.Errorf("Memory request must be set and equal to limits")
-		}
-	}
-
-	if len(spec.Volumes) > 0 {
-		return false, fmt.Errorf("There are more than one volume declared %v", len(spec.Volumes))
 	}
-
-	return true, nil
+	return nil
 }
@@ -12,10 +12,11 @@ import (
 	batchv1 "k8s.io/api/batch/v1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 )
 
 func loadValidJob(t *testing.T) admission.AdmissionReview {
-	body := `{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","request":{"uid":"e1b0cabd-700d-4ed2-90ab-7e0957da7037","kind":{"group":"batch","version":"v1","kind":"Job"},"resource":{"group":"batch","version":"v1","resource":"jobs"},"requestKind":{"group":"batch","version":"v1","kind":"Job"},"requestResource":{"group":"batch","version":"v1","resource":"jobs"},"name":"busybox","namespace":"default","operation":"CREATE","userInfo":{"username":"kubernetes-admin","groups":["system:masters","system:authenticated"]},"object":{"kind":"Job","apiVersion":"batch/v1","metadata":{"name":"busybox","namespace":"default","uid":"c0381bc6-f7dd-49b3-a21d-4aa95f0f2d7b","creationTimestamp":"2021-04-04T22:30:26Z","annotations":{"kubectl.kubernetes.io/last-applied-configuration":"{\"apiVersion\":\"batch/v1\",\"kind\":\"Job\",\"metadata\":{\"annotations\":{},\"name\":\"busybox\",\"namespace\":\"default\"},\"spec\":{\"activeDeadlineSeconds\":30,\"backoffLimit\":1,\"template\":{\"spec\":{\"containers\":[{\"command\":[\"sleep\",\"120\"],\"env\":[{\"name\":\"TEST\",\"value\":\"VALUE\"}],\"image\":\"busybox\",\"name\":\"busybox\",\"resources\":{\"limits\":{\"cpu\":\"10m\",\"memory\":\"50Mi\"},\"requests\":{\"cpu\":\"10m\",\"memory\":\"50Mi\"}},\"securityContext\":{\"allowPrivilegeEscalation\":false,\"capabilities\":{\"drop\":[\"all\"]},\"privileged\":false,\"runAsNonRoot\":true,\"runAsUser\":33}}],\"restartPolicy\":\"Never\",\"runtimeClassName\":\"gvisor\"}},\"ttlSecondsAfterFinished\":86400}}\n"},"managedFields":[{"manager":"kubectl-client-side-apply","operation":"Update","apiVersion":"batch/v1","time":"2021-04-04T22:30:26Z","fieldsType":"FieldsV1","fieldsV1":{"f:metadata":{"f:annotations":{".":{},"f:kubectl.kubernetes.io/last-applied-configuration":{}}},"f:spec":{"f:activeDeadlineSeconds":{},"f:backoffLimit":{},"f:completions":{},"f:parallelism":{},"f:template":{"f:spec":{"f:containers":{"k:{\"name\":\"busybox\"}":{".":{},"f:command":{},"f:env":{".":{},"k:{\"name\":\"TEST\"}":{".":{},"f:name":{},"f:value":{}}},"f:image":{},"f:imagePullPolicy":{},"f:name":{},"f:resources":{".":{},"f:limits":{".":{},"f:cpu":{},"f:memory":{}},"f:requests":{".":{},"f:cpu":{},"f:memory":{}}},"f:securityContext":{".":{},"f:allowPrivilegeEscalation":{},"f:capabilities":{".":{},"f:drop":{}},"f:privileged":{},"f:runAsNonRoot":{},"f:runAsUser":{}},"f:terminationMessagePath":{},"f:terminationMessagePolicy":{}}},"f:dnsPolicy":{},"f:restartPolicy":{},"f:runtimeClassName":{},"f:schedulerName":{},"f:securityContext":{},"f:terminationGracePeriodSeconds":{}}},"f:ttlSecondsAfterFinished":{}}}}]},"spec":{"parallelism":1,"completions":1,"activeDeadlineSeconds":30,"backoffLimit":1,"selector":{"matchLabels":{"controller-uid":"c0381bc6-f7dd-49b3-a21d-4aa95f0f2d7b"}},"template":{"metadata":{"creationTimestamp":null,"labels":{"controller-uid":"c0381bc6-f7dd-49b3-a21d-4aa95f0f2d7b","job-name":"busybox"}},"spec":{"containers":[{"name":"busybox","image":"busybox","command":["sleep","120"],"env":[{"name":"TEST","value":"VALUE"}],"resources":{"limits":{"cpu":"10m","memory":"50Mi"},"requests":{"cpu":"10m","memory":"50Mi"}},"terminationMessagePath":"/dev/termination-log","terminationMessagePolicy":"File","imagePullPolicy":"Always","securityContext":{"capabilities":{"drop":["all"]},"privileged":false,"runAsUser":33,"runAsNonRoot":true,"allowPrivilegeEscalation":false}}],"restartPolicy":"Never","terminationGracePeriodSeconds":30,"dnsPolicy":"ClusterFirst","securityContext":{},"schedulerName":"default-scheduler","runtimeClassName":"gvisor"}}},"status":{}},"oldObject":null,"dryRun":false,"options":{"kind":"CreateOptions","apiVersion":"meta.k8s.io/v1","fieldManager":"kubectl-client-side-apply"}}}`
+	body := `{"kind":"AdmissionReview","apiVersion":"admission.k8s.io/v1","request":{"uid":"e1b0cabd-700d-4ed2-90ab-7e0957da7037","kind":{"group":"batch","version":"v1","kind":"Job"},"resource":{"group":"batch","version":"v1","resource":"jobs"},"requestKind":{"group":"batch","version":"v1","kind":"Job"},"requestResource":{"group":"batch","version":"v1","resource":"jobs"},"name":"busybox","namespace":"default","operation":"CREATE","userInfo":{"username":"kubernetes-admin","groups":["system:masters","system:authenticated"]},"object":{"kind":"Job","apiVersion":"batch/v1","metadata":{"name":"busybox","namespace":"default","uid":"c0381bc6-f7dd-49b3-a21d-4aa95f0f2d7b","creationTimestamp":"2021-04-04T22:30:26Z","annotations":{"kubectl.kubernetes.io/last-applied-configuration":"{\"apiVersion\":\"batch/v1\",\"kind\":\"Job\",\"metadata\":{\"annotations\":{},\"name\":\"busybox\",\"namespace\":\"default\"},\"spec\":{\"activeDeadlineSeconds\":30,\"backoffLimit\":1,\"template\":{\"spec\":{\"containers\":[{\"command\":[\"sleep\",\"120\"],\"env\":[{\"name\":\"TEST\",\"value\":\"VALUE\"}],\"image\":\"busybox\",\"name\":\"busybox\",\"resources\":{\"limits\":{\"cpu\":\"10m\",\"memory\":\"50Mi\"},\"requests\":{\"cpu\":\"10m\",\"memory\":\"50Mi\"}},\"securityContext\":{\"allowPrivilegeEscalation\":false,\"capabilities\":{\"drop\":[\"all\"]},\"privileged\":false,\"runAsNonRoot\":true,\"runAsUser\":33}}],\"restartPolicy\":\"Never\",\"runtimeClassName\":\"gvisor\"}},\"ttlSecondsAfterFinished\":86400}}\n"},"managedFields":[{"manager":"kubectl-client-side-apply","operation":"Update","apiVersion":"batch/v1","time":"2021-04-04T22:30:26Z","fieldsType":"FieldsV1","fieldsV1":{"f:metadata":{"f:annotations":{".":{},"f:kubectl.kubernetes.io/last-applied-configuration":{}}},"f:spec":{"f:activeDeadlineSeconds":{},"f:backoffLimit":{},"f:completions":{},"f:parallelism":{},"f:template":{"f:spec":{"f:containers":{"k:{\"name\":\"busybox\"}":{".":{},"f:command":{},"f:env":{".":{},"k:{\"name\":\"TEST\"}":{".":{},"f:name":{},"f:value":{}}},"f:image":{},"f:imagePullPolicy":{},"f:name":{},"f:resources":{".":{},"f:limits":{".":{},"f:cpu":{},"f:memory":{}},"f:requests":{".":{},"f:cpu":{},"f:memory":{}}},"f:securityContext":{".":{},"f:allowPrivilegeEscalation":{},"f:capabilities":{".":{},"f:drop":{}},"f:privileged":{},"f:runAsNonRoot":{},"f:runAsUser":{}},"f:terminationMessagePath":{},"f:terminationMessagePolicy":{}}},"f:dnsPolicy":{},"f:restartPolicy":{},"f:runtimeClassName":{},"f:schedulerName":{},"f:securityContext":{},"f:terminationGracePeriodSeconds":{}}},"f:ttlSecondsAfterFinished":{}}}}]},"spec":{"parallelism":1,"completions":1,"activeDeadlineSeconds":30,"backoffLimit":1,"selector":{"matchLabels":{"controller-uid":"c0381bc6-f7dd-49b3-a21d-4aa95f0f2d7b"}},"template":{"metadata":{"creationTimestamp":null,"labels":{"controller-uid":"c0381bc6-f7dd-49b3-a21d-4aa95f0f2d7b","job-name":"busybox"}},"spec":{"containers":[{"name":"busybox","image":"busybox","command":["sleep","120"],"env":[{"name":"TEST","value":"VALUE"}],"resources":{"limits":{"cpu":"10m","memory":"50Mi"},"requests":{"cpu":"10m","memory":"50Mi"}},"terminationMessagePath":"/dev/termination-log","terminationMessagePolicy":"File","imagePullPolicy":"Always","securityContext":{"capabilities":{"drop":["all"]},"privileged":false,"runAsUser":33,"runAsNonRoot":true,"allowPrivilegeEscalation":false}}],"restartPolicy":"Never","terminationGracePeriodSeconds":30,"dnsPolicy":"ClusterFirst","automountServiceAccountToken":false,"securityContext":{},"schedulerName":"default-scheduler","runtimeClassName":"gvisor"}}},"status":{}},"oldObject":null,"dryRun":false,"options":{"kind":"CreateOptions","apiVersion":"meta.k8s.io/v1","fieldManager":"kubectl-client-side-apply"}}}`
 	adm := admission.AdmissionReview{}
 	if err := json.Unmarshal([]byte(body), &adm); err != nil {
 		t.Fatalf("Error loading job %v", err)
@@ -82,6 +83,20 @@ func TestValidJob(t *testing.T) {
 	}
 }
 
+func TestSidecarJob(t *testing.T) {
+	admission := loadValidJob(t)
+	job := loadJob(t, admission)
+	spec := &job.Spec.Template.Spec
+	spec.InitContainers = []v1.Container{spec.Containers[0]}
+	spec.Containers = append(spec.Containers, spec.Containers[0])
+	saveJob(t, admission, job)
+
+	response := sendRequest(t, admission)
+	if response.Response.Allowed == false {
+		t.Fatalf("Containers must not be limited by default, %v", response.Response.Result.Message)
+	}
+}
+
 func TestEnvVariable(t *testing.T) {
 	admission := loadValidJob(t)
 	job := loadJob(t, admission)
@@ -150,9 +165,36 @@ func TestInvalidCases(t *testing.T) {
 		"hostipc": func(job *batchv1.Job) {
 			job.Spec.Template.Spec.HostIPC = true
 		},
+		"dnspolicy": func(job *batchv1.Job) {
+			job.Spec.Template.Spec.DNSPolicy = v1.DNSNone
+		},
+		"nameserver": func(job *batchv1.Job) {
+			job.Spec.Template.Spec.DNSConfig = &v1.PodDNSConfig{Nameservers: []string{"1.1.1.1"}}
+		},
+		"hostaliases": func(job *batchv1.Job) {
+			job.Spec.Template.Spec.HostAliases = []v1.HostAlias{v1.HostAlias{IP: "10.0.0.1", Hostnames: []string{"api"}}}
+		},
+		"shareprocess": func(job *batchv1.Job) {
+			share := true
+			job.Spec.Template.Spec.ShareProcessNamespace = &share
+		},
+		"hostnamefqdn": func(job *batchv1.Job) {
+			fqdn := true
+			job.Spec.Template.Spec.SetHostnameAsFQDN = &fqdn
+		},
+		"os": func(job *batchv1.Job) {
+			job.Spec.Template.Spec.OS = &v1.PodOS{Name: v1.Windows}
+		},
+		"gracePeriod": func(job *batchv1.Job) {
+			grace := int64(86400)
+			job.Spec.Template.Spec.TerminationGracePeriodSeconds = &grace
+		},
 		"servaccount": func(job *batchv1.Job) {
 			job.Spec.Template.Spec.ServiceAccountName = "test"
 		},
+		"priorityclass": func(job *batchv1.Job) {
+			job.Spec.Template.Spec.PriorityClassName = "system-cluster-critical"
+		},
 		"restartpolicy": func(job *batchv1.Job) {
 			job.Spec.Template.Spec.RestartPolicy = "Always"
 		},
@@ -171,6 +213,12 @@ func TestInvalidCases(t *testing.T) {
 				ValueFrom: &v1.EnvVarSource{},
 			}}
 		},
+		"ldpreload": func(job *batchv1.Job) {
+			job.Spec.Template.Spec.Containers[0].Env = []v1.EnvVar{v1.EnvVar{
+				Name:  "LD_PRELOAD",
+				Value: "/tmp/lib.so",
+			}}
+		},
 		"envFrom": func(job *batchv1.Job) {
 			job.Spec.Template.Spec.Containers[0].EnvFrom = []v1.EnvFromSource{v1.EnvFromSource{}}
 		},
@@ -271,3 +319,27 @@ func TestNonBatchOperation(t *testing.T) {
 		t.Fatalf("Invalid admission kind was processed, %v", response.Response.Result.Message)
 	}
 }
+
+func TestContainerHooks(t *testing.T) {
+	container := v1.Container{
+		Name:          "test",
+		Lifecycle:     &v1.Lifecycle{PreStop: &v1.LifecycleHandler{Exec: &v1.ExecAction{Command: []string{"sleep", "3600"}}}},
+		LivenessProbe: &v1.Probe{ProbeHandler: v1.ProbeHandler{Exec: &v1.ExecAction{Command: []string{"true"}}}},
+	}
+
+	profile := defaultProfile()
+	if err := checkContainerHooks(&container, field.NewPath("container"), &profile); err != nil {
+		t.Fatalf("Hooks must be allowed by default: %v", err)
+	}
+
+	profile.Limits.ForbidLifecycleHooks = true
+	if err := checkContainerHooks(&container, field.NewPath("container"), &profile); err == nil {
+		t.Fatalf("Lifecycle hook was allowed")
+	}
+
+	profile.Limits.ForbidLifecycleHooks = false
+	profile.Limits.ForbidExecProbes = true
+	if err := checkContainerHooks(&container, field.NewPath("container"), &profile); err == nil {
+		t.Fatalf("Exec probe was allowed")
+	}
+}
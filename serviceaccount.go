@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const defaultServiceAccount = "default"
+
+// checkServiceAccount requires an allowed service account, and when the profile forbids it,
+// that its token is not mounted either from the pod spec or the service account settings.
+// path is the path of the spec
+func checkServiceAccount(spec *v1.PodSpec, path *field.Path, namespace string, profile *Profile, cluster *Cluster) error {
+	name := spec.ServiceAccountName
+	if name == "" {
+		name = defaultServiceAccount
+	}
+	if !contains(profile.ServiceAccounts.Allowed, name) {
+		return field.Forbidden(path.Child("serviceAccountName"), fmt.Sprintf("serviceAccountName %v is not allowed", name))
+	}
+
+	if !profile.ServiceAccounts.ForbidTokenAutomount {
+		return nil
+	}
+	if spec.AutomountServiceAccountToken != nil {
+		if *spec.AutomountServiceAccountToken {
+			return field.Forbidden(path.Child("automountServiceAccountToken"), "automountServiceAccountToken must be false")
+		}
+		return nil
+	}
+
+	// The pod inherits the setting of the service account, which can only be checked with the cluster lookups
+	serviceAccount, err := cluster.ServiceAccount(namespace, name)
+	if errors.Is(err, errLookupDisabled) {
+		return nil
+	}
+	if err != nil {
+		return field.Required(path.Child("automountServiceAccountToken"), fmt.Sprintf("automountServiceAccountToken must be false, can't read service account %v: %v", name, err))
+	}
+	if serviceAccount.AutomountServiceAccountToken == nil || *serviceAccount.AutomountServiceAccountToken {
+		return field.Required(path.Child("automountServiceAccountToken"), fmt.Sprintf("automountServiceAccountToken must be false in the pod or in service account %v", name))
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func serviceAccountCluster(t *testing.T, serviceAccounts ...*v1.ServiceAccount) *Cluster {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, serviceAccount := range serviceAccounts {
+		if err := indexer.Add(serviceAccount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &Cluster{ServiceAccounts: corelisters.NewServiceAccountLister(indexer)}
+}
+
+func TestServiceAccount(t *testing.T) {
+	enabled, disabled := true, false
+	cluster := serviceAccountCluster(t,
+		&v1.ServiceAccount{ObjectMeta: k8meta.ObjectMeta{Name: "default", Namespace: "default"}},
+		&v1.ServiceAccount{ObjectMeta: k8meta.ObjectMeta{Name: "scoped", Namespace: "default"}, AutomountServiceAccountToken: &disabled},
+	)
+	profile := defaultProfile()
+	profile.ServiceAccounts = ServiceAccountPolicy{Allowed: []string{"default", "scoped"}, ForbidTokenAutomount: true}
+
+	cases := map[string]struct {
+		spec    v1.PodSpec
+		allowed bool
+		// Defaults to the cluster with both service accounts
+		cluster *Cluster
+	}{
+		"podDisabled":       {spec: v1.PodSpec{AutomountServiceAccountToken: &disabled}, allowed: true},
+		"podEnabled":        {spec: v1.PodSpec{AutomountServiceAccountToken: &enabled}, allowed: false},
+		"inheritedEnabled":  {spec: v1.PodSpec{}, allowed: false},
+		"inheritedDisabled": {spec: v1.PodSpec{ServiceAccountName: "scoped"}, allowed: true},
+		"notAllowed":        {spec: v1.PodSpec{ServiceAccountName: "admin", AutomountServiceAccountToken: &disabled}, allowed: false},
+		"missing":           {spec: v1.PodSpec{ServiceAccountName: "scoped"}, allowed: false, cluster: serviceAccountCluster(t)},
+		// Only the lookup is skipped without the cluster
+		"noLookups":           {spec: v1.PodSpec{}, allowed: true, cluster: &Cluster{}},
+		"noLookupsPodEnabled": {spec: v1.PodSpec{AutomountServiceAccountToken: &enabled}, allowed: false, cluster: &Cluster{}},
+		"noLookupsNotAllowed": {spec: v1.PodSpec{ServiceAccountName: "admin"}, allowed: false, cluster: &Cluster{}},
+	}
+
+	for key, val := range cases {
+		testCluster := cluster
+		if val.cluster != nil {
+			testCluster = val.cluster
+		}
+		err := checkServiceAccount(&val.spec, field.NewPath("spec"), "default", &profile, testCluster)
+		if val.allowed && err != nil {
+			t.Errorf("Valid service account `%v` was denied: %v", key, err)
+		}
+		if !val.allowed && err == nil {
+			t.Errorf("Invalid service account `%v` was allowed", key)
+		}
+	}
+
+	profile = defaultProfile()
+	if err := checkServiceAccount(&v1.PodSpec{}, field.NewPath("spec"), "default", &profile, nil); err != nil {
+		t.Errorf("Token automount must be allowed by default: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Sysctls considered safe by Kubernetes, they are namespaced and isolated between pods
+var safeSysctls = []string{
+	"kernel.shm_rmid_forced",
+	"net.ipv4.ip_local_port_range",
+	"net.ipv4.ip_unprivileged_port_start",
+	"net.ipv4.tcp_syncookies",
+	"net.ipv4.ping_group_range",
+	"net.ipv4.ip_local_reserved_ports",
+	"net.ipv4.tcp_keepalive_time",
+	"net.ipv4.tcp_fin_timeout",
+	"net.ipv4.tcp_keepalive_intvl",
+	"net.ipv4.tcp_keepalive_probes",
+	"net.ipv4.tcp_rmem",
+	"net.ipv4.tcp_wmem",
+}
+
+// normalizeSysctl converts the slash separated form (net/ipv4/tcp_syncookies) to the dotted form
+func normalizeSysctl(name string) string {
+	return strings.ReplaceAll(name, "/", ".")
+}
+
+// compile normalizes the sysctl names of the policy and compiles the value constraints, anchored
+// so they match the whole value
+func (policy *SysctlPolicy) compile() error {
+	for i, name := range policy.Allowed {
+		policy.Allowed[i] = normalizeSysctl(name)
+	}
+	values := map[string]string{}
+	policy.values = map[string]*regexp.Regexp{}
+	for sysctl, constraint := range policy.Values {
+		name := normalizeSysctl(sysctl)
+		if _, ok := values[name]; ok {
+			return fmt.Errorf("value constraint of sysctl %v is set twice", name)
+		}
+		regex, err := regexp.Compile("^(?:" + constraint + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid value constraint of sysctl %v: %v", sysctl, err)
+		}
+		values[name], policy.values[name] = constraint, regex
+	}
+	policy.Values = values
+	return nil
+}
+
+// checkSysctls requires every sysctl to be allowed, and its value to match the constraint if set.
+// path is the path of the sysctls
+func checkSysctls(sysctls []v1.Sysctl, path *field.Path, profile *Profile) error {
+	for i, sysctl := range sysctls {
+		name := normalizeSysctl(sysctl.Name)
+		if !contains(profile.Sysctls.Allowed, name) {
+			return field.Forbidden(path.Index(i).Child("name"), fmt.Sprintf("sysctl %v is not allowed", sysctl.Name))
+		}
+		if regex, ok := profile.Sysctls.values[name]; ok && !regex.MatchString(sysctl.Value) {
+			return field.Forbidden(path.Index(i).Child("value"), fmt.Sprintf("value of sysctl %v must match %v", sysctl.Name, profile.Sysctls.Values[name]))
+		}
+	}
+	return nil
+}
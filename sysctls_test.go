@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+func TestSysctls(t *testing.T) {
+	profile := defaultProfile()
+	profile.Sysctls.Values = map[string]string{"net/ipv4/ip_unprivileged_port_start": "80|1024", "net.ipv4.tcp_syncookies": "1"}
+	if err := profile.Sysctls.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]struct {
+		sysctl  v1.Sysctl
+		allowed bool
+	}{
+		"safe":             {v1.Sysctl{Name: "net.ipv4.ip_local_port_range", Value: "1024 65535"}, true},
+		"slashes":          {v1.Sysctl{Name: "net/ipv4/tcp_syncookies", Value: "1"}, true},
+		"constraint":       {v1.Sysctl{Name: "net.ipv4.ip_unprivileged_port_start", Value: "80"}, true},
+		"constraintFailed": {v1.Sysctl{Name: "net.ipv4.ip_unprivileged_port_start", Value: "0"}, false},
+		"partialMatch":     {v1.Sysctl{Name: "net.ipv4.ip_unprivileged_port_start", Value: "8080"}, false},
+		"slashConstraint":  {v1.Sysctl{Name: "net/ipv4/tcp_syncookies", Value: "0"}, false},
+		"unsafe":           {v1.Sysctl{Name: "kernel.msgmax", Value: "65536"}, false},
+		"empty":            {v1.Sysctl{}, false},
+	}
+
+	for key, val := range cases {
+		err := checkSysctls([]v1.Sysctl{val.sysctl}, field.NewPath("sysctls"), &profile)
+		if val.allowed && err != nil {
+			t.Errorf("Valid sysctl `%v` was denied: %v", key, err)
+		}
+		if !val.allowed && err == nil {
+			t.Errorf("Invalid sysctl `%v` was allowed", key)
+		}
+	}
+}
+
+func TestSysctlConstraints(t *testing.T) {
+	invalid := map[string]map[string]string{
+		"regex":     {"net.ipv4.tcp_syncookies": "("},
+		"duplicate": {"net.ipv4.tcp_syncookies": "1", "net/ipv4/tcp_syncookies": "0"},
+	}
+	for key, values := range invalid {
+		policy := SysctlPolicy{Values: values}
+		if err := policy.compile(); err == nil {
+			t.Errorf("Invalid constraints `%v` were accepted", key)
+		}
+	}
+}
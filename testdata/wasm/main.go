@@ -0,0 +1,74 @@
+//go:build wasip1
+
+// Test module of the WASM ABI, built with
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o labels.wasm ./testdata/wasm
+//
+// It denies objects with the label wasm-deny and warns when the label owner is missing.
+// The labels wasm-loop and wasm-oom make it exceed the time and memory limits.
+package main
+
+import (
+	"encoding/json"
+	"unsafe"
+)
+
+type input struct {
+	Object struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	} `json:"object"`
+}
+
+type violation struct {
+	Message  string `json:"message"`
+	Field    string `json:"field,omitempty"`
+	Severity string `json:"severity,omitempty"`
+}
+
+// Buffers shared with the host, referenced so the garbage collector keeps them
+var buffers = map[uint32][]byte{}
+
+//go:wasmexport allocate
+func allocate(size uint32) uint32 {
+	buffer := make([]byte, size)
+	pointer := uint32(uintptr(unsafe.Pointer(unsafe.SliceData(buffer))))
+	buffers[pointer] = buffer
+	return pointer
+}
+
+//go:wasmexport validate
+func validate(pointer, size uint32) uint64 {
+	var object input
+	if err := json.Unmarshal(buffers[pointer][:size], &object); err != nil {
+		panic(err)
+	}
+	labels := object.Object.Metadata.Labels
+
+	if _, ok := labels["wasm-loop"]; ok {
+		for {
+		}
+	}
+	if _, ok := labels["wasm-oom"]; ok {
+		buffers[0] = make([]byte, 1<<30)
+	}
+
+	violations := []violation{}
+	if value, ok := labels["wasm-deny"]; ok {
+		violations = append(violations, violation{Message: "denied by the module: " + value, Field: "metadata.labels[wasm-deny]"})
+	}
+	if _, ok := labels["owner"]; !ok {
+		violations = append(violations, violation{Message: "owner label is missing", Severity: "warn"})
+	}
+	if len(violations) == 0 {
+		return 0
+	}
+
+	output, _ := json.Marshal(map[string]interface{}{"violations": violations})
+	result := allocate(uint32(len(output)))
+	copy(buffers[result], output)
+	return uint64(result)<<32 | uint64(len(output))
+}
+
+func main() {}
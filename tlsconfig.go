@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strings"
+)
+
+var tlsVersionNames = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurveNames = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+}
+
+// TLSOptions restricts the TLS parameters negotiated by the server. Empty values keep the Go defaults
+type TLSOptions struct {
+	// Versions, 1.0 to 1.3
+	MinVersion, MaxVersion string
+	// Names of the TLS 1.2 cipher suites, e.g. TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. TLS 1.3 suites
+	// can't be configured
+	CipherSuites []string
+	// Key exchange groups, one of X25519, X25519MLKEM768, P-256, P-384 or P-521
+	Curves []string
+	// Log the negotiated parameters of every connection
+	LogConnections bool
+}
+
+// apply sets the options in the config, rejecting combinations that no client could negotiate.
+// It must be called after the certificates are configured, the cipher suites are checked against them
+func (options TLSOptions) apply(config *tls.Config) error {
+	minVersion, maxVersion := uint16(tls.VersionTLS12), uint16(tls.VersionTLS13)
+	if options.MinVersion != "" {
+		version, ok := tlsVersionNames[options.MinVersion]
+		if !ok {
+			return fmt.Errorf("unknown TLS version %v, must be 1.0, 1.1, 1.2 or 1.3", options.MinVersion)
+		}
+		minVersion = version
+	}
+	if options.MaxVersion != "" {
+		version, ok := tlsVersionNames[options.MaxVersion]
+		if !ok {
+			return fmt.Errorf("unknown TLS version %v, must be 1.0, 1.1, 1.2 or 1.3", options.MaxVersion)
+		}
+		maxVersion = version
+	}
+	if minVersion > maxVersion {
+		return fmt.Errorf("minimum TLS version %v is greater than the maximum %v", tls.VersionName(minVersion), tls.VersionName(maxVersion))
+	}
+	config.MinVersion, config.MaxVersion = minVersion, maxVersion
+
+	if len(options.CipherSuites) > 0 {
+		if minVersion == tls.VersionTLS13 {
+			return fmt.Errorf("cipher suites can't be configured for TLS 1.3")
+		}
+		suites := map[string]*tls.CipherSuite{}
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite
+		}
+		config.CipherSuites = nil
+		http2, keyMatch := false, false
+		keyType, err := certificateKeyType(config)
+		if err != nil {
+			return err
+		}
+		for _, name := range options.CipherSuites {
+			suite, ok := suites[name]
+			if !ok {
+				return fmt.Errorf("unknown or insecure cipher suite %v", name)
+			}
+			if len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13 {
+				return fmt.Errorf("cipher suite %v is a TLS 1.3 suite, they can't be configured", name)
+			}
+			if !supportsVersion(suite, minVersion, maxVersion) {
+				return fmt.Errorf("cipher suite %v can't be used with %v to %v", name, tls.VersionName(minVersion), tls.VersionName(maxVersion))
+			}
+			config.CipherSuites = append(config.CipherSuites, suite.ID)
+			if suite.ID == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || suite.ID == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+				http2 = true
+			}
+			if keyType == "" || strings.Contains(name, keyType) {
+				keyMatch = true
+			}
+		}
+		// The apiserver connects with HTTP/2, the server fails to start without these suites
+		if !http2 {
+			return fmt.Errorf("cipher suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, required by HTTP/2")
+		}
+		if !keyMatch {
+			return fmt.Errorf("no cipher suite can be used with the %v key of the certificate", strings.Trim(keyType, "_"))
+		}
+	}
+
+	if len(options.Curves) > 0 {
+		config.CurvePreferences = nil
+		classic := false
+		for _, name := range options.Curves {
+			curve, ok := tlsCurveNames[name]
+			if !ok {
+				return fmt.Errorf("unknown curve %v", name)
+			}
+			config.CurvePreferences = append(config.CurvePreferences, curve)
+			if curve != tls.X25519MLKEM768 {
+				classic = true
+			}
+		}
+		// Post-quantum key exchanges are only supported by TLS 1.3
+		if !classic && minVersion < tls.VersionTLS13 {
+			return fmt.Errorf("TLS 1.2 needs at least a curve other than X25519MLKEM768")
+		}
+	}
+
+	if !options.LogConnections {
+		return nil
+	}
+	verify := config.VerifyConnection
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		log.Printf("Negotiated %v with %v and %v", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.CurveID)
+		return nil
+	}
+	return nil
+}
+
+// String describes the configured parameters, for the startup log
+func (options TLSOptions) String() string {
+	value := func(values []string) string {
+		if len(values) == 0 {
+			return "default"
+		}
+		return strings.Join(values, ",")
+	}
+	minVersion, maxVersion := options.MinVersion, options.MaxVersion
+	if minVersion == "" {
+		minVersion = "1.2"
+	}
+	if maxVersion == "" {
+		maxVersion = "1.3"
+	}
+	return fmt.Sprintf("TLS %v to %v, cipher suites %v, curves %v", minVersion, maxVersion, value(options.CipherSuites), value(options.Curves))
+}
+
+func supportsVersion(suite *tls.CipherSuite, minVersion, maxVersion uint16) bool {
+	for _, version := range suite.SupportedVersions {
+		if version >= minVersion && version <= maxVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateKeyType returns the part of the cipher suite names that matches the key of the serving
+// certificate, ECDSA suites are also used by Ed25519 keys. Empty when it can't be known
+func certificateKeyType(config *tls.Config) (string, error) {
+	var cert *tls.Certificate
+	if len(config.Certificates) > 0 {
+		cert = &config.Certificates[0]
+	} else if config.GetCertificate != nil {
+		var err error
+		if cert, err = config.GetCertificate(&tls.ClientHelloInfo{}); err != nil {
+			return "", err
+		}
+	}
+	if cert == nil {
+		return "", nil
+	}
+	switch cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return "_RSA_", nil
+	case *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return "_ECDSA_", nil
+	}
+	return "", nil
+}
+
+// splitList splits a comma separated flag, ignoring empty values
+func splitList(value string) []string {
+	values := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testServerCertificate(t *testing.T, keyType string) (tls.Certificate, *x509.CertPool) {
+	ca, err := newCA("server-ca", time.Hour, keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.issue([]string{"127.0.0.1"}, time.Hour, keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.certPEM)
+	return cert, roots
+}
+
+func TestTLSOptions(t *testing.T) {
+	cert, roots := testServerCertificate(t, KeyECDSAP256)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	server.EnableHTTP2 = true
+	options := TLSOptions{
+		MinVersion:     "1.2",
+		MaxVersion:     "1.2",
+		CipherSuites:   []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+		Curves:         []string{"P-384"},
+		LogConnections: true,
+	}
+	if err := options.apply(server.TLS); err != nil {
+		t.Fatal(err)
+	}
+	if server.TLS.VerifyConnection == nil {
+		t.Fatalf("Connections must be logged when enabled")
+	}
+	quiet := &tls.Config{}
+	if err := (TLSOptions{}).apply(quiet); err != nil || quiet.VerifyConnection != nil {
+		t.Fatalf("Connections must not be logged by default: %v", err)
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		client   *tls.Config
+		expected uint16
+	}{
+		{"defaults", &tls.Config{}, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		{"suite", &tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}}, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+		{"other suite", &tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}}, 0},
+		{"TLS 1.3", &tls.Config{MinVersion: tls.VersionTLS13}, 0},
+		{"other curve", &tls.Config{CurvePreferences: []tls.CurveID{tls.X25519}}, 0},
+	}
+	for _, test := range tests {
+		test.client.RootCAs = roots
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), test.client)
+		if test.expected == 0 {
+			if err == nil {
+				conn.Close()
+				t.Errorf("%v: handshake must fail", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", test.name, err)
+			continue
+		}
+		state := conn.ConnectionState()
+		conn.Close()
+		if state.Version != tls.VersionTLS12 || state.CipherSuite != test.expected || state.CurveID != tls.CurveP384 {
+			t.Errorf("%v: unexpected %v with %v and %v", test.name, tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite), state.CurveID)
+		}
+	}
+}
+
+func TestTLSOptionsInvalid(t *testing.T) {
+	ecdsaCert, _ := testServerCertificate(t, KeyECDSAP256)
+	rsaCert, _ := testServerCertificate(t, KeyRSA2048)
+	tests := []struct {
+		name    string
+		options TLSOptions
+		cert    tls.Certificate
+	}{
+		{"version", TLSOptions{MinVersion: "1.4"}, ecdsaCert},
+		{"min over max", TLSOptions{MinVersion: "1.3", MaxVersion: "1.2"}, ecdsaCert},
+		{"unknown suite", TLSOptions{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_FAKE"}}, ecdsaCert},
+		{"insecure suite", TLSOptions{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA"}}, ecdsaCert},
+		{"suites with TLS 1.3", TLSOptions{MinVersion: "1.3", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}, ecdsaCert},
+		{"TLS 1.3 suite", TLSOptions{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_AES_128_GCM_SHA256"}}, ecdsaCert},
+		{"suite version", TLSOptions{MinVersion: "1.0", MaxVersion: "1.1", CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}, ecdsaCert},
+		{"http2", TLSOptions{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"}}, ecdsaCert},
+		{"key type", TLSOptions{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}}, rsaCert},
+		{"unknown curve", TLSOptions{Curves: []string{"P-192"}}, ecdsaCert},
+		{"post-quantum with TLS 1.2", TLSOptions{Curves: []string{"X25519MLKEM768"}}, ecdsaCert},
+	}
+	for _, test := range tests {
+		if err := test.options.apply(&tls.Config{Certificates: []tls.Certificate{test.cert}}); err == nil {
+			t.Errorf("%v: invalid options were accepted", test.name)
+		}
+	}
+
+	valid := []TLSOptions{
+		{},
+		{MinVersion: "1.3"},
+		{MinVersion: "1.3", Curves: []string{"X25519MLKEM768"}},
+		{CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+	}
+	for _, options := range valid {
+		if err := options.apply(&tls.Config{Certificates: []tls.Certificate{rsaCert}}); err != nil {
+			t.Errorf("%v: %v", options, err)
+		}
+	}
+}
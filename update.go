@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	admission "k8s.io/api/admission/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// Fields that change on every update and never affect the checks
+var ignoredFields = map[string]bool{
+	"metadata.managedFields":     true,
+	"metadata.resourceVersion":   true,
+	"metadata.generation":        true,
+	"metadata.creationTimestamp": true,
+	"status":                     true,
+}
+
+// fieldChange is a field that differs between the old and the new object, the path
+// elements are map keys (string) or array indexes (int)
+type fieldChange struct {
+	path     []interface{}
+	old, new interface{}
+}
+
+func (change *fieldChange) fieldPath() *field.Path {
+	var path *field.Path
+	for _, element := range change.path {
+		switch element := element.(type) {
+		case string:
+			if path == nil {
+				path = field.NewPath(element)
+			} else {
+				path = path.Child(element)
+			}
+		case int:
+			path = path.Index(element)
+		}
+	}
+	return path
+}
+
+// String describes the change, only numbers and booleans are printed as strings may contain secrets
+func (change *fieldChange) String() string {
+	switch change.new.(type) {
+	case float64, bool:
+		old := change.old
+		if old == nil {
+			old = "unset"
+		}
+		return fmt.Sprintf("%v changed from %v to %v", change.fieldPath(), old, change.new)
+	}
+	return fmt.Sprintf("%v changed", change.fieldPath())
+}
+
+// checkUpdate is called when the new object of an update is denied with err. Updates that
+// don't change the spec of a job that was already denied are allowed when they don't add
+// violations, so jobs admitted before a policy change can still be updated by controllers.
+// Otherwise it looks for the changed field that causes the denial.
+func checkUpdate(ctx context.Context, request *admission.AdmissionRequest, job *batchv1.Job, handler *AdmissionHandler, err error) (bool, error) {
+	old, parseErr := parseJob(request.OldObject.Raw, request.Namespace)
+	if parseErr != nil {
+		return false, err
+	}
+	if allowed, _, _ := validateJob(ctx, old, handler); !allowed {
+		if !reflect.DeepEqual(old.Spec, job.Spec) {
+			return false, err
+		}
+		// Metadata changes, e.g. an annotation with a credential, can add violations
+		oldDenials, newDenials := jobDenials(ctx, old, handler), jobDenials(ctx, job, handler)
+		for _, rule := range registry {
+			denial, previous := newDenials[rule.ID()], oldDenials[rule.ID()]
+			if denial != nil && (previous == nil || previous.Error() != denial.Error()) {
+				return false, denial
+			}
+		}
+		return true, nil
+	}
+
+	var oldJob, newJob interface{}
+	if json.Unmarshal(request.OldObject.Raw, &oldJob) != nil || json.Unmarshal(request.Object.Raw, &newJob) != nil {
+		return false, err
+	}
+	for _, change := range changedFields(oldJob, newJob, nil) {
+		candidate, applyErr := applyChange(oldJob, change)
+		if applyErr != nil {
+			continue
+		}
+		candidateJob, parseErr := parseJob(candidate, request.Namespace)
+		if parseErr != nil {
+			continue
+		}
+		if allowed, _, candidateErr := validateJob(ctx, candidateJob, handler); !allowed {
+			return false, fmt.Errorf("%v: %v", change.String(), candidateErr)
+		}
+	}
+	return false, err
+}
+
+// jobDenials returns the violation that denies the job, by rule ID
+func jobDenials(ctx context.Context, job *batchv1.Job, handler *AdmissionHandler) map[string]error {
+	object, profile := jobObject(job, handler), handler.profile(job.Namespace)
+	denials := map[string]error{}
+	for _, rule := range registry {
+		if allowed, _, err := evaluateRules(ctx, []Rule{rule}, object, profile, nil); !allowed {
+			denials[rule.ID()] = err
+		}
+	}
+	return denials
+}
+
+// changedFields returns the fields that differ between the decoded JSON objects. Arrays are
+// compared by index when both have the same length, otherwise the whole array is a change.
+func changedFields(old, new interface{}, path []interface{}) []fieldChange {
+	if reflect.DeepEqual(old, new) {
+		return nil
+	}
+	child := func(element interface{}) []interface{} {
+		return append(append([]interface{}{}, path...), element)
+	}
+
+	switch new := new.(type) {
+	case map[string]interface{}:
+		old, ok := old.(map[string]interface{})
+		if !ok {
+			break
+		}
+		changes := []fieldChange{}
+		for _, key := range mergeKeys(old, new) {
+			childPath := child(key)
+			if ignoredFields[(&fieldChange{path: childPath}).fieldPath().String()] {
+				continue
+			}
+			changes = append(changes, changedFields(old[key], new[key], childPath)...)
+		}
+		return changes
+	case []interface{}:
+		old, ok := old.([]interface{})
+		if !ok || len(old) != len(new) {
+			break
+		}
+		changes := []fieldChange{}
+		for i := range new {
+			changes = append(changes, changedFields(old[i], new[i], child(i))...)
+		}
+		return changes
+	}
+	return []fieldChange{{path: path, old: old, new: new}}
+}
+
+// mergeKeys returns the keys of the maps, sorted so the reported field is deterministic
+func mergeKeys(maps ...map[string]interface{}) []string {
+	seen := map[string]bool{}
+	keys := []string{}
+	for _, values := range maps {
+		for key := range values {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// applyChange returns the JSON of the object with only the change applied
+func applyChange(object interface{}, change fieldChange) ([]byte, error) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		return nil, err
+	}
+	var copy interface{}
+	if err := json.Unmarshal(data, &copy); err != nil {
+		return nil, err
+	}
+	if len(change.path) == 0 {
+		return json.Marshal(change.new)
+	}
+
+	parent := copy
+	for _, element := range change.path[:len(change.path)-1] {
+		switch values := parent.(type) {
+		case map[string]interface{}:
+			parent = values[element.(string)]
+		case []interface{}:
+			parent = values[element.(int)]
+		default:
+			return nil, fmt.Errorf("%v is not in the object", change.fieldPath())
+		}
+	}
+	switch values := parent.(type) {
+	case map[string]interface{}:
+		last := change.path[len(change.path)-1].(string)
+		if change.new == nil {
+			delete(values, last)
+		} else {
+			values[last] = change.new
+		}
+	case []interface{}:
+		values[change.path[len(change.path)-1].(int)] = change.new
+	default:
+		return nil, fmt.Errorf("%v is not in the object", change.fieldPath())
+	}
+	return json.Marshal(copy)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	admission "k8s.io/api/admission/v1beta1"
+	batchv1 "k8s.io/api/batch/v1"
+)
+
+func updateRequest(t *testing.T, old func(*batchv1.Job), new func(*batchv1.Job)) admission.AdmissionReview {
+	review := loadValidJob(t)
+	review.Request.Operation = admission.Update
+
+	job := loadJob(t, review)
+	old(job)
+	saveJob(t, review, job)
+	review.Request.OldObject.Raw = review.Request.Object.Raw
+
+	job = loadJob(t, review)
+	new(job)
+	saveJob(t, review, job)
+	return review
+}
+
+func TestUpdate(t *testing.T) {
+	unchanged := func(job *batchv1.Job) {}
+	parallelism := func(job *batchv1.Job) { *job.Spec.Parallelism = 50 }
+	label := func(job *batchv1.Job) { job.Labels = map[string]string{"updated": "true"} }
+
+	response := sendRequest(t, updateRequest(t, unchanged, label))
+	if !response.Response.Allowed {
+		t.Fatalf("Compliant update was denied, %v", response.Response.Result.Message)
+	}
+
+	response = sendRequest(t, updateRequest(t, unchanged, parallelism))
+	if response.Response.Allowed {
+		t.Fatalf("Update of parallelism was allowed")
+	}
+	if message := response.Response.Result.Message; !strings.HasPrefix(message, "spec.parallelism changed from 1 to 50:") {
+		t.Fatalf("Denial must report the changed field, got %v", message)
+	}
+
+	response = sendRequest(t, updateRequest(t, unchanged, func(job *batchv1.Job) {
+		label(job)
+		job.Spec.Template.Spec.Containers[0].Env[0].Name = "LD_PRELOAD"
+	}))
+	if message := response.Response.Result.Message; response.Response.Allowed || !strings.HasPrefix(message, "spec.template.spec.containers[0].env[0].name changed:") {
+		t.Fatalf("Denial must report the changed env, got %v", message)
+	}
+
+	// Jobs admitted before a policy change can still be updated without changing their spec
+	response = sendRequest(t, updateRequest(t, parallelism, func(job *batchv1.Job) {
+		parallelism(job)
+		label(job)
+	}))
+	if !response.Response.Allowed {
+		t.Fatalf("Metadata update of a non-compliant job was denied, %v", response.Response.Result.Message)
+	}
+
+	response = sendRequest(t, updateRequest(t, parallelism, func(job *batchv1.Job) { *job.Spec.Parallelism = 60 }))
+	if response.Response.Allowed {
+		t.Fatalf("Spec update of a non-compliant job was allowed")
+	}
+}
+
+func TestUpdateMetadataViolation(t *testing.T) {
+	profile := defaultProfile()
+	profile.RuntimeClass = "gvisor"
+	profile.Metadata.Labels = []MetadataRule{{Key: "team", Values: []string{"ml"}}}
+	profile.SecretScan.Mode = ScanDeny
+	policy := &Policy{DefaultProfile: "team", Profiles: map[string]*Profile{"team": &profile}}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	handler := &AdmissionHandler{RuntimeClass: "gvisor", Policy: policy}
+	// Non-compliant spec, admitted before the policy change
+	parallelism := func(job *batchv1.Job) {
+		*job.Spec.Parallelism = 50
+		job.Labels = map[string]string{"team": "ml"}
+		job.Spec.Template.Labels["team"] = "ml"
+	}
+
+	tests := []struct {
+		name    string
+		new     func(job *batchv1.Job)
+		allowed bool
+		message string
+	}{
+		{name: "unrelated label", new: func(job *batchv1.Job) { job.Labels["updated"] = "true" }, allowed: true},
+		{name: "removed label", new: func(job *batchv1.Job) { delete(job.Labels, "team") }, message: "label team"},
+		{name: "invalid label", new: func(job *batchv1.Job) { job.Labels["team"] = "other" }, message: "label team"},
+		{name: "credential", new: func(job *batchv1.Job) { job.Annotations["token"] = testJWT }, message: "metadata.annotations"},
+	}
+	for _, test := range tests {
+		review := updateRequest(t, parallelism, func(job *batchv1.Job) {
+			parallelism(job)
+			test.new(job)
+		})
+		allowed, _, err := checkRequest(context.Background(), review.Request, handler)
+		if allowed != test.allowed {
+			t.Errorf("%v: expected allowed %v, got %v", test.name, test.allowed, err)
+		}
+		if !test.allowed && err != nil && !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%v: denial must report %v, got %v", test.name, test.message, err)
+		}
+	}
+}
+
+func TestChangedFields(t *testing.T) {
+	old := map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": "1", "name": "job"},
+		"spec":     map[string]interface{}{"parallelism": 1.0, "list": []interface{}{"a", "b"}},
+	}
+	new := map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": "2", "name": "job"},
+		"spec":     map[string]interface{}{"parallelism": 2.0, "list": []interface{}{"a", "c"}, "suspend": true},
+	}
+
+	// Keys are sorted, so the first denied field is always the same
+	paths := []string{}
+	for _, change := range changedFields(old, new, nil) {
+		paths = append(paths, change.fieldPath().String())
+	}
+	if strings.Join(paths, ",") != "spec.list[1],spec.parallelism,spec.suspend" {
+		t.Fatalf("Unexpected changed fields %v", paths)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	v1 "k8s.io/api/core/v1"
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// Variables of the exported policies, every matched kind has its pod template at spec.template
+var vapVariables = []admissionregistrationv1.Variable{
+	{Name: "spec", Expression: "object.spec.template.spec"},
+	{Name: "allContainers", Expression: "variables.spec.containers + (has(variables.spec.initContainers) ? variables.spec.initContainers : [])"},
+}
+
+// vapTranslation expresses a built-in rule as ValidatingAdmissionPolicy validations
+type vapTranslation struct {
+	// The rule only applies to jobs
+	jobOnly bool
+	// translate returns the validations enforcing the profile, and an error describing the
+	// settings that can't be expressed in CEL, e.g. because they need cluster lookups
+	translate func(profile *Profile) ([]admissionregistrationv1.Validation, error)
+}
+
+// vapTranslations are the built-in rules that can be exported, by rule ID
+var vapTranslations = map[string]vapTranslation{
+	GroupJob + ".activeDeadline": {jobOnly: true, translate: vapStatic("has(object.spec.activeDeadlineSeconds) && object.spec.activeDeadlineSeconds > 0", "activeDeadlineSeconds must be set")},
+	GroupJob + ".restartPolicy":  {jobOnly: true, translate: vapStatic("has(variables.spec.restartPolicy) && variables.spec.restartPolicy == 'Never'", "Job is not allowed to restart")},
+	GroupRuntime + ".runtimeClass": {translate: func(profile *Profile) ([]admissionregistrationv1.Validation, error) {
+		return vapValidations(fmt.Sprintf("has(variables.spec.runtimeClassName) && variables.spec.runtimeClassName == %v", strconv.Quote(profile.RuntimeClass)),
+			fmt.Sprintf("RuntimeClass must be %v", profile.RuntimeClass)), nil
+	}},
+	GroupHost + ".network":          {translate: vapStatic("!has(variables.spec.hostNetwork) || !variables.spec.hostNetwork", "HostNetwork must not be set")},
+	GroupHost + ".ipc":              {translate: vapStatic("!has(variables.spec.hostIPC) || !variables.spec.hostIPC", "HostIPC must be false")},
+	GroupHost + ".pid":              {translate: vapStatic("!has(variables.spec.hostPID) || !variables.spec.hostPID", "HostPID must be false")},
+	GroupPod + ".fields":            {translate: vapPodFields},
+	GroupPod + ".priority":          {translate: vapPriority},
+	GroupPod + ".sysctls":           {translate: vapSysctls},
+	GroupLimits + ".containers":     {translate: vapLimits},
+	GroupLimits + ".initContainers": {translate: vapInitContainerLimits},
+	GroupLimits + ".terminationGracePeriod": {translate: func(profile *Profile) ([]admissionregistrationv1.Validation, error) {
+		return vapValidations(fmt.Sprintf("!has(variables.spec.terminationGracePeriodSeconds) || variables.spec.terminationGracePeriodSeconds <= %v", profile.Limits.MaxTerminationGracePeriodSeconds),
+			fmt.Sprintf("terminationGracePeriodSeconds must not be greater than %v", profile.Limits.MaxTerminationGracePeriodSeconds)), nil
+	}},
+	GroupLimits + ".hooks":                             {translate: vapHooks},
+	GroupVolumes + ".volumes":                          {translate: vapStatic("!has(variables.spec.volumes) || size(variables.spec.volumes) == 0", "Volumes are not supported")},
+	GroupVolumes + ".devices":                          {translate: vapStatic("variables.allContainers.all(c, !has(c.volumeDevices) || size(c.volumeDevices) == 0)", "VolumeDevices are not supported")},
+	GroupVolumes + ".mounts":                           {translate: vapStatic("variables.allContainers.all(c, !has(c.volumeMounts) || size(c.volumeMounts) == 0)", "VolumeMounts are not supported")},
+	GroupSecurityContext + ".required":                 {translate: vapStatic("variables.allContainers.all(c, has(c.securityContext))", "SecurityContext must be set for the container")},
+	GroupSecurityContext + ".runAsNonRoot":             {translate: vapStatic("variables.allContainers.all(c, !has(c.securityContext) || has(c.securityContext.runAsNonRoot) && c.securityContext.runAsNonRoot)", "RunAsNonRoot must be set per container")},
+	GroupSecurityContext + ".allowPrivilegeEscalation": {translate: vapStatic("variables.allContainers.all(c, !has(c.securityContext) || has(c.securityContext.allowPrivilegeEscalation) && !c.securityContext.allowPrivilegeEscalation)", "AllowPrivilegeEscalation must be false per container")},
+	GroupSecurityContext + ".privileged":               {translate: vapStatic("variables.allContainers.all(c, !has(c.securityContext) || has(c.securityContext.privileged) && !c.securityContext.privileged)", "Privileged must be false per container")},
+	GroupSecurityContext + ".capabilities":             {translate: vapCapabilities},
+	GroupPorts + ".containerPorts":                     {translate: vapStatic("variables.allContainers.all(c, !has(c.ports) || size(c.ports) == 0)", "No port must be defined")},
+	GroupResources + ".cpu":                            {translate: vapResource("cpu", "CPU")},
+	GroupResources + ".memory":                         {translate: vapResource("memory", "Memory")},
+}
+
+// vapKind is a kind matched by the exported policies
+type vapKind struct {
+	group, version, kind, resource string
+	// Rule groups validated in the kind, empty validates every group
+	ruleGroups []string
+}
+
+// applies returns if the rule runs against the kind in the webhook
+func (kind *vapKind) applies(id string, translation vapTranslation) bool {
+	if kind.kind == "Job" && kind.group == "batch" {
+		return true
+	}
+	return !translation.jobOnly && (len(kind.ruleGroups) == 0 || contains(kind.ruleGroups, strings.SplitN(id, ".", 2)[0]))
+}
+
+// ExportVAP translates the rules of the policy to ValidatingAdmissionPolicies and their bindings, one
+// per profile and one for the CEL rules of the policy. It also returns the rules that can't be
+// expressed natively, which still need the webhook.
+func ExportVAP(policy *Policy, runtimeClass, name string) ([]runtime.Object, []string) {
+	handler := &AdmissionHandler{RuntimeClass: runtimeClass, Policy: policy}
+	if policy == nil {
+		policy = &Policy{}
+	}
+	unsupported := []string{}
+	kinds := vapKinds(policy, &unsupported)
+
+	objects := []runtime.Object{}
+	partial := map[string][]string{}
+	for _, binding := range profileBindings(policy) {
+		profile := handler.profile(binding.namespace)
+		validations := []admissionregistrationv1.Validation{}
+		for _, rule := range registry {
+			translation, ok := vapTranslations[rule.ID()]
+			if !ok {
+				continue
+			}
+			result, err := translation.translate(profile)
+			if err != nil {
+				partial[rule.ID()] = append(partial[rule.ID()], fmt.Sprintf("%v (profile %v)", err, binding.profile))
+			}
+			validations = append(validations, vapGuard(rule.ID(), translation, kinds, result)...)
+		}
+		policies := vapPolicy(name+"-"+binding.name, kinds, validations, binding.selector, admissionregistrationv1.Deny)
+		if len(policies) > 0 {
+			policies[0].(*admissionregistrationv1.ValidatingAdmissionPolicy).Spec.MatchConditions = vapUpdateConditions
+		}
+		objects = append(objects, policies...)
+	}
+	for _, rule := range registry {
+		if _, ok := vapTranslations[rule.ID()]; !ok {
+			unsupported = append(unsupported, fmt.Sprintf("%v: %v", rule.ID(), rule.Description()))
+		} else if reasons, ok := partial[rule.ID()]; ok {
+			unsupported = append(unsupported, fmt.Sprintf("%v: %v", rule.ID(), strings.Join(reasons, ", ")))
+		}
+	}
+
+	// CEL rules are global and use the same variables in the apiserver, warnings are bound with the Warn action
+	denials, warnings := []admissionregistrationv1.Validation{}, []admissionregistrationv1.Validation{}
+	for _, rule := range policy.rules {
+		cel, ok := rule.(*celRule)
+		if !ok {
+			unsupported = append(unsupported, fmt.Sprintf("%v: only evaluated by the webhook", rule.ID()))
+			continue
+		}
+		if cel.Params != nil {
+			unsupported = append(unsupported, fmt.Sprintf("%v: params require a paramKind resource", rule.ID()))
+			continue
+		}
+		validation := admissionregistrationv1.Validation{Expression: cel.Expression, Message: cel.Message, MessageExpression: cel.MessageExpression}
+		if cel.Severity() == SeverityWarn {
+			warnings = append(warnings, validation)
+		} else {
+			denials = append(denials, validation)
+		}
+	}
+	objects = append(objects, vapPolicy(name+"-cel", kinds, denials, nil, admissionregistrationv1.Deny)...)
+	objects = append(objects, vapPolicy(name+"-cel-warn", kinds, warnings, nil, admissionregistrationv1.Warn)...)
+	return objects, unsupported
+}
+
+// vapKinds returns jobs and the workloads of the webhook with their pod template at spec.template
+func vapKinds(policy *Policy, unsupported *[]string) []vapKind {
+	kinds := []vapKind{{group: "batch", version: "v1", kind: "Job", resource: "jobs"}}
+	workloads := append([]WorkloadRule{}, policy.Workloads...)
+	for _, apps := range appsWorkloads {
+		overridden := false
+		for i := range policy.Workloads {
+			overridden = overridden || policy.Workloads[i].Group == apps.Group && policy.Workloads[i].Kind == apps.Kind
+		}
+		if !overridden {
+			workloads = append(workloads, apps)
+		}
+	}
+	for _, workload := range workloads {
+		if len(workload.PodSpecPaths) > 0 || len(workload.PodTemplatePaths) != 1 || workload.PodTemplatePaths[0] != appsTemplatePaths[0] {
+			*unsupported = append(*unsupported, fmt.Sprintf("workload %v: only pod templates at spec.template are exported", workload.Kind))
+			continue
+		}
+		version := workload.Version
+		if version == "" {
+			version = "*"
+		}
+		// Resources are assumed to be the lowercase plural of the kind
+		resource := strings.ToLower(workload.Kind) + "s"
+		kinds = append(kinds, vapKind{group: workload.Group, version: version, kind: workload.Kind, resource: resource, ruleGroups: workload.RuleGroups})
+	}
+	return kinds
+}
+
+// vapBinding is a profile and the namespaces using it
+type vapBinding struct {
+	// Suffix of the policy and binding names
+	name    string
+	profile string
+	// Namespace resolved to the profile by the handler
+	namespace string
+	selector  *k8meta.LabelSelector
+}
+
+// profileBindings returns the profiles in use, the default profile applies to the namespaces without mapping
+func profileBindings(policy *Policy) []vapBinding {
+	byProfile := map[string][]string{}
+	for namespace, profile := range policy.Namespaces {
+		byProfile[profile] = append(byProfile[profile], namespace)
+	}
+	profiles := []string{}
+	for profile := range byProfile {
+		profiles = append(profiles, profile)
+	}
+	sort.Strings(profiles)
+
+	defaultName := policy.DefaultProfile
+	if defaultName == "" {
+		defaultName = "default"
+	}
+	mapped := []string{}
+	bindings := []vapBinding{}
+	for _, profile := range profiles {
+		namespaces := byProfile[profile]
+		sort.Strings(namespaces)
+		// Without defaultProfile the fallback is the built-in profile, so a profile named default keeps its binding
+		if profile == policy.DefaultProfile {
+			continue
+		}
+		mapped = append(mapped, namespaces...)
+		bindings = append(bindings, vapBinding{name: "profile-" + profile, profile: profile, namespace: namespaces[0], selector: namespaceSelector(k8meta.LabelSelectorOpIn, namespaces)})
+	}
+	// An empty name is not a valid namespace, so it always resolves to the default profile. Profile
+	// bindings are prefixed, so the fallback name can't collide with them
+	defaults := vapBinding{name: "fallback", profile: defaultName}
+	if len(mapped) > 0 {
+		sort.Strings(mapped)
+		defaults.selector = namespaceSelector(k8meta.LabelSelectorOpNotIn, mapped)
+	}
+	return append([]vapBinding{defaults}, bindings...)
+}
+
+func namespaceSelector(operator k8meta.LabelSelectorOperator, namespaces []string) *k8meta.LabelSelector {
+	return &k8meta.LabelSelector{MatchExpressions: []k8meta.LabelSelectorRequirement{
+		{Key: "kubernetes.io/metadata.name", Operator: operator, Values: namespaces},
+	}}
+}
+
+// vapUpdateConditions skip the updates that keep the pod specs, as the webhook allows them for
+// objects admitted before a policy change. Translated rules only read the spec of jobs
+var vapUpdateConditions = []admissionregistrationv1.MatchCondition{{
+	Name:       "pod-spec-changed",
+	Expression: "request.operation != 'UPDATE' || (request.kind.group == 'batch' && request.kind.kind == 'Job' ? object.spec != oldObject.spec : object.spec.template != oldObject.spec.template)",
+}}
+
+// vapPolicy returns the policy and its binding, nothing without validations. Namespaces other than
+// kube-system are matched by the selector, nil matches all of them
+func vapPolicy(name string, kinds []vapKind, validations []admissionregistrationv1.Validation, selector *k8meta.LabelSelector, action admissionregistrationv1.ValidationAction) []runtime.Object {
+	if len(validations) == 0 {
+		return nil
+	}
+	rules := []admissionregistrationv1.NamedRuleWithOperations{}
+	for _, kind := range kinds {
+		rules = append(rules, admissionregistrationv1.NamedRuleWithOperations{RuleWithOperations: admissionregistrationv1.RuleWithOperations{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{kind.group},
+				APIVersions: []string{kind.version},
+				Resources:   []string{kind.resource},
+			},
+		}})
+	}
+	failurePolicy := admissionregistrationv1.Fail
+	policy := &admissionregistrationv1.ValidatingAdmissionPolicy{
+		TypeMeta:   k8meta.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "ValidatingAdmissionPolicy"},
+		ObjectMeta: k8meta.ObjectMeta{Name: name},
+		Spec: admissionregistrationv1.ValidatingAdmissionPolicySpec{
+			FailurePolicy:    &failurePolicy,
+			MatchConstraints: &admissionregistrationv1.MatchResources{ResourceRules: rules},
+			Variables:        vapVariables,
+			Validations:      validations,
+		},
+	}
+	binding := &admissionregistrationv1.ValidatingAdmissionPolicyBinding{
+		TypeMeta:   k8meta.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "ValidatingAdmissionPolicyBinding"},
+		ObjectMeta: k8meta.ObjectMeta{Name: name},
+		Spec: admissionregistrationv1.ValidatingAdmissionPolicyBindingSpec{
+			PolicyName:        name,
+			ValidationActions: []admissionregistrationv1.ValidationAction{action},
+		},
+	}
+	// The webhook skips kube-system
+	selector = selector.DeepCopy()
+	if selector == nil {
+		selector = &k8meta.LabelSelector{}
+	}
+	selector.MatchExpressions = append(selector.MatchExpressions, namespaceSelector(k8meta.LabelSelectorOpNotIn, []string{"kube-system"}).MatchExpressions...)
+	binding.Spec.MatchResources = &admissionregistrationv1.MatchResources{NamespaceSelector: selector}
+	return []runtime.Object{policy, binding}
+}
+
+// vapGuard limits the validations to the kinds where the webhook runs the rule
+func vapGuard(id string, translation vapTranslation, kinds []vapKind, validations []admissionregistrationv1.Validation) []admissionregistrationv1.Validation {
+	applied := []string{}
+	for i := range kinds {
+		if kinds[i].applies(id, translation) {
+			applied = append(applied, kinds[i].kind)
+		}
+	}
+	if len(applied) == len(kinds) {
+		return validations
+	}
+	guarded := []admissionregistrationv1.Validation{}
+	for _, validation := range validations {
+		validation.Expression = fmt.Sprintf("!(request.kind.kind in %v) || (%v)", celList(applied), validation.Expression)
+		guarded = append(guarded, validation)
+	}
+	return guarded
+}
+
+// celList returns a CEL list literal of the strings
+func celList(values []string) string {
+	quoted := []string{}
+	for _, value := range values {
+		quoted = append(quoted, strconv.Quote(value))
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+func vapValidations(expressionsAndMessages ...string) []admissionregistrationv1.Validation {
+	validations := []admissionregistrationv1.Validation{}
+	for i := 0; i+1 < len(expressionsAndMessages); i += 2 {
+		validations = append(validations, admissionregistrationv1.Validation{Expression: expressionsAndMessages[i], Message: expressionsAndMessages[i+1]})
+	}
+	return validations
+}
+
+// vapStatic returns a translation that doesn't depend on the profile
+func vapStatic(expression, message string) func(profile *Profile) ([]admissionregistrationv1.Validation, error) {
+	return func(profile *Profile) ([]admissionregistrationv1.Validation, error) {
+		return vapValidations(expression, message), nil
+	}
+}
+
+func vapPodFields(profile *Profile) ([]admissionregistrationv1.Validation, error) {
+	policy := &profile.Pod
+	validations := vapValidations(
+		fmt.Sprintf("(has(variables.spec.dnsPolicy) ? variables.spec.dnsPolicy : 'ClusterFirst') in %v", celList(policy.DNSPolicies)), "dnsPolicy is not allowed",
+		fmt.Sprintf("!has(variables.spec.dnsConfig) || !has(variables.spec.dnsConfig.nameservers) || variables.spec.dnsConfig.nameservers.all(n, n in %v)", celList(policy.Nameservers)), "dnsConfig nameserver is not allowed",
+		fmt.Sprintf("!has(variables.spec.os) || variables.spec.os.name in %v", celList(policy.OS)), "os is not allowed",
+	)
+	if !policy.AllowHostAliases {
+		validations = append(validations, vapValidations("!has(variables.spec.hostAliases) || size(variables.spec.hostAliases) == 0", "hostAliases must not be set")...)
+	}
+	if !policy.AllowShareProcessNamespace {
+		validations = append(validations, vapValidations("!has(variables.spec.shareProcessNamespace) || !variables.spec.shareProcessNamespace", "shareProcessNamespace must be false")...)
+	}
+	if policy.RequireUserNamespace {
+		validations = append(validations, vapValidations("has(variables.spec.hostUsers) && !variables.spec.hostUsers", "hostUsers must be false")...)
+	}
+	if !policy.AllowSetHostnameAsFQDN {
+		validations = append(validations, vapValidations("!has(variables.spec.setHostnameAsFQDN) || !variables.spec.setHostnameAsFQDN", "setHostnameAsFQDN must be false")...)
+	}
+	return validations, nil
+}
+
+func vapPriority(profile *Profile) ([]admissionregistrationv1.Validation, error) {
+	validations := vapValidations(fmt.Sprintf("!has(variables.spec.priorityClassName) || variables.spec.priorityClassName == '' || variables.spec.priorityClassName in %v", celList(profile.Priority.Allowed)), "priorityClassName is not allowed")
+	if profile.Priority.MaxValue != nil || profile.Priority.ForbidPreemption {
+		return validations, fmt.Errorf("maxValue and forbidPreemption read the priority class")
+	}
+	return validations, nil
+}
+
+func vapSysctls(profile *Profile) ([]admissionregistrationv1.Validation, error) {
+	sysctls := "(has(variables.spec.securityContext) && has(variables.spec.securityContext.sysctls) ? variables.spec.securityContext.sysctls : [])"
+	validations := vapValidations(fmt.Sprintf("%v.all(s, s.name.replace('/', '.') in %v)", sysctls, celList(profile.Sysctls.Allowed)), "sysctl is not allowed")
+	names := []string{}
+	for name := range profile.Sysctls.Values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		constraint := profile.Sysctls.Values[name]
+		validations = append(validations, vapValidations(fmt.Sprintf("%v.all(s, s.name.replace('/', '.') != %v || s.value.matches(%v))", sysctls, strconv.Quote(name), strconv.Quote("^(?:"+constraint+")$")),
+			fmt.Sprintf("value of sysctl %v must match %v", name, constraint))...)
+	}
+	return validations, nil
+}
+
+func vapLimits(profile *Profile) ([]admissionregistrationv1.Validation, error) {
+	if profile.Limits.MaxContainers == 0 {
+		return nil, nil
+	}
+	return vapValidations(fmt.Sprintf("size(variables.spec.containers) <= %v", profile.Limits.MaxContainers),
+		fmt.Sprintf("the maximum of containers is %v", profile.Limits.MaxContainers)), nil
+}
+
+func vapInitContainerLimits(profile *Profile) ([]admissionregistrationv1.Validation, error) {
+	if profile.Limits.MaxInitContainers == 0 {
+		return nil, nil
+	}
+	return vapValidations(fmt.Sprintf("!has(variables.spec.initContainers) || size(variables.spec.initContainers) <= %v", profile.Limits.MaxInitContainers),
+		fmt.Sprintf("the maximum of initContainers is %v", profile.Limits.MaxInitContainers)), nil
+}
+
+func vapHooks(profile *Profile) ([]admissionregistrationv1.Validation, error) {
+	validations := []admissionregistrationv1.Validation{}
+	if profile.Limits.ForbidLifecycleHooks {
+		validations = append(validations, vapValidations("variables.allContainers.all(c, !has(c.lifecycle) || !has(c.lifecycle.postStart) && !has(c.lifecycle.preStop))", "lifecycle hooks are not allowed")...)
+	}
+	if profile.Limits.ForbidExecProbes {
+		validations = append(validations, vapValidations("variables.allContainers.all(c, (!has(c.livenessProbe) || !has(c.livenessProbe.exec)) && (!has(c.readinessProbe) || !has(c.readinessProbe.exec)) && (!has(c.startupProbe) || !has(c.startupProbe.exec)))", "exec probes are not allowed")...)
+	}
+	return validations, nil
+}
+
+func vapCapabilities(profile *Profile) ([]admissionregistrationv1.Validation, error) {
+	// The webhook accepts the names in any case, with or without the CAP_ prefix
+	allowed := []string{}
+	for _, capability := range profile.Capabilities.Add {
+		name := normalizeCapability(v1.Capability(capability))
+		allowed = append(allowed, name, "CAP_"+name)
+	}
+	return vapValidations(
+		"variables.allContainers.all(c, !has(c.securityContext) || has(c.securityContext.capabilities) && has(c.securityContext.capabilities.drop) && c.securityContext.capabilities.drop.exists(d, d.trim().upperAscii() in ['ALL', 'CAP_ALL']))", "Container must drop all capabilities (drop must contain ALL)",
+		fmt.Sprintf("variables.allContainers.all(c, !has(c.securityContext) || !has(c.securityContext.capabilities) || !has(c.securityContext.capabilities.add) || c.securityContext.capabilities.add.all(a, a.trim().upperAscii() in %v))", celList(allowed)), "Container must not add capabilities outside of the profile",
+	), nil
+}
+
+// vapResource requires equal requests and limits, compared with the Kubernetes quantity library
+func vapResource(resource, title string) func(profile *Profile) ([]admissionregistrationv1.Validation, error) {
+	request, limit := "c.resources.requests."+resource, "c.resources.limits."+resource
+	expression := fmt.Sprintf("variables.allContainers.all(c, has(c.resources) && has(c.resources.requests) && has(c.resources.limits) && '%v' in c.resources.requests && '%v' in c.resources.limits && quantity(%v).isGreaterThan(quantity('0')) && quantity(%v).compareTo(quantity(%v)) == 0)",
+		resource, resource, request, request, limit)
+	return vapStatic(expression, fmt.Sprintf("%v request must be set and equal to limits", title))
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/ext"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// vapEnv approximates the CEL environment of the apiserver, quantities are compared as milli values
+func vapEnv(t *testing.T) *cel.Env {
+	env, err := cel.NewEnv(
+		cel.Variable("object", cel.DynType),
+		cel.Variable("oldObject", cel.DynType),
+		cel.Variable("request", cel.DynType),
+		cel.Variable("variables", cel.DynType),
+		ext.Strings(),
+		cel.Function("quantity", cel.Overload("quantity_string", []*cel.Type{cel.StringType}, cel.IntType,
+			cel.UnaryBinding(func(value ref.Val) ref.Val {
+				quantity, err := resource.ParseQuantity(string(value.(types.String)))
+				if err != nil {
+					return types.NewErr("%v", err)
+				}
+				return types.Int(quantity.MilliValue())
+			}))),
+		cel.Function("isGreaterThan", cel.MemberOverload("quantity_isGreaterThan", []*cel.Type{cel.IntType, cel.IntType}, cel.BoolType,
+			cel.BinaryBinding(func(left, right ref.Val) ref.Val { return types.Bool(left.(types.Int) > right.(types.Int)) }))),
+		cel.Function("compareTo", cel.MemberOverload("quantity_compareTo", []*cel.Type{cel.IntType, cel.IntType}, cel.IntType,
+			cel.BinaryBinding(func(left, right ref.Val) ref.Val { return left.(types.Int).Compare(right) }))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func evaluateVAP(t *testing.T, env *cel.Env, policy *admissionregistrationv1.ValidatingAdmissionPolicy, job *batchv1.Job) []string {
+	data, err := json.Marshal(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := map[string]interface{}{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		t.Fatal(err)
+	}
+	eval := func(expression string, variables map[string]interface{}) ref.Val {
+		ast, issues := env.Compile(expression)
+		if issues.Err() != nil {
+			t.Fatalf("Invalid expression %v: %v", expression, issues.Err())
+		}
+		program, err := env.Program(ast)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, _, err := program.Eval(map[string]interface{}{
+			"object":    object,
+			"request":   map[string]interface{}{"kind": map[string]interface{}{"group": "batch", "version": "v1", "kind": "Job"}},
+			"variables": variables,
+		})
+		if err != nil {
+			t.Fatalf("Error evaluating %v: %v", expression, err)
+		}
+		return result
+	}
+
+	variables := map[string]interface{}{}
+	for _, variable := range policy.Spec.Variables {
+		variables[variable.Name] = eval(variable.Expression, variables)
+	}
+	failed := []string{}
+	for _, validation := range policy.Spec.Validations {
+		if eval(validation.Expression, variables) != types.True {
+			failed = append(failed, validation.Message)
+		}
+	}
+	return failed
+}
+
+func TestExportVAP(t *testing.T) {
+	objects, unsupported := ExportVAP(nil, "gvisor", "simple-admission")
+	if len(objects) != 2 {
+		t.Fatalf("Default profile must export a policy and its binding, got %v objects", len(objects))
+	}
+	policy := objects[0].(*admissionregistrationv1.ValidatingAdmissionPolicy)
+	if binding := objects[1].(*admissionregistrationv1.ValidatingAdmissionPolicyBinding); binding.Spec.PolicyName != policy.Name || len(binding.Spec.MatchResources.NamespaceSelector.MatchExpressions) != 1 {
+		t.Fatalf("Binding of the default profile must select every namespace but kube-system, got %v", binding.Spec)
+	}
+	for _, id := range []string{"env.sources", "secrets.scan", "pod.serviceAccount"} {
+		found := false
+		for _, rule := range unsupported {
+			found = found || strings.HasPrefix(rule, id+":")
+		}
+		if !found {
+			t.Errorf("Rule %v must be reported as unsupported, got %v", id, unsupported)
+		}
+	}
+
+	// The exported validations must agree with the webhook
+	env := vapEnv(t)
+	handler := &AdmissionHandler{RuntimeClass: "gvisor"}
+	cases := map[string]func(job *batchv1.Job){
+		"valid": func(job *batchv1.Job) {},
+		"equalQuantities": func(job *batchv1.Job) {
+			job.Spec.Template.Spec.Containers[0].Resources.Requests[v1.ResourceCPU] = resource.MustParse("0.01")
+		},
+		"hostPID":      func(job *batchv1.Job) { job.Spec.Template.Spec.HostPID = true },
+		"runtimeClass": func(job *batchv1.Job) { job.Spec.Template.Spec.RuntimeClassName = nil },
+		"privileged": func(job *batchv1.Job) {
+			privileged := true
+			job.Spec.Template.Spec.Containers[0].SecurityContext.Privileged = &privileged
+		},
+		"cpuLimit": func(job *batchv1.Job) {
+			job.Spec.Template.Spec.Containers[0].Resources.Limits[v1.ResourceCPU] = resource.MustParse("20m")
+		},
+		"noMemory": func(job *batchv1.Job) { job.Spec.Template.Spec.Containers[0].Resources = v1.ResourceRequirements{} },
+		"volumes": func(job *batchv1.Job) {
+			job.Spec.Template.Spec.Volumes = []v1.Volume{{Name: "data", VolumeSource: v1.VolumeSource{EmptyDir: &v1.EmptyDirVolumeSource{}}}}
+		},
+		"containers": func(job *batchv1.Job) {
+			job.Spec.Template.Spec.Containers = append(job.Spec.Template.Spec.Containers, job.Spec.Template.Spec.Containers[0])
+		},
+		"capabilities": func(job *batchv1.Job) {
+			job.Spec.Template.Spec.Containers[0].SecurityContext.Capabilities.Add = []v1.Capability{"net_admin"}
+		},
+		"sysctls": func(job *batchv1.Job) {
+			job.Spec.Template.Spec.SecurityContext = &v1.PodSecurityContext{Sysctls: []v1.Sysctl{{Name: "kernel/msgmax", Value: "1"}}}
+		},
+		"restartPolicy": func(job *batchv1.Job) { job.Spec.Template.Spec.RestartPolicy = v1.RestartPolicyOnFailure },
+	}
+	for key, mutate := range cases {
+		review := loadValidJob(t)
+		job := loadJob(t, review)
+		job.Labels = map[string]string{"team": "ml"}
+		mutate(job)
+		saveJob(t, review, job)
+
+		allowed, _, err := checkRequest(context.Background(), review.Request, handler)
+		failed := evaluateVAP(t, env, policy, job)
+		if allowed != (len(failed) == 0) {
+			t.Errorf("%v: webhook allowed %v (%v) but the policy failed %v", key, allowed, err, failed)
+		}
+	}
+}
+
+func TestExportVAPProfiles(t *testing.T) {
+	handler := celHandler(t, `
+defaultProfile: standard
+namespaces:
+  ml: restricted
+  research: restricted
+  batch: standard
+profiles:
+  standard: {}
+  restricted:
+    runtimeClass: kata
+    priority:
+      forbidPreemption: true
+workloads:
+- group: kubeflow.org
+  kind: PyTorchJob
+  podTemplatePaths: [spec.pytorchReplicaSpecs.*.template]
+- group: apps
+  kind: Deployment
+  ruleGroups: [runtime]
+cel:
+  rules:
+  - name: owner
+    expression: "has(object.metadata.labels) && 'owner' in object.metadata.labels"
+    message: owner label is missing
+    severity: warn
+  - name: team
+    expression: "has(object.metadata.labels) && object.metadata.labels.exists(k, k in params.keys)"
+    params:
+      keys: [team]
+`)
+	objects, unsupported := ExportVAP(handler.Policy, "gvisor", "admission")
+
+	names := []string{}
+	for _, object := range objects {
+		if binding, ok := object.(*admissionregistrationv1.ValidatingAdmissionPolicyBinding); ok {
+			names = append(names, binding.Name)
+			if selector := binding.Spec.MatchResources.NamespaceSelector.MatchExpressions; selector[len(selector)-1].Operator != "NotIn" || strings.Join(selector[len(selector)-1].Values, ",") != "kube-system" {
+				t.Errorf("Binding %v must exclude kube-system, got %v", binding.Name, selector)
+			}
+			switch binding.Name {
+			case "admission-fallback":
+				if selector := binding.Spec.MatchResources.NamespaceSelector.MatchExpressions[0]; selector.Operator != "NotIn" || strings.Join(selector.Values, ",") != "ml,research" {
+					t.Errorf("Default profile must exclude the namespaces of other profiles, got %v", selector)
+				}
+			case "admission-profile-restricted":
+				if selector := binding.Spec.MatchResources.NamespaceSelector.MatchExpressions[0]; selector.Operator != "In" || strings.Join(selector.Values, ",") != "ml,research" {
+					t.Errorf("Profile must select its namespaces, got %v", selector)
+				}
+			case "admission-cel-warn":
+				if binding.Spec.ValidationActions[0] != admissionregistrationv1.Warn {
+					t.Errorf("Warning rules must be bound with the Warn action, got %v", binding.Spec.ValidationActions)
+				}
+			}
+			continue
+		}
+		policy := object.(*admissionregistrationv1.ValidatingAdmissionPolicy)
+		for _, validation := range policy.Spec.Validations {
+			if strings.Contains(validation.Expression, "hostPID") && (!strings.HasPrefix(validation.Expression, "!(request.kind.kind in") || strings.Contains(validation.Expression, "Deployment")) {
+				t.Errorf("Rule groups of the Deployments must be kept, got %v", validation.Expression)
+			}
+			if policy.Name == "admission-restricted" && strings.Contains(validation.Expression, "runtimeClassName ==") && !strings.Contains(validation.Expression, `"kata"`) {
+				t.Errorf("Runtime class of the profile must be exported, got %v", validation.Expression)
+			}
+		}
+	}
+	if strings.Join(names, ",") != "admission-fallback,admission-profile-restricted,admission-cel-warn" {
+		t.Errorf("Unexpected bindings %v", names)
+	}
+
+	expected := []string{"workload PyTorchJob:", "pod.priority: maxValue and forbidPreemption read the priority class (profile restricted)", "cel.team:"}
+	for _, prefix := range expected {
+		found := false
+		for _, rule := range unsupported {
+			found = found || strings.HasPrefix(rule, prefix)
+		}
+		if !found {
+			t.Errorf("%v must be reported as unsupported, got %v", prefix, unsupported)
+		}
+	}
+}
+
+func TestExportVAPDefaultProfileName(t *testing.T) {
+	handler := celHandler(t, `
+namespaces:
+  a: default
+  b: ml
+profiles:
+  default: {}
+  ml:
+    runtimeClass: kata
+`)
+	objects, _ := ExportVAP(handler.Policy, "gvisor", "sa")
+
+	names := map[string]bool{}
+	for _, object := range objects {
+		binding, ok := object.(*admissionregistrationv1.ValidatingAdmissionPolicyBinding)
+		if !ok {
+			continue
+		}
+		if names[binding.Name] {
+			t.Errorf("Binding %v is exported twice", binding.Name)
+		}
+		names[binding.Name] = true
+	}
+	for _, name := range []string{"sa-fallback", "sa-profile-default", "sa-profile-ml"} {
+		if !names[name] {
+			t.Errorf("Binding %v must be exported, got %v", name, names)
+		}
+	}
+}
+
+func TestExportVAPUpdates(t *testing.T) {
+	objects, _ := ExportVAP(nil, "gvisor", "simple-admission")
+	conditions := objects[0].(*admissionregistrationv1.ValidatingAdmissionPolicy).Spec.MatchConditions
+	if len(conditions) != 1 {
+		t.Fatalf("Profile policies must skip the updates that keep the pod specs, got %v", conditions)
+	}
+	env := vapEnv(t)
+	ast, issues := env.Compile(conditions[0].Expression)
+	if issues.Err() != nil {
+		t.Fatalf("Invalid match condition: %v", issues.Err())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deployment := map[string]interface{}{"spec": map[string]interface{}{"replicas": 1, "template": map[string]interface{}{"spec": map[string]interface{}{"hostPID": true}}}}
+	scaled := map[string]interface{}{"spec": map[string]interface{}{"replicas": 2, "template": map[string]interface{}{"spec": map[string]interface{}{"hostPID": true}}}}
+	job := map[string]interface{}{"spec": map[string]interface{}{"parallelism": 1, "template": map[string]interface{}{}}}
+	scaledJob := map[string]interface{}{"spec": map[string]interface{}{"parallelism": 2, "template": map[string]interface{}{}}}
+	appsKind := map[string]interface{}{"group": "apps", "kind": "Deployment"}
+	jobKind := map[string]interface{}{"group": "batch", "kind": "Job"}
+	cases := map[string]struct {
+		operation     string
+		kind          map[string]interface{}
+		old, object   map[string]interface{}
+		expectedMatch bool
+	}{
+		"create":         {operation: "CREATE", kind: appsKind, object: deployment, expectedMatch: true},
+		"scale":          {operation: "UPDATE", kind: appsKind, old: deployment, object: scaled, expectedMatch: false},
+		"templateChange": {operation: "UPDATE", kind: appsKind, old: job, object: deployment, expectedMatch: true},
+		"jobMetadata":    {operation: "UPDATE", kind: jobKind, old: job, object: job, expectedMatch: false},
+		"jobSpec":        {operation: "UPDATE", kind: jobKind, old: job, object: scaledJob, expectedMatch: true},
+	}
+	for key, val := range cases {
+		result, _, err := program.Eval(map[string]interface{}{
+			"object":    val.object,
+			"oldObject": val.old,
+			"request":   map[string]interface{}{"operation": val.operation, "kind": val.kind},
+		})
+		if err != nil {
+			t.Fatalf("%v: error evaluating the match condition: %v", key, err)
+		}
+		if result != types.Bool(val.expectedMatch) {
+			t.Errorf("%v: expected match %v, got %v", key, val.expectedMatch, result)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Defaults of the WASM modules
+const (
+	defaultWASMMemoryLimitMiB = 64
+	defaultWASMTimeout        = time.Second
+	// Pages of 64 KiB in a MiB
+	wasmPagesPerMiB = 16
+)
+
+// WASMPolicy loads the WASM modules of a directory, evaluated once per request. Modules must
+// implement the ABI described in the README and are compiled when the policy is loaded.
+type WASMPolicy struct {
+	// Directory with the .wasm modules. Empty disables the modules
+	Directory string `json:"directory,omitempty"`
+	// Maximum memory of a module instance, defaults to 64 MiB
+	MemoryLimitMiB uint32 `json:"memoryLimitMiB,omitempty"`
+	// Maximum duration of an evaluation, defaults to 1s
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// wasmRule is the Rule of a compiled module, a new instance runs every request
+type wasmRule struct {
+	name    string
+	runtime wazero.Runtime
+	module  wazero.CompiledModule
+	start   []string
+	timeout time.Duration
+}
+
+// compile compiles the modules of the directory and checks their exports
+func (policy *WASMPolicy) compile() ([]Rule, error) {
+	if policy.Directory == "" {
+		return nil, nil
+	}
+	timeout := defaultWASMTimeout
+	if policy.Timeout != "" {
+		parsed, err := time.ParseDuration(policy.Timeout)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid wasm timeout %v", policy.Timeout)
+		}
+		timeout = parsed
+	}
+	memoryLimit := policy.MemoryLimitMiB
+	if memoryLimit == 0 {
+		memoryLimit = defaultWASMMemoryLimitMiB
+	}
+	if memoryLimit > 4096 {
+		return nil, fmt.Errorf("wasm memoryLimitMiB must not be greater than 4096")
+	}
+
+	files, err := filepath.Glob(filepath.Join(policy.Directory, "*.wasm"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no .wasm module in %v", policy.Directory)
+	}
+	sort.Strings(files)
+
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(memoryLimit*wasmPagesPerMiB).
+		WithCloseOnContextDone(true))
+	// Modules built for WASI, e.g. with GOOS=wasip1, import it even without files or env
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		return nil, err
+	}
+
+	rules := []Rule{}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".wasm")
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		module, err := runtime.CompileModule(ctx, data)
+		if err != nil {
+			return nil, fmt.Errorf("wasm module %v: %v", name, err)
+		}
+		if err := checkWASMExports(module); err != nil {
+			return nil, fmt.Errorf("wasm module %v: %v", name, err)
+		}
+		rule := &wasmRule{name: name, runtime: runtime, module: module, timeout: timeout}
+		// Reactor modules initialize their runtime in _initialize instead of _start
+		if _, ok := module.ExportedFunctions()["_initialize"]; ok {
+			rule.start = []string{"_initialize"}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// checkWASMExports validates the exports of the ABI
+func checkWASMExports(module wazero.CompiledModule) error {
+	if _, ok := module.ExportedMemories()["memory"]; !ok {
+		return fmt.Errorf("must export its memory as memory")
+	}
+	signatures := map[string][2][]api.ValueType{
+		"allocate": {{api.ValueTypeI32}, {api.ValueTypeI32}},
+		"validate": {{api.ValueTypeI32, api.ValueTypeI32}, {api.ValueTypeI64}},
+	}
+	for name, signature := range signatures {
+		function, ok := module.ExportedFunctions()[name]
+		if !ok {
+			return fmt.Errorf("must export the function %v", name)
+		}
+		if fmt.Sprint(function.ParamTypes()) != fmt.Sprint(signature[0]) || fmt.Sprint(function.ResultTypes()) != fmt.Sprint(signature[1]) {
+			return fmt.Errorf("function %v has the wrong signature", name)
+		}
+	}
+	return nil
+}
+
+func (rule *wasmRule) ID() string          { return "wasm." + rule.name }
+func (rule *wasmRule) Description() string { return "WASM module " + rule.name }
+func (rule *wasmRule) Severity() Severity  { return SeverityDeny }
+
+// Evaluate runs the module in a new instance, errors, traps and timeouts deny the request
+func (rule *wasmRule) Evaluate(ctx context.Context, object *Object, profile *Profile) []Violation {
+	if object.Request == nil {
+		return nil
+	}
+	result, err := rule.run(ctx, object)
+	if err != nil {
+		return []Violation{{Message: fmt.Sprintf("wasm module %v failed: %v", rule.name, err)}}
+	}
+	return result.violations()
+}
+
+func (rule *wasmRule) run(ctx context.Context, object *Object) (*violationsDocument, error) {
+	variables, err := requestVariables(object)
+	if err != nil {
+		return nil, err
+	}
+	input, err := json.Marshal(variables)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rule.timeout)
+	defer cancel()
+	// Unnamed instances don't conflict with the concurrent requests
+	instance, err := rule.runtime.InstantiateModule(ctx, rule.module, wazero.NewModuleConfig().WithName("").WithStartFunctions(rule.start...))
+	if err != nil {
+		return nil, err
+	}
+	defer instance.Close(context.Background())
+
+	results, err := instance.ExportedFunction("allocate").Call(ctx, uint64(len(input)))
+	if err != nil {
+		return nil, err
+	}
+	pointer := uint32(results[0])
+	if !instance.Memory().Write(pointer, input) {
+		return nil, fmt.Errorf("allocate returned memory out of range")
+	}
+
+	results, err = instance.ExportedFunction("validate").Call(ctx, uint64(pointer), uint64(len(input)))
+	if err != nil {
+		return nil, err
+	}
+	result := &violationsDocument{}
+	if results[0] == 0 {
+		return result, nil
+	}
+	output, ok := instance.Memory().Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return nil, fmt.Errorf("validate returned memory out of range")
+	}
+	if err := json.Unmarshal(output, result); err != nil {
+		return nil, fmt.Errorf("invalid result: %v", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	testModuleOnce sync.Once
+	testModule     []byte
+	testModuleErr  error
+)
+
+// wasmDirectory returns a directory with the test module of testdata/wasm
+func wasmDirectory(t *testing.T) string {
+	testModuleOnce.Do(func() {
+		directory, err := os.MkdirTemp("", "simple-admission-wasm")
+		if err != nil {
+			testModuleErr = err
+			return
+		}
+		defer os.RemoveAll(directory)
+		output := filepath.Join(directory, "labels.wasm")
+		command := exec.Command("go", "build", "-buildmode=c-shared", "-o", output, "./testdata/wasm")
+		command.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+		if data, err := command.CombinedOutput(); err != nil {
+			testModuleErr = err
+			t.Log(string(data))
+			return
+		}
+		testModule, testModuleErr = os.ReadFile(output)
+	})
+	if testModuleErr != nil {
+		t.Fatalf("Error building the test module: %v", testModuleErr)
+	}
+	directory := t.TempDir()
+	if err := os.WriteFile(filepath.Join(directory, "labels.wasm"), testModule, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return directory
+}
+
+func wasmHandler(t *testing.T, settings WASMPolicy) *AdmissionHandler {
+	policy := &Policy{WASM: settings}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &AdmissionHandler{RuntimeClass: "gvisor", Policy: policy}
+}
+
+func TestWASMModule(t *testing.T) {
+	handler := wasmHandler(t, WASMPolicy{Directory: wasmDirectory(t)})
+	review := loadValidJob(t)
+	job := loadJob(t, review)
+
+	allowed, warnings, err := checkRequest(context.Background(), review.Request, handler)
+	if !allowed || len(warnings) != 1 || warnings[0] != "owner label is missing" {
+		t.Fatalf("Job must be allowed with the module warning, got %v %v", warnings, err)
+	}
+
+	job.Labels = map[string]string{"owner": "ml", "wasm-deny": "test"}
+	saveJob(t, review, job)
+	allowed, warnings, err = checkRequest(context.Background(), review.Request, handler)
+	if allowed || err.Error() != "metadata.labels[wasm-deny]: denied by the module: test" {
+		t.Fatalf("Module violation must deny with its field, got %v", err)
+	}
+
+	job.Labels = map[string]string{"owner": "ml"}
+	saveJob(t, review, job)
+	if allowed, warnings, err = checkRequest(context.Background(), review.Request, handler); !allowed || len(warnings) > 0 {
+		t.Fatalf("Job must be allowed without warnings, got %v %v", warnings, err)
+	}
+}
+
+func TestWASMLimits(t *testing.T) {
+	handler := wasmHandler(t, WASMPolicy{Directory: wasmDirectory(t), Timeout: "500ms", MemoryLimitMiB: 128})
+	for _, label := range []string{"wasm-loop", "wasm-oom"} {
+		review := loadValidJob(t)
+		job := loadJob(t, review)
+		job.Labels = map[string]string{label: "true"}
+		saveJob(t, review, job)
+
+		allowed, _, err := checkRequest(context.Background(), review.Request, handler)
+		if allowed || !strings.HasPrefix(err.Error(), "wasm module labels failed") {
+			t.Errorf("Module over the limits with %v must deny, got %v", label, err)
+		}
+	}
+}
+
+func TestInvalidWASMModules(t *testing.T) {
+	modules := map[string][]byte{
+		"invalid":   []byte("not a module"),
+		"noExports": []byte("\x00asm\x01\x00\x00\x00"),
+	}
+	for key, module := range modules {
+		directory := t.TempDir()
+		if err := os.WriteFile(filepath.Join(directory, key+".wasm"), module, 0600); err != nil {
+			t.Fatal(err)
+		}
+		policy := &Policy{WASM: WASMPolicy{Directory: directory}}
+		if err := policy.validate(); err == nil {
+			t.Errorf("Invalid module `%v` was loaded", key)
+		}
+	}
+
+	policy := &Policy{WASM: WASMPolicy{Directory: t.TempDir()}}
+	if err := policy.validate(); err == nil {
+		t.Errorf("Directory without modules was loaded")
+	}
+}
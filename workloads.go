@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	admission "k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+// WorkloadRule maps a kind to the paths of its embedded pod specs. Paths are dot separated
+// field names, where name[*] selects every item of an array, name[N] a single item and
+// * every value of a map, e.g. spec.pytorchReplicaSpecs.*.template
+type WorkloadRule struct {
+	Group string `json:"group"`
+	// Empty matches every version
+	Version          string   `json:"version,omitempty"`
+	Kind             string   `json:"kind"`
+	PodSpecPaths     []string `json:"podSpecPaths,omitempty"`
+	PodTemplatePaths []string `json:"podTemplatePaths,omitempty"`
+	// Rule groups run against the pod specs, empty runs every group
+	RuleGroups []string `json:"ruleGroups,omitempty"`
+}
+
+var appsTemplatePaths = []string{"spec.template"}
+
+// apps/v1 kinds validated when the policy does not list them, policy entries for these kinds
+// can omit the paths to use spec.template
+var appsWorkloads = []WorkloadRule{
+	{Group: "apps", Version: "v1", Kind: "Deployment", PodTemplatePaths: appsTemplatePaths},
+	{Group: "apps", Version: "v1", Kind: "StatefulSet", PodTemplatePaths: appsTemplatePaths},
+	{Group: "apps", Version: "v1", Kind: "DaemonSet", PodTemplatePaths: appsTemplatePaths},
+	{Group: "apps", Version: "v1", Kind: "ReplicaSet", PodTemplatePaths: appsTemplatePaths},
+}
+
+// isAppsWorkload returns if the rule targets one of the apps/v1 kinds
+func (rule *WorkloadRule) isAppsWorkload() bool {
+	for _, apps := range appsWorkloads {
+		if rule.Group == apps.Group && rule.Kind == apps.Kind && (rule.Version == "" || rule.Version == apps.Version) {
+			return true
+		}
+	}
+	return false
+}
+
+type pathSegment struct {
+	name string
+	// Index of the array item, -1 for every item, nil if the field is not an array
+	index *int
+}
+
+func (rule *WorkloadRule) matches(request *admission.AdmissionRequest) bool {
+	return rule.Group == request.Kind.Group && rule.Kind == request.Kind.Kind && (rule.Version == "" || rule.Version == request.Kind.Version)
+}
+
+func (rule *WorkloadRule) validate() error {
+	if rule.Kind == "" {
+		return fmt.Errorf("workloads must set a kind")
+	}
+	if len(rule.PodSpecPaths) == 0 && len(rule.PodTemplatePaths) == 0 {
+		return fmt.Errorf("workload %v must set podSpecPaths or podTemplatePaths", rule.Kind)
+	}
+	for _, path := range append(append([]string{}, rule.PodSpecPaths...), rule.PodTemplatePaths...) {
+		if _, err := parsePath(path); err != nil {
+			return fmt.Errorf("workload %v: %v", rule.Kind, err)
+		}
+	}
+	for _, group := range rule.RuleGroups {
+		if groups := registeredGroups(); !contains(groups, group) {
+			return fmt.Errorf("workload %v: unknown rule group %v, must be one of %v", rule.Kind, group, strings.Join(groups, ", "))
+		}
+	}
+	return nil
+}
+
+func parsePath(path string) ([]pathSegment, error) {
+	segments := []pathSegment{}
+	for _, part := range strings.Split(path, ".") {
+		segment := pathSegment{name: part}
+		if open := strings.Index(part, "["); open >= 0 {
+			if !strings.HasSuffix(part, "]") || open == 0 {
+				return nil, fmt.Errorf("invalid path %v", path)
+			}
+			segment.name = part[:open]
+			index := -1
+			if value := part[open+1 : len(part)-1]; value != "*" {
+				parsed, err := strconv.Atoi(value)
+				if err != nil || parsed < 0 {
+					return nil, fmt.Errorf("invalid index in path %v", path)
+				}
+				index = parsed
+			}
+			segment.index = &index
+		}
+		if segment.name == "" {
+			return nil, fmt.Errorf("invalid path %v", path)
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// fragment is a value found in a decoded object, with its path in the object
+type fragment struct {
+	path  *field.Path
+	value interface{}
+}
+
+// findFragments returns the values of the object at the path, missing fields are skipped
+func findFragments(object interface{}, segments []pathSegment, path *field.Path) []fragment {
+	if len(segments) == 0 {
+		return []fragment{{path, object}}
+	}
+	values, ok := object.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	child := func(name string) *field.Path {
+		if path == nil {
+			return field.NewPath(name)
+		}
+		return path.Child(name)
+	}
+
+	segment := segments[0]
+	if segment.name == "*" && segment.index == nil {
+		// Sorted so denials are deterministic
+		keys := []string{}
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		result := []fragment{}
+		for _, key := range keys {
+			result = append(result, findFragments(values[key], segments[1:], child(key))...)
+		}
+		return result
+	}
+
+	value, ok := values[segment.name]
+	if !ok {
+		return nil
+	}
+	if segment.index == nil {
+		return findFragments(value, segments[1:], child(segment.name))
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+	result := []fragment{}
+	for i, item := range items {
+		if *segment.index == -1 || *segment.index == i {
+			result = append(result, findFragments(item, segments[1:], child(segment.name).Index(i))...)
+		}
+	}
+	return result
+}
+
+// workloadRule returns the rule of the kind of the request, nil if none applies.
+// The rules of the policy take precedence over the apps/v1 defaults
+func (handler *AdmissionHandler) workloadRule(request *admission.AdmissionRequest) *WorkloadRule {
+	if handler.Policy != nil {
+		for i := range handler.Policy.Workloads {
+			if handler.Policy.Workloads[i].matches(request) {
+				return &handler.Policy.Workloads[i]
+			}
+		}
+	}
+	for i := range appsWorkloads {
+		if appsWorkloads[i].matches(request) {
+			return &appsWorkloads[i]
+		}
+	}
+	return nil
+}
+
+// checkWorkload decodes the pod specs embedded in the object and runs the pod and container checks,
+// it returns the warnings of every pod spec
+func checkWorkload(ctx context.Context, request *admission.AdmissionRequest, rule *WorkloadRule, handler *AdmissionHandler) (bool, []string, error) {
+	if request.Operation != admission.Create && request.Operation != admission.Update {
+		return true, nil, nil
+	}
+	var object interface{}
+	if err := json.Unmarshal(request.Object.Raw, &object); err != nil {
+		log.Printf("Error parsing %v %v", request.Kind.Kind, err)
+		return false, nil, fmt.Errorf("error parsing %v", request.Kind.Kind)
+	}
+	if request.Operation == admission.Update && !podSpecsChanged(request, object, rule) {
+		return true, nil, nil
+	}
+	profile := handler.profile(request.Namespace)
+
+	warnings := []string{}
+	check := func(paths []string, template bool) (bool, error) {
+		for _, path := range paths {
+			segments, _ := parsePath(path)
+			for _, fragment := range findFragments(object, segments, nil) {
+				data, err := json.Marshal(fragment.value)
+				if err != nil {
+					return false, err
+				}
+				spec, specPath := &v1.PodSpec{}, fragment.path
+				if template {
+					podTemplate := &v1.PodTemplateSpec{}
+					err = json.Unmarshal(data, podTemplate)
+					spec, specPath = &podTemplate.Spec, specPath.Child("spec")
+				} else {
+					err = json.Unmarshal(data, spec)
+				}
+				if err != nil {
+					return false, fmt.Errorf("%v: error parsing pod spec: %v", fragment.path, err)
+				}
+				object := &Object{PodSpec: spec, SpecPath: specPath, Namespace: request.Namespace, Cluster: handler.Cluster}
+				allowed, specWarnings, err := evaluateRules(ctx, registry, object, profile, rule.RuleGroups)
+				if !allowed {
+					return false, withPath(specPath, err)
+				}
+				warnings = append(warnings, specWarnings...)
+			}
+		}
+		return true, nil
+	}
+
+	if allowed, err := check(rule.PodSpecPaths, false); !allowed {
+		return false, nil, err
+	}
+	if allowed, err := check(rule.PodTemplatePaths, true); !allowed {
+		return false, nil, err
+	}
+	return true, warnings, nil
+}
+
+// podSpecsChanged returns if an update changes the pod specs of the rule paths. Other updates, like
+// scaling or metadata changes by controllers, are allowed so objects admitted before a policy change
+// can still be managed
+func podSpecsChanged(request *admission.AdmissionRequest, object interface{}, rule *WorkloadRule) bool {
+	var old interface{}
+	if err := json.Unmarshal(request.OldObject.Raw, &old); err != nil || old == nil {
+		return true
+	}
+	for _, path := range append(append([]string{}, rule.PodSpecPaths...), rule.PodTemplatePaths...) {
+		segments, _ := parsePath(path)
+		if !reflect.DeepEqual(findFragments(old, segments, nil), findFragments(object, segments, nil)) {
+			return true
+		}
+	}
+	return false
+}
+
+// withPath prefixes the error with the path unless it already names a field
+func withPath(path *field.Path, err error) error {
+	if violation, ok := err.(Violation); err == nil || ok && violation.Field != "" {
+		return err
+	}
+	return fmt.Errorf("%v: %v", path, err)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	admission "k8s.io/api/admission/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	k8meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+func workloadRequest(t *testing.T, object interface{}) *admission.AdmissionRequest {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kind := k8meta.GroupVersionKind{Group: "kubeflow.org", Version: "v1", Kind: "PyTorchJob"}
+	return &admission.AdmissionRequest{
+		Kind:        kind,
+		RequestKind: &kind,
+		Namespace:   "default",
+		Operation:   admission.Create,
+		Object:      runtime.RawExtension{Raw: raw},
+	}
+}
+
+func workloadHandler(t *testing.T) *AdmissionHandler {
+	policy := &Policy{}
+	if err := yaml.Unmarshal([]byte(`
+workloads:
+- group: kubeflow.org
+  kind: PyTorchJob
+  podTemplatePaths: ["spec.pytorchReplicaSpecs.*.template"]
+  podSpecPaths: ["spec.extraPods[*]"]
+`), policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return &AdmissionHandler{RuntimeClass: "gvisor", Policy: policy}
+}
+
+func TestWorkloadPodTemplates(t *testing.T) {
+	spec := loadJob(t, loadValidJob(t)).Spec.Template.Spec
+	invalid := *spec.DeepCopy()
+	invalid.HostNetwork = true
+
+	object := func(worker v1.PodSpec, extra ...v1.PodSpec) map[string]interface{} {
+		return map[string]interface{}{
+			"spec": map[string]interface{}{
+				"pytorchReplicaSpecs": map[string]interface{}{
+					"Master": map[string]interface{}{"template": v1.PodTemplateSpec{Spec: spec}},
+					"Worker": map[string]interface{}{"template": v1.PodTemplateSpec{Spec: worker}},
+				},
+				"extraPods": extra,
+			},
+		}
+	}
+	handler := workloadHandler(t)
+
+	allowed, _, err := checkRequest(context.Background(), workloadRequest(t, object(spec, spec)), handler)
+	if !allowed {
+		t.Fatalf("Valid workload was denied: %v", err)
+	}
+
+	saved := registry
+	RegisterRule(NewRule("custom.latest", "Images should be pinned", SeverityWarn, func(ctx context.Context, object *Object, profile *Profile) []Violation {
+		return []Violation{{Field: object.SpecPath.Child("containers").Index(0).Child("image").String(), Message: "should be pinned"}}
+	}))
+	allowed, warnings, err := checkRequest(context.Background(), workloadRequest(t, object(spec)), handler)
+	registry = saved
+	if !allowed || len(warnings) != 2 || warnings[1] != "spec.pytorchReplicaSpecs.Worker.template.spec.containers[0].image: should be pinned" {
+		t.Fatalf("Warnings of every pod spec must be returned, got %v %v", warnings, err)
+	}
+
+	allowed, _, err = checkRequest(context.Background(), workloadRequest(t, object(invalid)), handler)
+	if allowed || !strings.HasPrefix(err.Error(), "spec.pytorchReplicaSpecs.Worker.template.spec.hostNetwork: Forbidden") {
+		t.Fatalf("Invalid worker template must be denied with its path, got %v", err)
+	}
+
+	allowed, _, err = checkRequest(context.Background(), workloadRequest(t, object(spec, spec, invalid)), handler)
+	if allowed || !strings.HasPrefix(err.Error(), "spec.extraPods[1].hostNetwork: Forbidden") {
+		t.Fatalf("Invalid pod spec must be denied with its path, got %v", err)
+	}
+
+	request := workloadRequest(t, object(invalid))
+	request.Kind.Kind = "TFJob"
+	request.RequestKind.Kind = "TFJob"
+	if allowed, _, _ = checkRequest(context.Background(), request, handler); !allowed {
+		t.Fatalf("Kinds without a workload rule must be skipped")
+	}
+}
+
+func TestWorkloadPaths(t *testing.T) {
+	for _, path := range []string{"spec.templates[*].podSpec", "spec.*.template", "items[2]"} {
+		if _, err := parsePath(path); err != nil {
+			t.Errorf("Valid path %v was rejected: %v", path, err)
+		}
+	}
+	for _, path := range []string{"spec..template", "spec.items[a]", "spec.[0]", "spec.items[-1]", "spec.items[0"} {
+		if _, err := parsePath(path); err == nil {
+			t.Errorf("Invalid path %v was accepted", path)
+		}
+	}
+}
+
+func TestAppsWorkloads(t *testing.T) {
+	spec := loadJob(t, loadValidJob(t)).Spec.Template.Spec
+	spec.RestartPolicy = v1.RestartPolicyAlways
+	withPorts := *spec.DeepCopy()
+	withPorts.Containers[0].Ports = []v1.ContainerPort{{ContainerPort: 8080}}
+
+	request := func(kind string, spec v1.PodSpec) *admission.AdmissionRequest {
+		request := workloadRequest(t, map[string]interface{}{"spec": map[string]interface{}{"template": v1.PodTemplateSpec{Spec: spec}}})
+		request.Kind = k8meta.GroupVersionKind{Group: "apps", Version: "v1", Kind: kind}
+		request.RequestKind = &request.Kind
+		return request
+	}
+	defaults := &AdmissionHandler{RuntimeClass: "gvisor"}
+
+	for _, kind := range []string{"Deployment", "StatefulSet", "DaemonSet", "ReplicaSet"} {
+		if allowed, _, err := checkRequest(context.Background(), request(kind, spec), defaults); !allowed {
+			t.Errorf("Valid %v was denied: %v", kind, err)
+		}
+		allowed, _, err := checkRequest(context.Background(), request(kind, withPorts), defaults)
+		if allowed || !strings.HasPrefix(err.Error(), "spec.template.spec.containers[0].ports: Forbidden") {
+			t.Errorf("%v with ports must be denied with the template path, got %v", kind, err)
+		}
+	}
+
+	policy := &Policy{}
+	if err := yaml.Unmarshal([]byte(`
+workloads:
+- group: apps
+  kind: Deployment
+  ruleGroups: [runtime, host, pod, securityContext, resources]
+`), policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if paths := policy.Workloads[0].PodTemplatePaths; len(paths) != 1 || paths[0] != "spec.template" || &paths[0] == &appsTemplatePaths[0] {
+		t.Fatalf("apps/v1 kinds must default to a copy of spec.template, got %v", paths)
+	}
+	handler := &AdmissionHandler{RuntimeClass: "gvisor", Policy: policy}
+	if allowed, _, err := checkRequest(context.Background(), request("Deployment", withPorts), handler); !allowed {
+		t.Fatalf("Deployment must skip the ports group: %v", err)
+	}
+	if allowed, _, _ := checkRequest(context.Background(), request("StatefulSet", withPorts), handler); allowed {
+		t.Fatalf("Kinds not in the policy must use every group")
+	}
+	withPorts.HostPID = true
+	if allowed, _, _ := checkRequest(context.Background(), request("Deployment", withPorts), handler); allowed {
+		t.Fatalf("Deployment must run the host group")
+	}
+
+	invalid := WorkloadRule{Group: "apps", Kind: "Deployment", PodTemplatePaths: []string{"spec.template"}, RuleGroups: []string{"jobs"}}
+	if err := invalid.validate(); err == nil {
+		t.Fatalf("Unknown rule group was accepted")
+	}
+}
+
+func TestAppsWorkloadUpdates(t *testing.T) {
+	spec := loadJob(t, loadValidJob(t)).Spec.Template.Spec
+	spec.RestartPolicy = v1.RestartPolicyAlways
+	invalid := *spec.DeepCopy()
+	invalid.HostNetwork = true
+	hostPID := *invalid.DeepCopy()
+	hostPID.HostPID = true
+	object := func(replicas int, spec v1.PodSpec) map[string]interface{} {
+		return map[string]interface{}{"spec": map[string]interface{}{"replicas": replicas, "template": v1.PodTemplateSpec{Spec: spec}}}
+	}
+	update := func(old, new map[string]interface{}) *admission.AdmissionRequest {
+		request := workloadRequest(t, new)
+		request.Kind = k8meta.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+		request.RequestKind = &request.Kind
+		request.Operation = admission.Update
+		raw, err := json.Marshal(old)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.OldObject = runtime.RawExtension{Raw: raw}
+		return request
+	}
+	handler := &AdmissionHandler{RuntimeClass: "gvisor"}
+
+	tests := []struct {
+		name     string
+		old, new map[string]interface{}
+		allowed  bool
+	}{
+		{"scale of a non-compliant deployment", object(3, invalid), object(1, invalid), true},
+		{"template change", object(1, spec), object(1, invalid), false},
+		{"template change of a non-compliant deployment", object(1, invalid), object(1, hostPID), false},
+		{"compliant template change", object(1, invalid), object(1, spec), true},
+	}
+	for _, test := range tests {
+		if allowed, _, err := checkRequest(context.Background(), update(test.old, test.new), handler); allowed != test.allowed {
+			t.Errorf("%v: expected allowed %v, got %v", test.name, test.allowed, err)
+		}
+	}
+}